@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// dlqSelection picks dead-lettered messages by message ID. An empty selection
+// with All set matches every message.
+type dlqSelection struct {
+	IDs map[string]bool
+	All bool
+}
+
+func parseDLQSelection(ids string, all bool) (dlqSelection, error) {
+	selection := dlqSelection{IDs: map[string]bool{}, All: all}
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			selection.IDs[id] = true
+		}
+	}
+
+	if all && len(selection.IDs) > 0 {
+		return selection, errors.New("use either -ids or -all, not both")
+	}
+	if !all && len(selection.IDs) == 0 {
+		return selection, errors.New("select messages with -ids id1,id2 or -all")
+	}
+	return selection, nil
+}
+
+func (s dlqSelection) matches(message *azservicebus.ReceivedMessage) bool {
+	return s.All || s.IDs[message.MessageID]
+}
+
+func newDeadLetterReceiver(client *azservicebus.Client, queueName string) (*azservicebus.Receiver, error) {
+	receiver, err := client.NewReceiverForQueue(queueName, &azservicebus.ReceiverOptions{
+		SubQueue: azservicebus.SubQueueDeadLetter,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new dead-letter receiver: %w", err)
+	}
+	return receiver, nil
+}
+
+// listDeadLetters peeks the whole dead-letter queue without locking anything.
+func listDeadLetters(ctx context.Context, client *azservicebus.Client, queueName string) error {
+	receiver, err := newDeadLetterReceiver(client, queueName)
+	if err != nil {
+		return err
+	}
+	defer receiver.Close(ctx)
+
+	total := 0
+	for {
+		// Each call continues after the last peeked sequence number
+		messages, err := receiver.PeekMessages(ctx, 50, nil)
+		if err != nil {
+			return fmt.Errorf("peek dead letters: %w", err)
+		}
+		if len(messages) == 0 {
+			break
+		}
+
+		for _, message := range messages {
+			printReceivedMessage(message)
+		}
+		total += len(messages)
+	}
+
+	fmt.Printf("%d dead-lettered message(s) in %s\n", total, queueName)
+	return nil
+}
+
+// settleDeadLetters receives the dead-letter queue in peek-lock mode, runs
+// action on every selected message and completes it. Messages that are not
+// selected stay locked until the queue is drained, so they are not received
+// twice, and are then abandoned back to the dead-letter queue.
+func settleDeadLetters(ctx context.Context, client *azservicebus.Client, queueName string, selection dlqSelection, action func(*azservicebus.ReceivedMessage) error) (int, error) {
+	receiver, err := newDeadLetterReceiver(client, queueName)
+	if err != nil {
+		return 0, err
+	}
+	defer receiver.Close(ctx)
+
+	var skipped []*azservicebus.ReceivedMessage
+	defer func() {
+		for _, message := range skipped {
+			if err := receiver.AbandonMessage(ctx, message, nil); err != nil {
+				log.Printf("abandon dead letter %s: %v", message.MessageID, err)
+			}
+		}
+	}()
+
+	settled := 0
+	for {
+		receiveCtx, receiveCancel := context.WithTimeout(ctx, 5*time.Second)
+		messages, err := receiver.ReceiveMessages(receiveCtx, 50, nil)
+		receiveCancel()
+
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return settled, fmt.Errorf("receive dead letters: %w", err)
+		}
+		if len(messages) == 0 {
+			return settled, nil
+		}
+
+		for _, message := range messages {
+			if !selection.matches(message) {
+				skipped = append(skipped, message)
+				continue
+			}
+
+			if err := action(message); err != nil {
+				skipped = append(skipped, message)
+				return settled, err
+			}
+			if err := receiver.CompleteMessage(ctx, message, nil); err != nil {
+				return settled, fmt.Errorf("complete dead letter %s: %w", message.MessageID, err)
+			}
+			settled++
+		}
+	}
+}
+
+// resubmitMessageID gives a resubmitted dead letter its own MessageID. Keeping
+// the original one would let duplicate detection drop the copy while the dead
+// letter is completed, losing the message. It is derived from the dead-letter
+// sequence number, so sending the same dead letter again after a failed
+// complete is still deduplicated.
+func resubmitMessageID(message *azservicebus.ReceivedMessage, originalID string) string {
+	return fmt.Sprintf("%s-resubmit-%d", originalID, ptr.Deref(message.SequenceNumber))
+}
+
+// resubmitDeadLetters sends the selected dead letters back to the main queue.
+// The copy keeps the body and properties under a new MessageID, and records
+// the original MessageID and where it came from.
+func resubmitDeadLetters(ctx context.Context, client *azservicebus.Client, queueName string, selection dlqSelection) error {
+	sender, err := client.NewSender(queueName, nil)
+	if err != nil {
+		return fmt.Errorf("new sender: %w", err)
+	}
+	defer sender.Close(ctx)
+
+	resubmitted, err := settleDeadLetters(ctx, client, queueName, selection, func(message *azservicebus.ReceivedMessage) error {
+		copied := message.Message()
+		copied.ApplicationProperties = map[string]any{}
+		for key, value := range message.ApplicationProperties {
+			copied.ApplicationProperties[key] = value
+		}
+		// A message resubmitted before keeps its first MessageID as the original
+		originalID, ok := copied.ApplicationProperties["originalMessageId"].(string)
+		if !ok {
+			originalID = message.MessageID
+		}
+		copied.MessageID = ptr.To(resubmitMessageID(message, originalID))
+		copied.ApplicationProperties["originalMessageId"] = originalID
+		copied.ApplicationProperties["resubmittedAt"] = time.Now().UTC()
+		copied.ApplicationProperties["deadLetterReason"] = ptr.Deref(message.DeadLetterReason)
+		// Scheduled messages would wait for their original time again
+		copied.ScheduledEnqueueTime = nil
+
+		if err := sender.SendMessage(ctx, copied, nil); err != nil {
+			return fmt.Errorf("resubmit %s: %w", message.MessageID, err)
+		}
+		log.Printf("Resubmitted: messageId=%s as %s", message.MessageID, ptr.Deref(copied.MessageID))
+		return nil
+	})
+
+	log.Printf("Resubmitted %d dead-lettered message(s) to %s", resubmitted, queueName)
+	return err
+}
+
+// purgeDeadLetters deletes the selected dead letters.
+func purgeDeadLetters(ctx context.Context, client *azservicebus.Client, queueName string, selection dlqSelection) error {
+	purged, err := settleDeadLetters(ctx, client, queueName, selection, func(message *azservicebus.ReceivedMessage) error {
+		log.Printf("Purged: messageId=%s", message.MessageID)
+		return nil
+	})
+
+	log.Printf("Purged %d dead-lettered message(s) from %s", purged, queueName)
+	return err
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// emulatorQueue returns a client for the local Service Bus emulator and a
+// queue emptied of messages and dead letters, or skips the test when the
+// emulator is not running. The queue comes from the emulator Config.json:
+// SERVICEBUS_EMULATOR_QUEUE, or queue.1 of the default configuration.
+func emulatorQueue(t *testing.T) (*azservicebus.Client, string) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", "localhost:5672", time.Second)
+	if err != nil {
+		t.Skip("Service Bus emulator is not running on localhost:5672")
+	}
+	conn.Close()
+
+	client, err := newClient("", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close(context.Background()) })
+
+	queueName := os.Getenv("SERVICEBUS_EMULATOR_QUEUE")
+	if queueName == "" {
+		queueName = "queue.1"
+	}
+
+	drain(t, client, queueName, azservicebus.SubQueue(0))
+	drain(t, client, queueName, azservicebus.SubQueueDeadLetter)
+	return client, queueName
+}
+
+// drain deletes every message of the queue or one of its subqueues.
+func drain(t *testing.T, client *azservicebus.Client, queueName string, subQueue azservicebus.SubQueue) {
+	t.Helper()
+
+	receiver, err := client.NewReceiverForQueue(queueName, &azservicebus.ReceiverOptions{
+		ReceiveMode: azservicebus.ReceiveModeReceiveAndDelete,
+		SubQueue:    subQueue,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close(context.Background())
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		messages, err := receiver.ReceiveMessages(ctx, 100, nil)
+		cancel()
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("drain %s: %v", queueName, err)
+		}
+		if len(messages) == 0 {
+			return
+		}
+	}
+}
+
+func sendTestMessage(t *testing.T, client *azservicebus.Client, queueName string, id string, properties map[string]any) {
+	t.Helper()
+
+	sender, err := client.NewSender(queueName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close(context.Background())
+
+	err = sender.SendMessage(context.Background(), &azservicebus.Message{
+		MessageID:             &id,
+		Body:                  []byte("body of " + id),
+		ApplicationProperties: properties,
+	}, nil)
+	if err != nil {
+		t.Fatalf("send %s: %v", id, err)
+	}
+}
+
+// receiveOne waits up to 5s for the next message, nil if none arrives.
+func receiveOne(t *testing.T, receiver *azservicebus.Receiver) *azservicebus.ReceivedMessage {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages, err := receiver.ReceiveMessages(ctx, 1, nil)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("receive: %v", err)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return messages[0]
+}
+
+// deadLetterTestMessages sends and dead-letters a message for every ID.
+func deadLetterTestMessages(t *testing.T, client *azservicebus.Client, queueName string, ids ...string) {
+	t.Helper()
+
+	receiver, err := client.NewReceiverForQueue(queueName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close(context.Background())
+
+	for _, id := range ids {
+		sendTestMessage(t, client, queueName, id, map[string]any{"origin": "test"})
+		message := receiveOne(t, receiver)
+		if message == nil {
+			t.Fatalf("message %s was not received", id)
+		}
+		err := receiver.DeadLetterMessage(context.Background(), message, &azservicebus.DeadLetterOptions{
+			Reason: ptr.To("TestReason"),
+		})
+		if err != nil {
+			t.Fatalf("dead-letter %s: %v", id, err)
+		}
+	}
+}
+
+// peekDeadLetters returns the dead-lettered messages by message ID.
+func peekDeadLetters(t *testing.T, client *azservicebus.Client, queueName string) map[string]*azservicebus.ReceivedMessage {
+	t.Helper()
+
+	receiver, err := newDeadLetterReceiver(client, queueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close(context.Background())
+
+	messages, err := receiver.PeekMessages(context.Background(), 100, nil)
+	if err != nil {
+		t.Fatalf("peek dead letters: %v", err)
+	}
+
+	byID := map[string]*azservicebus.ReceivedMessage{}
+	for _, message := range messages {
+		byID[message.MessageID] = message
+	}
+	return byID
+}
+
+func failingHandler(ctx context.Context, message *azservicebus.ReceivedMessage) error {
+	return errors.New("handler failure")
+}
+
+func TestProcessMessageDeadLettersOnLastAttempt(t *testing.T) {
+	client, queueName := emulatorQueue(t)
+	id := fmt.Sprintf("last-attempt-%d", time.Now().UnixNano())
+	sendTestMessage(t, client, queueName, id, nil)
+
+	receiver, err := client.NewReceiverForQueue(queueName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close(context.Background())
+
+	options := receiverOptions{MaxAttempts: 2}
+	want := []messageOutcome{outcomeAbandoned, outcomeDeadLettered}
+	for attempt, wantOutcome := range want {
+		message := receiveOne(t, receiver)
+		if message == nil {
+			t.Fatalf("attempt %d: message was not received", attempt+1)
+		}
+		outcome, err := processMessage(context.Background(), receiver, message, failingHandler, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outcome != wantOutcome {
+			t.Fatalf("attempt %d: outcome = %d, want %d", attempt+1, outcome, wantOutcome)
+		}
+	}
+
+	deadLetter, ok := peekDeadLetters(t, client, queueName)[id]
+	if !ok {
+		t.Fatalf("message %s is not in the dead-letter queue", id)
+	}
+	if reason := ptr.Deref(deadLetter.DeadLetterReason); reason != deadLetterReasonHandlerFailed {
+		t.Errorf("dead-letter reason = %q, want %q", reason, deadLetterReasonHandlerFailed)
+	}
+	if description := ptr.Deref(deadLetter.DeadLetterErrorDescription); !strings.Contains(description, "attempt 2: handler failure") {
+		t.Errorf("dead-letter description = %q, want the attempt and handler error", description)
+	}
+}
+
+func TestServiceDeadLettersPastMaxDeliveryCount(t *testing.T) {
+	client, queueName := emulatorQueue(t)
+	id := fmt.Sprintf("max-delivery-%d", time.Now().UnixNano())
+	sendTestMessage(t, client, queueName, id, nil)
+
+	receiver, err := client.NewReceiverForQueue(queueName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close(context.Background())
+
+	// MaxAttempts above the queue MaxDeliveryCount: the receiver keeps
+	// abandoning and the service dead-letters the message
+	options := receiverOptions{MaxAttempts: 1000}
+	for attempt := 1; ; attempt++ {
+		message := receiveOne(t, receiver)
+		if message == nil {
+			break
+		}
+		if attempt > 100 {
+			t.Fatal("message was never dead-lettered by the service")
+		}
+		if _, err := processMessage(context.Background(), receiver, message, failingHandler, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadLetter, ok := peekDeadLetters(t, client, queueName)[id]
+	if !ok {
+		t.Fatalf("message %s is not in the dead-letter queue", id)
+	}
+	if reason := ptr.Deref(deadLetter.DeadLetterReason); reason != "MaxDeliveryCountExceeded" {
+		t.Errorf("dead-letter reason = %q, want MaxDeliveryCountExceeded", reason)
+	}
+}
+
+func TestResubmitDeadLetters(t *testing.T) {
+	client, queueName := emulatorQueue(t)
+	id := fmt.Sprintf("resubmit-%d", time.Now().UnixNano())
+	deadLetterTestMessages(t, client, queueName, id)
+
+	selection, err := parseDLQSelection(id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resubmitDeadLetters(context.Background(), client, queueName, selection); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := peekDeadLetters(t, client, queueName)[id]; ok {
+		t.Errorf("message %s is still in the dead-letter queue", id)
+	}
+
+	receiver, err := client.NewReceiverForQueue(queueName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close(context.Background())
+
+	message := receiveOne(t, receiver)
+	if message == nil {
+		t.Fatal("resubmitted message was not received from the main queue")
+	}
+	defer receiver.CompleteMessage(context.Background(), message, nil)
+
+	// A new MessageID keeps duplicate detection from dropping the copy
+	if message.MessageID == id || !strings.HasPrefix(message.MessageID, id+"-resubmit-") {
+		t.Errorf("message ID = %q, want a new ID derived from %q", message.MessageID, id)
+	}
+	if original := message.ApplicationProperties["originalMessageId"]; original != id {
+		t.Errorf("originalMessageId property = %v, want %q", original, id)
+	}
+	if body := string(message.Body); body != "body of "+id {
+		t.Errorf("body = %q, want %q", body, "body of "+id)
+	}
+	if origin := message.ApplicationProperties["origin"]; origin != "test" {
+		t.Errorf("origin property = %v, want test", origin)
+	}
+	if reason := message.ApplicationProperties["deadLetterReason"]; reason != "TestReason" {
+		t.Errorf("deadLetterReason property = %v, want TestReason", reason)
+	}
+}
+
+func TestPurgeDeadLetters(t *testing.T) {
+	client, queueName := emulatorQueue(t)
+	suffix := time.Now().UnixNano()
+	purged, kept := fmt.Sprintf("purged-%d", suffix), fmt.Sprintf("kept-%d", suffix)
+	deadLetterTestMessages(t, client, queueName, purged, kept)
+
+	selection, err := parseDLQSelection(purged, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := purgeDeadLetters(context.Background(), client, queueName, selection); err != nil {
+		t.Fatal(err)
+	}
+
+	deadLetters := peekDeadLetters(t, client, queueName)
+	if _, ok := deadLetters[purged]; ok {
+		t.Errorf("selected message %s was not purged", purged)
+	}
+	if _, ok := deadLetters[kept]; !ok {
+		t.Errorf("unselected message %s was purged", kept)
+	}
+
+	selection, err = parseDLQSelection("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := purgeDeadLetters(context.Background(), client, queueName, selection); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(peekDeadLetters(t, client, queueName)); n != 0 {
+		t.Errorf("%d dead letters left after purging all, want 0", n)
+	}
+}
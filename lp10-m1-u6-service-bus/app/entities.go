@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
+
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// entitySettings holds the queue and topic settings given on the command
+// line. Nil fields were not given and keep the entity's current (or, when
+// creating, the service default) value.
+type entitySettings struct {
+	LockDuration             *time.Duration
+	MaxDeliveryCount         *int32
+	DuplicateDetectionWindow *time.Duration
+	DeadLetterOnExpiration   *bool
+}
+
+// isoDuration formats d the way the management API expects, e.g. PT1M30S.
+func isoDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+
+	var b strings.Builder
+	b.WriteString("P")
+	if days := d / (24 * time.Hour); days > 0 {
+		fmt.Fprintf(&b, "%dD", days)
+		d -= days * 24 * time.Hour
+	}
+	if d == 0 {
+		if b.Len() == 1 {
+			return "PT0S"
+		}
+		return b.String()
+	}
+
+	b.WriteString("T")
+	if hours := d / time.Hour; hours > 0 {
+		fmt.Fprintf(&b, "%dH", hours)
+		d -= hours * time.Hour
+	}
+	if minutes := d / time.Minute; minutes > 0 {
+		fmt.Fprintf(&b, "%dM", minutes)
+		d -= minutes * time.Minute
+	}
+	if seconds := d / time.Second; seconds > 0 {
+		fmt.Fprintf(&b, "%dS", seconds)
+	}
+	return b.String()
+}
+
+// applyToQueue copies the given settings onto properties. A duplicate
+// detection window turns duplicate detection on, which is only possible when
+// the queue is created.
+func (s entitySettings) applyToQueue(properties *admin.QueueProperties) {
+	if s.LockDuration != nil {
+		properties.LockDuration = ptr.To(isoDuration(*s.LockDuration))
+	}
+	if s.MaxDeliveryCount != nil {
+		properties.MaxDeliveryCount = s.MaxDeliveryCount
+	}
+	if s.DuplicateDetectionWindow != nil {
+		properties.RequiresDuplicateDetection = ptr.To(true)
+		properties.DuplicateDetectionHistoryTimeWindow = ptr.To(isoDuration(*s.DuplicateDetectionWindow))
+	}
+	if s.DeadLetterOnExpiration != nil {
+		properties.DeadLetteringOnMessageExpiration = s.DeadLetterOnExpiration
+	}
+}
+
+// applyToTopic copies the given settings onto properties. Locks, delivery
+// counts and dead-lettering belong to the subscriptions of a topic, so only
+// duplicate detection can be set here.
+func (s entitySettings) applyToTopic(properties *admin.TopicProperties) error {
+	if s.LockDuration != nil || s.MaxDeliveryCount != nil || s.DeadLetterOnExpiration != nil {
+		return errors.New("lock duration, max delivery count and dead-lettering on expiration are subscription settings, not topic settings")
+	}
+	if s.DuplicateDetectionWindow != nil {
+		properties.RequiresDuplicateDetection = ptr.To(true)
+		properties.DuplicateDetectionHistoryTimeWindow = ptr.To(isoDuration(*s.DuplicateDetectionWindow))
+	}
+	return nil
+}
+
+func createQueue(ctx context.Context, adminClient *admin.Client, queueName string, settings entitySettings) error {
+	properties := &admin.QueueProperties{}
+	settings.applyToQueue(properties)
+
+	resp, err := adminClient.CreateQueue(ctx, queueName, &admin.CreateQueueOptions{Properties: properties})
+	if isStatus(err, http.StatusConflict) {
+		log.Printf("Queue %s already exists, use -mode update-queue to change it", queueName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("create queue: %w", err)
+	}
+
+	log.Printf("Created queue %s", queueName)
+	printQueueProperties(resp.QueueProperties)
+	return nil
+}
+
+// updateQueue reads the queue and writes it back with settings applied, since
+// UpdateQueue replaces every property.
+func updateQueue(ctx context.Context, adminClient *admin.Client, queueName string, settings entitySettings) error {
+	current, err := adminClient.GetQueue(ctx, queueName, nil)
+	if err != nil {
+		return fmt.Errorf("get queue: %w", err)
+	}
+	if current == nil {
+		return fmt.Errorf("queue %s not found", queueName)
+	}
+
+	if settings.DuplicateDetectionWindow != nil && !ptr.Deref(current.RequiresDuplicateDetection) {
+		return fmt.Errorf("queue %s was created without duplicate detection; it cannot be turned on afterwards", queueName)
+	}
+
+	properties := current.QueueProperties
+	settings.applyToQueue(&properties)
+
+	resp, err := adminClient.UpdateQueue(ctx, queueName, properties, nil)
+	if err != nil {
+		return fmt.Errorf("update queue: %w", err)
+	}
+
+	log.Printf("Updated queue %s", queueName)
+	printQueueProperties(resp.QueueProperties)
+	return nil
+}
+
+func deleteQueue(ctx context.Context, adminClient *admin.Client, queueName string) error {
+	_, err := adminClient.DeleteQueue(ctx, queueName, nil)
+	if isStatus(err, http.StatusNotFound) {
+		log.Printf("Queue %s does not exist", queueName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("delete queue: %w", err)
+	}
+
+	log.Printf("Deleted queue %s", queueName)
+	return nil
+}
+
+func updateTopic(ctx context.Context, adminClient *admin.Client, topicName string, settings entitySettings) error {
+	current, err := adminClient.GetTopic(ctx, topicName, nil)
+	if err != nil {
+		return fmt.Errorf("get topic: %w", err)
+	}
+	if current == nil {
+		return fmt.Errorf("topic %s not found", topicName)
+	}
+
+	if settings.DuplicateDetectionWindow != nil && !ptr.Deref(current.RequiresDuplicateDetection) {
+		return fmt.Errorf("topic %s was created without duplicate detection; it cannot be turned on afterwards", topicName)
+	}
+
+	properties := current.TopicProperties
+	if err := settings.applyToTopic(&properties); err != nil {
+		return err
+	}
+
+	resp, err := adminClient.UpdateTopic(ctx, topicName, properties, nil)
+	if err != nil {
+		return fmt.Errorf("update topic: %w", err)
+	}
+
+	log.Printf("Updated topic %s", topicName)
+	printTopicProperties(resp.TopicProperties)
+	return nil
+}
+
+func deleteTopic(ctx context.Context, adminClient *admin.Client, topicName string) error {
+	_, err := adminClient.DeleteTopic(ctx, topicName, nil)
+	if isStatus(err, http.StatusNotFound) {
+		log.Printf("Topic %s does not exist", topicName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("delete topic: %w", err)
+	}
+
+	log.Printf("Deleted topic %s (and all its subscriptions)", topicName)
+	return nil
+}
+
+// listEntities prints every queue and topic of the namespace with its main
+// settings and runtime counts.
+func listEntities(ctx context.Context, adminClient *admin.Client) error {
+	queueCounts := map[string]admin.QueueRuntimeProperties{}
+	runtimePager := adminClient.NewListQueuesRuntimePropertiesPager(nil)
+	for runtimePager.More() {
+		page, err := runtimePager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("list queue runtime properties: %w", err)
+		}
+		for _, item := range page.QueueRuntimeProperties {
+			queueCounts[item.QueueName] = item.QueueRuntimeProperties
+		}
+	}
+
+	fmt.Println("Queues:")
+	queues := 0
+	queuePager := adminClient.NewListQueuesPager(nil)
+	for queuePager.More() {
+		page, err := queuePager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("list queues: %w", err)
+		}
+		for _, queue := range page.Queues {
+			queues++
+			fmt.Printf("- %s\n", queue.QueueName)
+			printQueueProperties(queue.QueueProperties)
+			if counts, ok := queueCounts[queue.QueueName]; ok {
+				printQueueRuntimeProperties(counts)
+			}
+		}
+	}
+
+	topicCounts := map[string]admin.TopicRuntimeProperties{}
+	topicRuntimePager := adminClient.NewListTopicsRuntimePropertiesPager(nil)
+	for topicRuntimePager.More() {
+		page, err := topicRuntimePager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("list topic runtime properties: %w", err)
+		}
+		for _, item := range page.TopicRuntimeProperties {
+			topicCounts[item.TopicName] = item.TopicRuntimeProperties
+		}
+	}
+
+	fmt.Println("Topics:")
+	topics := 0
+	topicPager := adminClient.NewListTopicsPager(nil)
+	for topicPager.More() {
+		page, err := topicPager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("list topics: %w", err)
+		}
+		for _, topic := range page.Topics {
+			topics++
+			fmt.Printf("- %s\n", topic.TopicName)
+			printTopicProperties(topic.TopicProperties)
+			if counts, ok := topicCounts[topic.TopicName]; ok {
+				printTopicRuntimeProperties(counts)
+			}
+		}
+	}
+
+	fmt.Printf("%d queue(s), %d topic(s)\n", queues, topics)
+	return nil
+}
+
+// showQueue prints the settings and current message counts of one queue.
+func showQueue(ctx context.Context, adminClient *admin.Client, queueName string) error {
+	queue, err := adminClient.GetQueue(ctx, queueName, nil)
+	if err != nil {
+		return fmt.Errorf("get queue: %w", err)
+	}
+	if queue == nil {
+		return fmt.Errorf("queue %s not found", queueName)
+	}
+
+	counts, err := adminClient.GetQueueRuntimeProperties(ctx, queueName, nil)
+	if err != nil {
+		return fmt.Errorf("get queue runtime properties: %w", err)
+	}
+
+	fmt.Printf("Queue %s\n", queueName)
+	printQueueProperties(queue.QueueProperties)
+	printQueueRuntimeProperties(counts.QueueRuntimeProperties)
+	return nil
+}
+
+// showTopic prints the settings and counts of a topic and the message counts
+// of each of its subscriptions, which is where the messages actually wait.
+func showTopic(ctx context.Context, adminClient *admin.Client, topicName string) error {
+	topic, err := adminClient.GetTopic(ctx, topicName, nil)
+	if err != nil {
+		return fmt.Errorf("get topic: %w", err)
+	}
+	if topic == nil {
+		return fmt.Errorf("topic %s not found", topicName)
+	}
+
+	counts, err := adminClient.GetTopicRuntimeProperties(ctx, topicName, nil)
+	if err != nil {
+		return fmt.Errorf("get topic runtime properties: %w", err)
+	}
+
+	fmt.Printf("Topic %s\n", topicName)
+	printTopicProperties(topic.TopicProperties)
+	printTopicRuntimeProperties(counts.TopicRuntimeProperties)
+
+	pager := adminClient.NewListSubscriptionsRuntimePropertiesPager(topicName, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("list subscription runtime properties: %w", err)
+		}
+		for _, subscription := range page.SubscriptionRuntimeProperties {
+			fmt.Printf("  subscription %s: active=%d deadLetter=%d transfer=%d transferDeadLetter=%d total=%d\n",
+				subscription.SubscriptionName, subscription.ActiveMessageCount, subscription.DeadLetterMessageCount,
+				subscription.TransferMessageCount, subscription.TransferDeadLetterMessageCount, subscription.TotalMessageCount)
+		}
+	}
+	return nil
+}
+
+func printQueueProperties(properties admin.QueueProperties) {
+	fmt.Printf("  lockDuration=%s maxDeliveryCount=%d duplicateDetection=%t window=%s deadLetterOnExpiration=%t sessions=%t status=%s\n",
+		ptr.Deref(properties.LockDuration), ptr.Deref(properties.MaxDeliveryCount),
+		ptr.Deref(properties.RequiresDuplicateDetection), ptr.Deref(properties.DuplicateDetectionHistoryTimeWindow),
+		ptr.Deref(properties.DeadLetteringOnMessageExpiration), ptr.Deref(properties.RequiresSession), entityStatus(properties.Status))
+}
+
+func printQueueRuntimeProperties(counts admin.QueueRuntimeProperties) {
+	fmt.Printf("  active=%d deadLetter=%d scheduled=%d transfer=%d transferDeadLetter=%d total=%d size=%dB\n",
+		counts.ActiveMessageCount, counts.DeadLetterMessageCount, counts.ScheduledMessageCount,
+		counts.TransferMessageCount, counts.TransferDeadLetterMessageCount, counts.TotalMessageCount, counts.SizeInBytes)
+}
+
+func printTopicProperties(properties admin.TopicProperties) {
+	fmt.Printf("  duplicateDetection=%t window=%s defaultTTL=%s status=%s\n",
+		ptr.Deref(properties.RequiresDuplicateDetection), ptr.Deref(properties.DuplicateDetectionHistoryTimeWindow),
+		ptr.Deref(properties.DefaultMessageTimeToLive), entityStatus(properties.Status))
+}
+
+func printTopicRuntimeProperties(counts admin.TopicRuntimeProperties) {
+	fmt.Printf("  subscriptions=%d scheduled=%d size=%dB\n", counts.SubscriptionCount, counts.ScheduledMessageCount, counts.SizeInBytes)
+}
+
+func entityStatus(status *admin.EntityStatus) string {
+	if status == nil {
+		return ""
+	}
+	return string(*status)
+}
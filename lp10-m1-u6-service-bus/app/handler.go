@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"github.com/neovasili/training-az-204/pkg/messaging"
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// Dead-letter reason set by the receiver when the handler gives up on a message.
+const deadLetterReasonHandlerFailed = "HandlerFailed"
+
+// MessageHandler processes one received message. Returning an error abandons
+// the message for a retry, or dead-letters it once MaxAttempts is reached.
+type MessageHandler func(ctx context.Context, message *azservicebus.ReceivedMessage) error
+
+// newDemoHandler simulates work that takes workTime and fails with
+// probability failRate. Messages containing "poison" always fail, which makes
+// it easy to watch a message end up in the dead-letter queue.
+func newDemoHandler(workTime time.Duration, failRate float64) MessageHandler {
+	return func(ctx context.Context, message *azservicebus.ReceivedMessage) error {
+		body := string(message.Body)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(workTime):
+		}
+
+		if strings.Contains(body, "poison") {
+			return errors.New("message marked as poison")
+		}
+		if rand.Float64() < failRate {
+			return errors.New("simulated handler failure")
+		}
+
+		log.Printf("Processed: messageId=%s body=%s", message.MessageID, body)
+		return nil
+	}
+}
+
+// receiverOptions controls how the receiver handles and settles messages.
+type receiverOptions struct {
+	// MaxAttempts is the number of deliveries before a failing message is
+	// dead-lettered by the receiver. It should not exceed the queue
+	// MaxDeliveryCount, otherwise the service dead-letters it first with
+	// reason MaxDeliveryCountExceeded.
+	MaxAttempts uint32
+	// DeferWhen decides which messages are deferred instead of handled. Their
+	// sequence numbers are logged so they can be fetched later. Nil defers none.
+	DeferWhen func(message *azservicebus.ReceivedMessage) bool
+	// MaxInFlight is the number of messages handled concurrently.
+	MaxInFlight int
+	// DrainTimeout bounds how long in-flight handlers may run after Ctrl+C.
+	DrainTimeout time.Duration
+	// ReceiveMode ReceiveAndDelete removes messages as they are received, so
+	// they are neither settled nor retried: a failed handler loses the message.
+	ReceiveMode azservicebus.ReceiveMode
+	// SubQueue receives from the dead-letter or transfer dead-letter queue.
+	SubQueue azservicebus.SubQueue
+	// Recorder, when set, records every message on its first delivery, before it is handled.
+	Recorder *messaging.Recorder
+}
+
+// deferFlagged defers messages sent with the application property defer=true.
+func deferFlagged(message *azservicebus.ReceivedMessage) bool {
+	value, ok := message.ApplicationProperties["defer"].(bool)
+	return ok && value
+}
+
+// messageSettler is implemented by both Receiver and SessionReceiver.
+type messageSettler interface {
+	CompleteMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions) error
+	AbandonMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions) error
+	DeadLetterMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeadLetterOptions) error
+	DeferMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeferMessageOptions) error
+}
+
+// messageOutcome tells the receiver how a message was settled.
+type messageOutcome int
+
+const (
+	outcomeCompleted messageOutcome = iota
+	outcomeAbandoned
+	outcomeDeadLettered
+	outcomeDeferred
+)
+
+// lockRenewer is implemented by Receiver. Session receivers renew the session
+// lock instead, which covers all its messages.
+type lockRenewer interface {
+	RenewMessageLock(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.RenewMessageLockOptions) error
+}
+
+// processMessage runs handler and settles the message: complete on success,
+// abandon on failure, or dead-letter with the handler error as description on
+// the last attempt. Messages matched by DeferWhen are deferred unhandled.
+// The message lock is renewed while the handler runs. If ctx is cancelled
+// the handler is interrupted and the message abandoned, whatever the attempt.
+func processMessage(ctx context.Context, receiver messageSettler, message *azservicebus.ReceivedMessage, handler MessageHandler, options receiverOptions) (messageOutcome, error) {
+	// Settlement must still go through when ctx is cancelled
+	settleCtx := context.WithoutCancel(ctx)
+
+	if options.DeferWhen != nil && options.DeferWhen(message) {
+		if err := receiver.DeferMessage(settleCtx, message, nil); err != nil {
+			return outcomeAbandoned, fmt.Errorf("defer message: %w", err)
+		}
+		log.Printf("Deferred: messageId=%s sequence=%d (fetch it with -mode receive-deferred -sequence-numbers %d)",
+			message.MessageID, ptr.Deref(message.SequenceNumber), ptr.Deref(message.SequenceNumber))
+		return outcomeDeferred, nil
+	}
+
+	handlerErr := runWithLockRenewal(ctx, receiver, message, handler)
+
+	if handlerErr != nil && ctx.Err() != nil {
+		log.Printf("Abandoning unfinished message on shutdown: messageId=%s", message.MessageID)
+		if err := receiver.AbandonMessage(settleCtx, message, nil); err != nil {
+			return outcomeAbandoned, fmt.Errorf("abandon message: %w", err)
+		}
+		return outcomeAbandoned, nil
+	}
+
+	if handlerErr == nil {
+		// Complete (peek-lock pattern)
+		if err := receiver.CompleteMessage(settleCtx, message, nil); err != nil {
+			return outcomeAbandoned, fmt.Errorf("complete message: %w", err)
+		}
+		return outcomeCompleted, nil
+	}
+
+	if message.DeliveryCount < options.MaxAttempts {
+		log.Printf("Handler failed: messageId=%s attempt=%d/%d: %v", message.MessageID, message.DeliveryCount, options.MaxAttempts, handlerErr)
+		if err := receiver.AbandonMessage(settleCtx, message, nil); err != nil {
+			return outcomeAbandoned, fmt.Errorf("abandon message: %w", err)
+		}
+		return outcomeAbandoned, nil
+	}
+
+	err := receiver.DeadLetterMessage(settleCtx, message, &azservicebus.DeadLetterOptions{
+		Reason:           ptr.To(deadLetterReasonHandlerFailed),
+		ErrorDescription: ptr.To(fmt.Sprintf("attempt %d: %v", message.DeliveryCount, handlerErr)),
+	})
+	if err != nil {
+		return outcomeAbandoned, fmt.Errorf("dead-letter message: %w", err)
+	}
+
+	log.Printf("Dead-lettered: messageId=%s after %d attempt(s): %v", message.MessageID, message.DeliveryCount, handlerErr)
+	return outcomeDeadLettered, nil
+}
+
+// runWithLockRenewal runs handler while renewing the message lock whenever half
+// of its remaining duration has passed, so slow handlers keep the message.
+func runWithLockRenewal(ctx context.Context, receiver messageSettler, message *azservicebus.ReceivedMessage, handler MessageHandler) error {
+	renewer, ok := receiver.(lockRenewer)
+	if !ok || message.LockedUntil == nil {
+		return handler(ctx, message)
+	}
+
+	renewCtx, stopRenewing := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			wait := max(time.Until(*message.LockedUntil)/2, time.Second)
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-time.After(wait):
+			}
+
+			if err := renewer.RenewMessageLock(renewCtx, message, nil); err != nil {
+				if renewCtx.Err() == nil {
+					log.Printf("renew lock: messageId=%s: %v", message.MessageID, err)
+				}
+				return
+			}
+			log.Printf("Renewed lock: messageId=%s until %s", message.MessageID, message.LockedUntil.Format(time.RFC3339))
+		}
+	}()
+
+	err := handler(ctx, message)
+	stopRenewing()
+	wg.Wait()
+	return err
+}
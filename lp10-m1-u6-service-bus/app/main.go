@@ -2,31 +2,166 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
+
+	"github.com/neovasili/training-az-204/pkg/loadgen"
+	"github.com/neovasili/training-az-204/pkg/messaging"
+	"github.com/neovasili/training-az-204/pkg/ptr"
 )
 
+// Connection string of the local Service Bus emulator (not a secret)
+const emulatorConnectionString = "Endpoint=sb://localhost;SharedAccessKeyName=RootManageSharedAccessKey;" +
+	"SharedAccessKey=SAS_KEY_VALUE;UseDevelopmentEmulator=true;"
+
 func main() {
 	var (
-		mode     = flag.String("mode", "", "send|receive")
-		interval = flag.Duration("interval", 2*time.Second, "send interval (send mode)")
-		count    = flag.Int("count", 0, "messages to send (0 = forever) (send mode)")
+		mode     = flag.String("mode", "", "send|receive|peek|replay|bench|relay|session-receive|cancel-scheduled|receive-deferred|dlq|publish|subscribe|create-topic|create-subscription|add-rule|delete-rule|list-rules|routing-demo|list-entities|show-queue|create-queue|update-queue|delete-queue|show-topic|update-topic|delete-topic")
+		interval = flag.Duration("interval", 2*time.Second, "send interval (send/publish modes)")
+		count    = flag.Int("count", 0, "messages to send or peek (0 = forever or all) (send/publish/bench/peek modes)")
+		queue    = flag.String("queue", "training-queue", "queue name")
+
+		topicName        = flag.String("topic", "training-topic", "topic name (topic modes)")
+		subscriptionName = flag.String("subscription", "training-subscription", "subscription name (topic modes, empty lists every subscription in list-rules mode)")
+		ruleName         = flag.String("rule", "", "rule name (create-subscription/add-rule/delete-rule modes)")
+		ruleSQL          = flag.String("sql", "", `SQL filter expression, e.g. "priority > 5" (create-subscription/add-rule modes)`)
+		ruleCorrelation  = flag.String("correlation", "", "correlation filter key=value,... on subject/correlationId/... or application properties (create-subscription/add-rule modes)")
+		ruleAction       = flag.String("sql-action", "", `SQL rule action, e.g. "SET sys.Label = 'urgent'" (create-subscription/add-rule modes)`)
+
+		maxAttempts  = flag.Uint("max-attempts", 5, "deliveries before a failing message is dead-lettered (receive mode)")
+		maxInFlight  = flag.Int("max-in-flight", 1, "messages handled concurrently (receive/subscribe modes)")
+		drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "on Ctrl+C, how long to wait for in-flight handlers before abandoning their messages (receive/subscribe modes)")
+		receiveMode  = flag.String("receive-mode", "peek-lock", "peek-lock|receive-and-delete; receive-and-delete loses messages whose handler fails (receive/subscribe modes)")
+		subQueue     = flag.String("subqueue", "none", "none|deadletter|transfer (receive/subscribe/peek modes)")
+		fromSequence = flag.Int64("from-sequence", 0, "first sequence number to peek, 0 = oldest (peek mode)")
+		pageSize     = flag.Int("page-size", 50, "messages per PeekMessages call (peek mode)")
+		workTime     = flag.Duration("work", 0, "simulated processing time per message (receive mode)")
+		failRate     = flag.Float64("fail-rate", 0, "probability that the demo handler fails (receive mode)")
+
+		dlqAction = flag.String("action", "list", "list|resubmit|purge (dlq mode)")
+		dlqIDs    = flag.String("ids", "", "comma-separated message IDs to resubmit or purge (dlq mode)")
+		dlqAll    = flag.Bool("all", false, "resubmit or purge every dead-lettered message (dlq mode)")
+
+		contentType     = flag.String("content-type", "application/json", "ContentType of sent messages (send/publish modes)")
+		correlationID   = flag.String("correlation-id", "", "CorrelationID of sent messages (send/publish modes)")
+		messageIDExpr   = flag.String("message-id", "", `Go template for the MessageID, e.g. "order-{{.Counter}}", for duplicate detection (send/publish modes)`)
+		ttl             = flag.Duration("ttl", 0, "message time-to-live, 0 = entity default (send/publish modes)")
+		scheduleIn      = flag.Duration("schedule-in", 0, "schedule messages this far in the future instead of sending them now (send/publish modes)")
+		sequenceNumbers = flag.String("sequence-numbers", "", "comma-separated sequence numbers (cancel-scheduled/receive-deferred modes)")
+
+		senders      = flag.Int("senders", 4, "concurrent senders (bench mode)")
+		duration     = flag.Duration("duration", 0, "how long to run, 0 = until -count or Ctrl+C (bench mode)")
+		payloadSize  = flag.Int("payload-size", 256, "bytes of payload per message (bench mode)")
+		outputEntity = flag.String("output", "training-output-queue", "queue or topic the relayed messages are sent to (relay mode)")
+
+		sessionKeyExpr = flag.String("session-key", "", `Go template for the SessionID, e.g. "customer-{{mod .Counter 3}}"; sends to the session queue (send mode)`)
+		sessionID      = flag.String("session", "", "accept only this session instead of the next available one (session-receive mode)")
+		sessions       = flag.Int("sessions", 1, "sessions processed concurrently (session-receive mode)")
+		sessionIdle    = flag.Duration("session-idle", 10*time.Second, "release a session after this long without messages (session-receive mode)")
+
+		lockDuration       = flag.Duration("lock-duration", 0, "message lock duration, at most 5m (create-queue/update-queue modes)")
+		maxDeliveryCount   = flag.Int("max-delivery-count", 0, "deliveries before the service dead-letters a message (create-queue/update-queue modes)")
+		duplicateWindow    = flag.Duration("duplicate-window", 0, "duplicate detection window; turns duplicate detection on, which only works on create (create-/update-queue/topic modes)")
+		deadLetterOnExpiry = flag.Bool("dead-letter-on-expiration", false, "dead-letter expired messages instead of dropping them (create-queue/update-queue modes)")
+
+		recording = flag.String("recording", "", "NDJSON file received messages are appended to (receive/subscribe modes) or replayed from (replay mode)")
+		speed     = flag.Float64("speed", 1, "replay timing: 1 = original gaps, 2 = twice as fast, 0 = no gaps (replay mode)")
+
+		emulator  = flag.Bool("emulator", false, "use the local Service Bus emulator instead of the namespace")
+		transport = flag.String("transport", "", "servicebus|storagequeue|eventhubs: send or receive through the shared messaging package to compare transports (send/receive modes)")
 	)
+	properties := propertiesFlag{}
+	flag.Var(properties, "property", "application property key=value added to every message, repeatable (send/publish modes)")
 	flag.Parse()
 
-	if *mode != "send" && *mode != "receive" {
-		log.Fatal(`-mode is required and must be "send" or "receive"`)
+	switch *mode {
+	case "send", "receive", "peek", "replay", "bench", "relay", "session-receive", "cancel-scheduled", "receive-deferred", "dlq", "publish", "subscribe", "create-topic", "create-subscription", "add-rule", "delete-rule", "list-rules", "routing-demo",
+		"list-entities", "show-queue", "create-queue", "update-queue", "delete-queue", "show-topic", "update-topic", "delete-topic":
+	default:
+		log.Fatal(`-mode is required and must be one of send, receive, peek, replay, bench, relay, session-receive, cancel-scheduled, receive-deferred, dlq, publish, subscribe, create-topic, create-subscription, add-rule, delete-rule, list-rules, routing-demo, list-entities, show-queue, create-queue, update-queue, delete-queue, show-topic, update-topic, delete-topic`)
+	}
+
+	if *maxAttempts < 1 {
+		log.Fatal("-max-attempts must be at least 1")
+	}
+
+	if *maxInFlight < 1 {
+		log.Fatal("-max-in-flight must be at least 1")
+	}
+
+	if *speed < 0 {
+		log.Fatal("-speed must not be negative")
+	}
+	if *mode == "replay" && *recording == "" {
+		log.Fatal("-recording is required in replay mode")
+	}
+
+	if *fromSequence < 0 || *pageSize < 1 {
+		log.Fatal("-from-sequence must not be negative and -page-size at least 1")
+	}
+
+	receiveModeValue, err := parseReceiveMode(*receiveMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	subQueueValue, err := parseSubQueue(*subQueue)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *senders < 1 || *payloadSize < 0 {
+		log.Fatal("-senders must be at least 1 and -payload-size not negative")
+	}
+
+	if *sessions < 1 || *sessionIdle <= 0 {
+		log.Fatal("-sessions must be at least 1 and -session-idle positive")
+	}
+
+	// Settings not given on the command line keep their current or default value
+	var settings entitySettings
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "lock-duration":
+			settings.LockDuration = lockDuration
+		case "max-delivery-count":
+			settings.MaxDeliveryCount = ptr.To(int32(*maxDeliveryCount))
+		case "duplicate-window":
+			settings.DuplicateDetectionWindow = duplicateWindow
+		case "dead-letter-on-expiration":
+			settings.DeadLetterOnExpiration = deadLetterOnExpiry
+		}
+	})
+	if settings.MaxDeliveryCount != nil && *settings.MaxDeliveryCount < 1 {
+		log.Fatal("-max-delivery-count must be at least 1")
+	}
+
+	sessionKey, err := newSessionKey(*sessionKeyExpr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var messageID *template.Template
+	if *messageIDExpr != "" {
+		if messageID, err = loadgen.NewTemplate("message id", *messageIDExpr); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	serviceBusNamespaceFqdn := "service-bus-test-sbns.servicebus.windows.net"
-	queueName := "training-queue"
+	queueName := *queue
+	sessionQueueName := "training-session-queue"
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -45,103 +180,407 @@ func main() {
 		log.Fatalf("credential: %v", err)
 	}
 
-	client, err := azservicebus.NewClient(serviceBusNamespaceFqdn, credential, nil)
+	// -transport runs the shared messaging demo instead of runSender and
+	// runReceiver below. Those stay on the SDK because the Sender and Receiver
+	// interfaces cannot express sessions, scheduling, deferral, dead-lettering and lock renewal.
+	if *transport != "" {
+		if *emulator {
+			log.Fatal("-transport does not support -emulator")
+		}
+
+		endpoints := messaging.LabEndpoints
+		endpoints.ServiceBusNamespace = serviceBusNamespaceFqdn
+		endpoints.ServiceBusQueue = queueName
+		demoOptions := messaging.DemoOptions{
+			Endpoints: endpoints,
+			Interval:  *interval,
+			Count:     *count,
+			WorkTime:  *workTime,
+			FailRate:  *failRate,
+		}
+		if *recording != "" && *mode == "receive" {
+			if demoOptions.Recorder, err = messaging.CreateRecorder(*recording); err != nil {
+				log.Fatal(err)
+			}
+			defer demoOptions.Recorder.Close()
+		}
+
+		err = messaging.RunDemo(ctx, *mode, *transport, credential, demoOptions)
+		if err != nil {
+			log.Fatalf("%s failed: %v", *mode, err)
+		}
+		return
+	}
+
+	client, err := newClient(serviceBusNamespaceFqdn, credential, *emulator)
 	if err != nil {
 		log.Fatalf("service bus client: %v", err)
 	}
-	defer client.Close(ctx)
+	// ctx is already cancelled after Ctrl+C, but links should still close cleanly
+	defer client.Close(context.WithoutCancel(ctx))
+
+	adminClient, err := newAdminClient(serviceBusNamespaceFqdn, credential, *emulator)
+	if err != nil {
+		log.Fatalf("service bus admin client: %v", err)
+	}
+
+	rule := ruleOptions{Name: *ruleName, SQL: *ruleSQL, Correlation: *ruleCorrelation, Action: *ruleAction}
+	options := receiverOptions{
+		MaxAttempts:  uint32(*maxAttempts),
+		MaxInFlight:  *maxInFlight,
+		DrainTimeout: *drainTimeout,
+		ReceiveMode:  receiveModeValue,
+		SubQueue:     subQueueValue,
+	}
+	handler := newDemoHandler(*workTime, *failRate)
+
+	// Only receive modes record, replay mode reads the same file
+	if *recording != "" && (*mode == "receive" || *mode == "subscribe") {
+		recorder, err := messaging.CreateRecorder(*recording)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer recorder.Close()
+		options.Recorder = recorder
+	}
+
+	sendOptions := senderOptions{
+		Interval:      *interval,
+		Count:         *count,
+		Properties:    properties,
+		SessionKey:    sessionKey,
+		ContentType:   *contentType,
+		CorrelationID: *correlationID,
+		MessageID:     messageID,
+		TimeToLive:    *ttl,
+		ScheduleIn:    *scheduleIn,
+	}
 
 	switch *mode {
 	case "send":
-		if err := runSender(ctx, client, queueName, *interval, *count); err != nil {
-			log.Fatalf("send failed: %v", err)
+		if sessionKey != nil {
+			err = runSender(ctx, client, sessionQueueName, sendOptions)
+		} else {
+			err = runSender(ctx, client, queueName, sendOptions)
 		}
+	case "publish":
+		err = runSender(ctx, client, *topicName, sendOptions)
 	case "receive":
-		if err := runReceiver(ctx, client, queueName); err != nil {
-			log.Fatalf("receive failed: %v", err)
+		options.DeferWhen = deferFlagged
+		err = runReceiver(ctx, client, queueName, "", handler, options)
+	case "replay":
+		err = runReplay(ctx, client, queueName, *recording, *speed)
+	case "peek":
+		err = peekMessages(ctx, client, queueName, peekOptions{
+			FromSequence: *fromSequence,
+			Count:        *count,
+			PageSize:     *pageSize,
+			SubQueue:     subQueueValue,
+		})
+	case "bench":
+		err = runBench(ctx, client, queueName, benchOptions{
+			Senders:     *senders,
+			Count:       *count,
+			Duration:    *duration,
+			PayloadSize: *payloadSize,
+		})
+	case "relay":
+		err = runRelay(ctx, client, queueName, *outputEntity)
+	case "cancel-scheduled":
+		var numbers []int64
+		if numbers, err = parseSequenceNumbers(*sequenceNumbers); err == nil {
+			err = cancelScheduled(ctx, client, queueName, numbers)
+		}
+	case "receive-deferred":
+		var numbers []int64
+		if numbers, err = parseSequenceNumbers(*sequenceNumbers); err == nil {
+			err = receiveDeferred(ctx, client, queueName, numbers, handler, options)
+		}
+	case "session-receive":
+		err = runSessionReceiver(ctx, client, sessionQueueName, handler, sessionReceiverOptions{
+			receiverOptions: options,
+			SessionID:       *sessionID,
+			Sessions:        *sessions,
+			IdleTimeout:     *sessionIdle,
+		})
+	case "subscribe":
+		err = runReceiver(ctx, client, *topicName, *subscriptionName, handler, options)
+	case "dlq":
+		err = runDLQ(ctx, client, queueName, *dlqAction, *dlqIDs, *dlqAll)
+	case "create-topic":
+		err = createTopic(ctx, adminClient, *topicName, settings)
+	case "update-topic":
+		err = updateTopic(ctx, adminClient, *topicName, settings)
+	case "delete-topic":
+		err = deleteTopic(ctx, adminClient, *topicName)
+	case "show-topic":
+		err = showTopic(ctx, adminClient, *topicName)
+	case "list-entities":
+		err = listEntities(ctx, adminClient)
+	case "show-queue":
+		err = showQueue(ctx, adminClient, queueName)
+	case "create-queue":
+		err = createQueue(ctx, adminClient, queueName, settings)
+	case "update-queue":
+		err = updateQueue(ctx, adminClient, queueName, settings)
+	case "delete-queue":
+		err = deleteQueue(ctx, adminClient, queueName)
+	case "create-subscription":
+		var ruleProperties admin.RuleProperties
+		if ruleProperties, err = rule.properties(); err == nil {
+			err = createSubscription(ctx, adminClient, *topicName, *subscriptionName, ruleProperties)
 		}
+	case "add-rule":
+		var ruleProperties admin.RuleProperties
+		if ruleProperties, err = rule.properties(); err == nil {
+			err = addRule(ctx, adminClient, *topicName, *subscriptionName, ruleProperties)
+		}
+	case "delete-rule":
+		err = deleteRule(ctx, adminClient, *topicName, *subscriptionName, *ruleName)
+	case "list-rules":
+		err = listRules(ctx, adminClient, *topicName, *subscriptionName)
+	case "routing-demo":
+		err = routingDemo(ctx, client, adminClient, *topicName)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %v", *mode, err)
+	}
+}
+
+func newClient(namespaceFqdn string, credential *azidentity.DefaultAzureCredential, emulator bool) (*azservicebus.Client, error) {
+	if emulator {
+		return azservicebus.NewClientFromConnectionString(emulatorConnectionString, nil)
+	}
+	return azservicebus.NewClient(namespaceFqdn, credential, nil)
+}
+
+func runDLQ(ctx context.Context, client *azservicebus.Client, queueName string, action string, ids string, all bool) error {
+	if action == "list" {
+		return listDeadLetters(ctx, client, queueName)
+	}
+
+	selection, err := parseDLQSelection(ids, all)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "resubmit":
+		return resubmitDeadLetters(ctx, client, queueName, selection)
+	case "purge":
+		return purgeDeadLetters(ctx, client, queueName, selection)
+	default:
+		return fmt.Errorf("unknown action %q (list|resubmit|purge)", action)
 	}
 }
 
-func runSender(ctx context.Context, client *azservicebus.Client, queueName string, interval time.Duration, count int) error {
-	sender, err := client.NewSender(queueName, nil)
+// senderOptions controls what runSender sends.
+type senderOptions struct {
+	Interval   time.Duration
+	Count      int
+	Properties map[string]any
+	// SessionKey sets the SessionID of every message; nil sends without sessions.
+	SessionKey    *sessionKey
+	ContentType   string
+	CorrelationID string
+	// MessageID renders the MessageID from the counter, so resending the same
+	// counter is dropped by duplicate detection. Nil lets the SDK generate one.
+	MessageID *template.Template
+	// TimeToLive overrides the entity default message TTL when positive.
+	TimeToLive time.Duration
+	// ScheduleIn schedules messages to be enqueued this long after sending.
+	ScheduleIn time.Duration
+}
+
+// runSender sends to a queue or a topic; both are just entity names to a sender.
+func runSender(ctx context.Context, client *azservicebus.Client, entityName string, options senderOptions) error {
+	sender, err := client.NewSender(entityName, nil)
 	if err != nil {
 		return fmt.Errorf("new sender: %w", err)
 	}
 	defer sender.Close(ctx)
 
-	log.Printf("Sending to queue=%s using AAD...", queueName)
+	log.Printf("Sending to entity=%s using AAD...", entityName)
 
 	sent := 0
 	for {
-		if count > 0 && sent >= count {
+		if options.Count > 0 && sent >= options.Count {
 			log.Printf("Done. Sent %d messages.", sent)
 			return nil
 		}
 
 		body := fmt.Sprintf(`{"counter":%d,"ts":"%s"}`, sent, time.Now().UTC().Format(time.RFC3339Nano))
 		message := &azservicebus.Message{
-			Body: []byte(body),
+			ApplicationProperties: options.Properties,
+		}
+		if options.ContentType != "" {
+			message.ContentType = &options.ContentType
+		}
+		if options.CorrelationID != "" {
+			message.CorrelationID = &options.CorrelationID
+		}
+		if options.TimeToLive > 0 {
+			message.TimeToLive = &options.TimeToLive
+		}
+		if options.MessageID != nil {
+			messageID, err := renderCounter(options.MessageID, sent)
+			if err != nil {
+				return err
+			}
+			message.MessageID = &messageID
 		}
 
-		if err := sender.SendMessage(ctx, message, nil); err != nil {
-			return fmt.Errorf("send message: %w", err)
+		if options.SessionKey != nil {
+			sessionID, seq, err := options.SessionKey.next(sent)
+			if err != nil {
+				return err
+			}
+			message.SessionID = &sessionID
+			body = fmt.Sprintf(`{"counter":%d,"session":%q,"seq":%d,"ts":"%s"}`, sent, sessionID, seq, time.Now().UTC().Format(time.RFC3339Nano))
 		}
+		message.Body = []byte(body)
+
+		if options.ScheduleIn > 0 {
+			enqueueAt := time.Now().Add(options.ScheduleIn)
+			sequenceNumbers, err := sender.ScheduleMessages(ctx, []*azservicebus.Message{message}, enqueueAt, nil)
+			if err != nil {
+				return fmt.Errorf("schedule message: %w", err)
+			}
 
-		sent++
-		log.Printf("Sent message #%d", sent)
+			sent++
+			log.Printf("Scheduled message #%d for %s sequence=%v (cancel with -mode cancel-scheduled -sequence-numbers)",
+				sent, enqueueAt.Format(time.RFC3339), sequenceNumbers)
+		} else {
+			if err := sender.SendMessage(ctx, message, nil); err != nil {
+				return fmt.Errorf("send message: %w", err)
+			}
+
+			sent++
+			log.Printf("Sent message #%d", sent)
+		}
 
 		select {
 		case <-ctx.Done():
 			return nil
-		case <-time.After(interval):
+		case <-time.After(options.Interval):
 		}
 	}
 }
 
-func runReceiver(ctx context.Context, client *azservicebus.Client, queueName string) error {
-	receiver, err := client.NewReceiverForQueue(queueName, nil)
+// runReceiver receives from a queue, or from a topic subscription when
+// subscriptionName is set, and handles up to MaxInFlight messages at once.
+// On Ctrl+C it stops receiving and waits up to DrainTimeout for in-flight
+// handlers; any still running are then cancelled and their messages abandoned,
+// so they are redelivered right away instead of after the lock expires.
+func runReceiver(ctx context.Context, client *azservicebus.Client, entityName string, subscriptionName string, handler MessageHandler, options receiverOptions) error {
+	receiverOptions := &azservicebus.ReceiverOptions{ReceiveMode: options.ReceiveMode, SubQueue: options.SubQueue}
+	deleteOnReceive := options.ReceiveMode == azservicebus.ReceiveModeReceiveAndDelete
+
+	var receiver *azservicebus.Receiver
+	var err error
+	if subscriptionName == "" {
+		receiver, err = client.NewReceiverForQueue(entityName, receiverOptions)
+		log.Printf("Receiving from queue=%s subqueue=%s deleteOnReceive=%t with max %d in flight using AAD...",
+			entityName, subQueueName(options.SubQueue), deleteOnReceive, options.MaxInFlight)
+	} else {
+		receiver, err = client.NewReceiverForSubscription(entityName, subscriptionName, receiverOptions)
+		log.Printf("Receiving from topic=%s subscription=%s subqueue=%s deleteOnReceive=%t with max %d in flight using AAD...",
+			entityName, subscriptionName, subQueueName(options.SubQueue), deleteOnReceive, options.MaxInFlight)
+	}
 	if err != nil {
 		return fmt.Errorf("new receiver: %w", err)
 	}
-	defer receiver.Close(ctx)
+	// Closed only after the drain below, so unfinished messages can still be abandoned
+	defer receiver.Close(context.WithoutCancel(ctx))
+
+	// Handlers outlive Ctrl+C until the drain timeout
+	handlerCtx, cancelHandlers := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelHandlers()
+
+	slots := make(chan struct{}, options.MaxInFlight)
+	var wg sync.WaitGroup
+
+	err = receiveLoop(ctx, receiver, slots, func(message *azservicebus.ReceivedMessage) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
 
-	log.Printf("Receiving from queue=%s using AAD...", queueName)
+			printReceivedMessage(message)
+			if options.Recorder != nil {
+				if err := options.Recorder.Write("servicebus", messaging.ServiceBusDelivery(message)); err != nil {
+					log.Print(err)
+				}
+			}
+			if deleteOnReceive {
+				// Already removed from the queue, there is nothing to settle
+				if err := handler(handlerCtx, message); err != nil {
+					log.Printf("Handler failed, message lost (receive-and-delete): messageId=%s: %v", message.MessageID, err)
+				}
+				return
+			}
+			if _, err := processMessage(handlerCtx, receiver, message, handler, options); err != nil {
+				log.Printf("process message %s: %v", message.MessageID, err)
+			}
+		}()
+	})
 
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(options.DrainTimeout):
+		log.Printf("Drain timeout after %s, abandoning unfinished messages...", options.DrainTimeout)
+		cancelHandlers()
+		<-drained
+	}
+
+	return err
+}
+
+// receiveLoop receives as many messages as there are free slots and passes
+// each one to dispatch with its slot taken, until ctx is cancelled.
+func receiveLoop(ctx context.Context, receiver *azservicebus.Receiver, slots chan struct{}, dispatch func(*azservicebus.ReceivedMessage)) error {
 	for {
+		// Wait for at least one free slot
 		select {
 		case <-ctx.Done():
 			return nil
-		default:
+		case slots <- struct{}{}:
 		}
+		free := cap(slots) - len(slots) + 1
 
 		receiveCtx, receiveCancel := context.WithTimeout(ctx, 30*time.Second)
-		messages, err := receiver.ReceiveMessages(receiveCtx, 10, nil)
+		messages, err := receiver.ReceiveMessages(receiveCtx, free, nil)
 		receiveCancel()
 
 		if err != nil {
+			<-slots
+			if ctx.Err() != nil {
+				return nil
+			}
 			// With no messages, the SDK can return context deadline exceeded due to our timeout.
 			// Treat it as "no messages right now".
-			if err == context.DeadlineExceeded {
+			if errors.Is(err, context.DeadlineExceeded) {
 				continue
 			}
 			return fmt.Errorf("receive messages: %w", err)
 		}
+		if len(messages) == 0 {
+			<-slots
+			continue
+		}
 
-		for _, message := range messages {
-			log.Printf("Received: messageId=%s body=%s", safeString(&message.MessageID), string(message.Body))
-
-			// Complete (peek-lock pattern)
-			if err := receiver.CompleteMessage(ctx, message, nil); err != nil {
-				return fmt.Errorf("complete message: %w", err)
+		for i, message := range messages {
+			// The first slot is already held; only this loop takes slots, so the others are free
+			if i > 0 {
+				slots <- struct{}{}
 			}
+			dispatch(message)
 		}
 	}
 }
-
-func safeString(value *string) string {
-	if value == nil {
-		return ""
-	}
-	return *value
-}
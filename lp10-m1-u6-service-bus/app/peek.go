@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// parseSubQueue maps the -subqueue flag to the SDK value. The zero value
+// targets the entity itself.
+func parseSubQueue(name string) (azservicebus.SubQueue, error) {
+	switch name {
+	case "", "none":
+		return 0, nil
+	case "deadletter":
+		return azservicebus.SubQueueDeadLetter, nil
+	case "transfer":
+		// Messages that could not be forwarded or sent within a transaction
+		return azservicebus.SubQueueTransfer, nil
+	default:
+		return 0, fmt.Errorf("unknown subqueue %q, expected none, deadletter or transfer", name)
+	}
+}
+
+func parseReceiveMode(name string) (azservicebus.ReceiveMode, error) {
+	switch name {
+	case "peek-lock":
+		return azservicebus.ReceiveModePeekLock, nil
+	case "receive-and-delete":
+		return azservicebus.ReceiveModeReceiveAndDelete, nil
+	default:
+		return 0, fmt.Errorf("unknown receive mode %q, expected peek-lock or receive-and-delete", name)
+	}
+}
+
+func subQueueName(subQueue azservicebus.SubQueue) string {
+	switch subQueue {
+	case azservicebus.SubQueueDeadLetter:
+		return "deadletter"
+	case azservicebus.SubQueueTransfer:
+		return "transfer"
+	default:
+		return "none"
+	}
+}
+
+// peekOptions controls the peek mode.
+type peekOptions struct {
+	// FromSequence is the first sequence number to show; 0 starts at the oldest message.
+	FromSequence int64
+	// Count stops after this many messages; 0 pages through everything.
+	Count int
+	// PageSize is the number of messages requested per PeekMessages call.
+	PageSize int
+	SubQueue azservicebus.SubQueue
+}
+
+// peekMessages pages through a queue, or one of its subqueues, without
+// locking, deleting or bumping the delivery count of any message, which makes
+// it safe to run against production queues.
+func peekMessages(ctx context.Context, client *azservicebus.Client, queueName string, options peekOptions) error {
+	receiver, err := client.NewReceiverForQueue(queueName, &azservicebus.ReceiverOptions{SubQueue: options.SubQueue})
+	if err != nil {
+		return fmt.Errorf("new receiver: %w", err)
+	}
+	defer receiver.Close(context.WithoutCancel(ctx))
+
+	log.Printf("Peeking queue=%s subqueue=%s from sequence=%d...", queueName, subQueueName(options.SubQueue), options.FromSequence)
+
+	// The SDK only advances its own cursor when no start is given, so pass it on every page
+	from := options.FromSequence
+	total := 0
+	exhausted := false
+	for options.Count == 0 || total < options.Count {
+		pageSize := options.PageSize
+		if options.Count > 0 {
+			pageSize = min(pageSize, options.Count-total)
+		}
+
+		messages, err := receiver.PeekMessages(ctx, pageSize, &azservicebus.PeekMessagesOptions{FromSequenceNumber: &from})
+		if err != nil {
+			return fmt.Errorf("peek messages: %w", err)
+		}
+		if len(messages) == 0 {
+			exhausted = true
+			break
+		}
+
+		for _, message := range messages {
+			printReceivedMessage(message)
+			from = ptr.Deref(message.SequenceNumber) + 1
+		}
+		total += len(messages)
+	}
+
+	fmt.Printf("%d message(s) peeked from %s (subqueue %s)\n", total, queueName, subQueueName(options.SubQueue))
+	if !exhausted {
+		fmt.Printf("More may follow: continue with -from-sequence %d\n", from)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"github.com/neovasili/training-az-204/pkg/loadgen"
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+type counterData struct {
+	Counter int
+}
+
+// renderCounter renders a template made with loadgen.NewTemplate for the
+// message counter, e.g. "order-{{.Counter}}" or "customer-{{mod .Counter 3}}".
+func renderCounter(tmpl *template.Template, counter int) (string, error) {
+	return loadgen.Render(tmpl, counterData{Counter: counter})
+}
+
+func parseSequenceNumbers(value string) ([]int64, error) {
+	var numbers []int64
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sequence number %q", part)
+		}
+		numbers = append(numbers, n)
+	}
+	if len(numbers) == 0 {
+		return nil, errors.New("-sequence-numbers is required")
+	}
+	return numbers, nil
+}
+
+func messageStateName(state azservicebus.MessageState) string {
+	switch state {
+	case azservicebus.MessageStateActive:
+		return "active"
+	case azservicebus.MessageStateDeferred:
+		return "deferred"
+	case azservicebus.MessageStateScheduled:
+		return "scheduled"
+	default:
+		return strconv.Itoa(int(state))
+	}
+}
+
+// printReceivedMessage prints the system properties, application properties
+// and body of a message. Optional properties are only shown when set.
+func printReceivedMessage(message *azservicebus.ReceivedMessage) {
+	fmt.Printf("- messageId=%s sequence=%d deliveryCount=%d state=%s\n",
+		message.MessageID, ptr.Deref(message.SequenceNumber), message.DeliveryCount, messageStateName(message.State))
+
+	optional := []struct {
+		name  string
+		value *string
+	}{
+		{"contentType", message.ContentType},
+		{"correlationId", message.CorrelationID},
+		{"subject", message.Subject},
+		{"to", message.To},
+		{"replyTo", message.ReplyTo},
+		{"replyToSessionId", message.ReplyToSessionID},
+		{"sessionId", message.SessionID},
+		{"partitionKey", message.PartitionKey},
+		{"deadLetterReason", message.DeadLetterReason},
+		{"deadLetterDescription", message.DeadLetterErrorDescription},
+		{"deadLetterSource", message.DeadLetterSource},
+	}
+	for _, property := range optional {
+		if property.value != nil {
+			fmt.Printf("  %s=%s\n", property.name, *property.value)
+		}
+	}
+
+	times := []struct {
+		name  string
+		value *time.Time
+	}{
+		{"enqueued", message.EnqueuedTime},
+		{"scheduledEnqueue", message.ScheduledEnqueueTime},
+		{"lockedUntil", message.LockedUntil},
+		{"expiresAt", message.ExpiresAt},
+	}
+	for _, property := range times {
+		if property.value != nil {
+			fmt.Printf("  %s=%s\n", property.name, property.value.Format(time.RFC3339Nano))
+		}
+	}
+
+	if message.TimeToLive != nil {
+		fmt.Printf("  timeToLive=%s\n", *message.TimeToLive)
+	}
+	if message.EnqueuedSequenceNumber != nil {
+		fmt.Printf("  enqueuedSequence=%d\n", *message.EnqueuedSequenceNumber)
+	}
+
+	keys := make([]string, 0, len(message.ApplicationProperties))
+	for key := range message.ApplicationProperties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("  property %s=%v\n", key, message.ApplicationProperties[key])
+	}
+
+	fmt.Printf("  body=%s\n", string(message.Body))
+}
+
+// cancelScheduled cancels scheduled messages that have not been enqueued yet.
+func cancelScheduled(ctx context.Context, client *azservicebus.Client, entityName string, sequenceNumbers []int64) error {
+	sender, err := client.NewSender(entityName, nil)
+	if err != nil {
+		return fmt.Errorf("new sender: %w", err)
+	}
+	defer sender.Close(ctx)
+
+	if err := sender.CancelScheduledMessages(ctx, sequenceNumbers, nil); err != nil {
+		return fmt.Errorf("cancel scheduled messages: %w", err)
+	}
+
+	log.Printf("Cancelled %d scheduled message(s) on %s: %v", len(sequenceNumbers), entityName, sequenceNumbers)
+	return nil
+}
+
+// receiveDeferred fetches deferred messages by sequence number and runs them
+// through the handler. Deferred messages can only be received this way.
+func receiveDeferred(ctx context.Context, client *azservicebus.Client, queueName string, sequenceNumbers []int64, handler MessageHandler, options receiverOptions) error {
+	receiver, err := client.NewReceiverForQueue(queueName, nil)
+	if err != nil {
+		return fmt.Errorf("new receiver: %w", err)
+	}
+	defer receiver.Close(ctx)
+
+	messages, err := receiver.ReceiveDeferredMessages(ctx, sequenceNumbers, nil)
+	if err != nil {
+		return fmt.Errorf("receive deferred messages: %w", err)
+	}
+	log.Printf("Received %d of %d deferred message(s)", len(messages), len(sequenceNumbers))
+
+	// No deferral rule here, otherwise the same messages would be deferred again
+	options.DeferWhen = nil
+	for _, message := range messages {
+		printReceivedMessage(message)
+		if _, err := processMessage(ctx, receiver, message, handler, options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"github.com/neovasili/training-az-204/pkg/messaging"
+)
+
+// runReplay sends the messages of a recording made with -recording back to
+// entityName, keeping their original gaps divided by speed. Message IDs,
+// session IDs and application properties are kept, so duplicate detection
+// drops messages that were already replayed within its window.
+func runReplay(ctx context.Context, client *azservicebus.Client, entityName string, path string, speed float64) error {
+	records, err := messaging.ReadRecording(path)
+	if err != nil {
+		return err
+	}
+
+	sbSender, err := client.NewSender(entityName, nil)
+	if err != nil {
+		return fmt.Errorf("new sender: %w", err)
+	}
+	sender := messaging.NewServiceBusSender(sbSender)
+	defer sender.Close(context.WithoutCancel(ctx))
+
+	log.Printf("Replaying %d message(s) from %s to %s at speed %g...", len(records), path, entityName, speed)
+	sent, err := messaging.Replay(ctx, sender, records, speed)
+	log.Printf("Done. Replayed %d of %d message(s).", sent, len(records))
+	return err
+}
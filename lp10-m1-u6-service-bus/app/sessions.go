@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"github.com/neovasili/training-az-204/pkg/loadgen"
+)
+
+// sessionKey renders the SessionID of each sent message from a Go template,
+// e.g. "customer-{{mod .Counter 3}}" spreads messages over three sessions.
+type sessionKey struct {
+	tmpl *template.Template
+	// seq numbers the messages of each session, so receivers can check order
+	seq map[string]int
+}
+
+func newSessionKey(expression string) (*sessionKey, error) {
+	if expression == "" {
+		return nil, nil
+	}
+
+	tmpl, err := loadgen.NewTemplate("session key", expression)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionKey{tmpl: tmpl, seq: map[string]int{}}, nil
+}
+
+// next returns the session ID for message number counter and its sequence
+// number within that session.
+func (k *sessionKey) next(counter int) (string, int, error) {
+	sessionID, err := renderCounter(k.tmpl, counter)
+	if err != nil {
+		return "", 0, err
+	}
+	if sessionID == "" {
+		return "", 0, errors.New("session key rendered an empty session ID")
+	}
+
+	k.seq[sessionID]++
+	return sessionID, k.seq[sessionID], nil
+}
+
+// sessionBody is the part of the message body the session receiver reads.
+type sessionBody struct {
+	Seq int `json:"seq"`
+}
+
+// sessionState is stored with SetSessionState, so the next receiver that
+// accepts the session resumes the ordering check where the last one stopped.
+type sessionState struct {
+	LastSeq   int       `json:"lastSeq"`
+	Processed int       `json:"processed"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// sessionReport counts, per session, whether messages arrived in order.
+type sessionReport struct {
+	Received   int
+	InOrder    int
+	Duplicates int // seq already processed (redelivery)
+	Gaps       int // seq skipped ahead of the expected one
+	Failed     int
+	LastSeq    int
+}
+
+type sessionReports struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionReport
+}
+
+func (r *sessionReports) get(sessionID string) *sessionReport {
+	if r.sessions == nil {
+		r.sessions = map[string]*sessionReport{}
+	}
+	report, ok := r.sessions[sessionID]
+	if !ok {
+		report = &sessionReport{}
+		r.sessions[sessionID] = report
+	}
+	return report
+}
+
+func (r *sessionReports) print() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make([]string, 0, len(r.sessions))
+	for id := range r.sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	fmt.Println("Session ordering report:")
+	for _, id := range ids {
+		report := r.sessions[id]
+		verdict := "ordered"
+		if report.Gaps > 0 || report.Duplicates > 0 {
+			verdict = "NOT ordered"
+		}
+		fmt.Printf("- %s: received=%d inOrder=%d duplicates=%d gaps=%d failed=%d lastSeq=%d -> %s\n",
+			id, report.Received, report.InOrder, report.Duplicates, report.Gaps, report.Failed, report.LastSeq, verdict)
+	}
+}
+
+// sessionReceiverOptions controls the session receive mode.
+type sessionReceiverOptions struct {
+	receiverOptions
+	// SessionID accepts only this session; empty accepts the next available ones.
+	SessionID string
+	// Sessions is the number of sessions processed concurrently.
+	Sessions int
+	// IdleTimeout releases a session after this long without messages.
+	IdleTimeout time.Duration
+}
+
+// runSessionReceiver processes sessions of a session-enabled queue. Each of
+// the Sessions workers holds one session at a time and handles its messages
+// one by one, which is what guarantees per-session ordering.
+func runSessionReceiver(ctx context.Context, client *azservicebus.Client, queueName string, handler MessageHandler, options sessionReceiverOptions) error {
+	if options.SessionID != "" {
+		options.Sessions = 1
+	}
+	log.Printf("Receiving sessions from queue=%s with %d concurrent session(s) using AAD...", queueName, options.Sessions)
+
+	reports := &sessionReports{}
+	errs := make(chan error, options.Sessions)
+
+	var wg sync.WaitGroup
+	for w := 0; w < options.Sessions; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- sessionWorker(ctx, client, queueName, handler, options, reports)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	reports.print()
+	return errors.Join(loadgen.Collect(errs)...)
+}
+
+func sessionWorker(ctx context.Context, client *azservicebus.Client, queueName string, handler MessageHandler, options sessionReceiverOptions, reports *sessionReports) error {
+	for ctx.Err() == nil {
+		var receiver *azservicebus.SessionReceiver
+		var err error
+		if options.SessionID != "" {
+			receiver, err = client.AcceptSessionForQueue(ctx, queueName, options.SessionID, nil)
+		} else {
+			receiver, err = client.AcceptNextSessionForQueue(ctx, queueName, nil)
+		}
+
+		var sbErr *azservicebus.Error
+		if errors.As(err, &sbErr) && sbErr.Code == azservicebus.CodeTimeout {
+			// No session with messages available right now
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("accept session: %w", err)
+		}
+
+		err = processSession(ctx, receiver, handler, options, reports)
+		receiver.Close(context.WithoutCancel(ctx))
+		if err != nil {
+			return err
+		}
+
+		if options.SessionID != "" {
+			return nil
+		}
+	}
+	return nil
+}
+
+// processSession handles the messages of one session in order until it has
+// been idle for IdleTimeout, keeping the session lock renewed meanwhile.
+func processSession(ctx context.Context, receiver *azservicebus.SessionReceiver, handler MessageHandler, options sessionReceiverOptions, reports *sessionReports) error {
+	sessionID := receiver.SessionID()
+
+	state, err := loadSessionState(ctx, receiver)
+	if err != nil {
+		return err
+	}
+	log.Printf("Accepted session %s (lastSeq=%d processed=%d)", sessionID, state.LastSeq, state.Processed)
+
+	renewCtx, stopRenewing := context.WithCancel(ctx)
+	defer stopRenewing()
+	go renewSessionLock(renewCtx, receiver)
+
+	for {
+		receiveCtx, receiveCancel := context.WithTimeout(ctx, options.IdleTimeout)
+		messages, err := receiver.ReceiveMessages(receiveCtx, 10, nil)
+		receiveCancel()
+
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			if ctx.Err() != nil {
+				return saveSessionState(context.WithoutCancel(ctx), receiver, state)
+			}
+			return fmt.Errorf("receive from session %s: %w", sessionID, err)
+		}
+		if len(messages) == 0 {
+			log.Printf("Session %s idle, releasing it", sessionID)
+			return saveSessionState(ctx, receiver, state)
+		}
+
+		for _, message := range messages {
+			var body sessionBody
+			_ = json.Unmarshal(message.Body, &body)
+			log.Printf("Received: session=%s seq=%d messageId=%s deliveryCount=%d", sessionID, body.Seq, message.MessageID, message.DeliveryCount)
+
+			outcome, err := processMessage(ctx, receiver, message, handler, options.receiverOptions)
+			if err != nil {
+				return err
+			}
+
+			reports.mu.Lock()
+			report := reports.get(sessionID)
+			report.Received++
+			if outcome == outcomeCompleted {
+				switch {
+				case body.Seq == 1 || body.Seq == state.LastSeq+1:
+					// seq 1 starts a new sender run
+					report.InOrder++
+				case body.Seq <= state.LastSeq:
+					report.Duplicates++
+				default:
+					report.Gaps++
+				}
+				state.LastSeq = body.Seq
+				state.Processed++
+				report.LastSeq = body.Seq
+			} else {
+				report.Failed++
+			}
+			reports.mu.Unlock()
+		}
+
+		// Ctrl+C mid-batch must not lose the progress of the messages already settled
+		if err := saveSessionState(context.WithoutCancel(ctx), receiver, state); err != nil {
+			return err
+		}
+	}
+}
+
+func loadSessionState(ctx context.Context, receiver *azservicebus.SessionReceiver) (sessionState, error) {
+	var state sessionState
+
+	data, err := receiver.GetSessionState(ctx, nil)
+	if err != nil {
+		return state, fmt.Errorf("get session state: %w", err)
+	}
+	if len(data) == 0 {
+		return state, nil
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Ignoring unreadable state of session %s: %v", receiver.SessionID(), err)
+		return sessionState{}, nil
+	}
+	return state, nil
+}
+
+func saveSessionState(ctx context.Context, receiver *azservicebus.SessionReceiver, state sessionState) error {
+	state.UpdatedAt = time.Now().UTC()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("marshal session state: %w", err)
+	}
+	if err := receiver.SetSessionState(ctx, data, nil); err != nil {
+		return fmt.Errorf("set session state: %w", err)
+	}
+	return nil
+}
+
+// renewSessionLock keeps the session locked to this receiver while it is
+// being processed, even when a handler runs longer than the lock duration.
+func renewSessionLock(ctx context.Context, receiver *azservicebus.SessionReceiver) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := receiver.RenewSessionLock(ctx, nil); err != nil && ctx.Err() == nil {
+			log.Printf("renew lock of session %s: %v", receiver.SessionID(), err)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"github.com/neovasili/training-az-204/pkg/loadgen"
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// benchOptions controls the batch send benchmark.
+type benchOptions struct {
+	Senders     int
+	Count       int           // total messages, 0 = until Duration or Ctrl+C
+	Duration    time.Duration // 0 = until Count or Ctrl+C
+	PayloadSize int
+}
+
+// benchResult collects per-batch send latencies of all senders.
+type benchResult struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	messages  int
+	bytes     uint64
+	errors    int
+}
+
+func (r *benchResult) record(latency time.Duration, messages int, bytes uint64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.errors++
+		return
+	}
+	r.latencies = append(r.latencies, latency)
+	r.messages += messages
+	r.bytes += bytes
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func (r *benchResult) print(elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sorted := append([]time.Duration(nil), r.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	batches := len(sorted)
+	fmt.Printf("Sent %d messages in %d batches over %s (%d failed batches)\n", r.messages, batches, elapsed.Round(time.Millisecond), r.errors)
+	fmt.Printf("Throughput: %.1f msg/s, %.1f KiB/s\n", float64(r.messages)/elapsed.Seconds(), float64(r.bytes)/1024/elapsed.Seconds())
+	if batches > 0 {
+		fmt.Printf("Average batch: %.1f messages, %d bytes\n", float64(r.messages)/float64(batches), r.bytes/uint64(batches))
+		fmt.Printf("Batch send latency: p50=%s p95=%s p99=%s max=%s\n",
+			percentile(sorted, 0.50), percentile(sorted, 0.95), percentile(sorted, 0.99), sorted[batches-1])
+	}
+}
+
+// runBench sends as fast as possible with Senders concurrent senders. Every
+// batch is filled up to the size limit of the link before it is sent.
+func runBench(ctx context.Context, client *azservicebus.Client, entityName string, options benchOptions) error {
+	if options.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Duration)
+		defer cancel()
+	}
+
+	log.Printf("Benchmarking entity=%s with %d sender(s), %d byte payloads...", entityName, options.Senders, options.PayloadSize)
+
+	payload := strings.Repeat("x", options.PayloadSize)
+	var claimed atomic.Int64
+	result := &benchResult{}
+	errs := make(chan error, options.Senders)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for s := 0; s < options.Senders; s++ {
+		wg.Add(1)
+		go func(senderIndex int) {
+			defer wg.Done()
+			errs <- benchSender(ctx, client, entityName, senderIndex, payload, options.Count, &claimed, result)
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+
+	result.print(time.Since(start))
+	return errors.Join(loadgen.Collect(errs)...)
+}
+
+func benchSender(ctx context.Context, client *azservicebus.Client, entityName string, senderIndex int, payload string, total int, claimed *atomic.Int64, result *benchResult) error {
+	sender, err := client.NewSender(entityName, nil)
+	if err != nil {
+		return fmt.Errorf("new sender: %w", err)
+	}
+	defer sender.Close(context.WithoutCancel(ctx))
+
+	// next claims the next message; with a total count the senders share it
+	next := func() *azservicebus.Message {
+		n := claimed.Add(1)
+		if total > 0 && n > int64(total) {
+			return nil
+		}
+		return &azservicebus.Message{
+			Body:                  []byte(fmt.Sprintf(`{"n":%d,"data":"%s"}`, n, payload)),
+			ApplicationProperties: map[string]any{"sender": int64(senderIndex)},
+		}
+	}
+
+	pending := next()
+	for pending != nil && ctx.Err() == nil {
+		batch, err := sender.NewMessageBatch(ctx, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("new message batch: %w", err)
+		}
+
+		for pending != nil {
+			err := batch.AddMessage(pending, nil)
+			if errors.Is(err, azservicebus.ErrMessageTooLarge) {
+				if batch.NumMessages() == 0 {
+					return fmt.Errorf("a %d byte payload does not fit in an empty batch", len(payload))
+				}
+				// Batch is full, the pending message goes into the next one
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("add message: %w", err)
+			}
+			pending = next()
+		}
+
+		sendStart := time.Now()
+		err = sender.SendMessageBatch(ctx, batch, nil)
+		if err != nil && ctx.Err() != nil {
+			// -duration expired or Ctrl+C mid-send: not a failure of the batch
+			break
+		}
+		result.record(time.Since(sendStart), int(batch.NumMessages()), batch.NumBytes(), err)
+		if err != nil {
+			log.Printf("sender %d: send batch: %v", senderIndex, err)
+		}
+	}
+
+	return nil
+}
+
+// relayMessageID derives the output MessageID from the input one, so when an
+// input is redelivered after its output was already sent, duplicate detection
+// on the output entity drops the second copy.
+func relayMessageID(input *azservicebus.ReceivedMessage) string {
+	return "relay-" + input.MessageID
+}
+
+// runRelay receives from inputQueue, transforms each message and sends the
+// result to outputEntity. The input is completed only after the output was
+// sent, so a crash in between redelivers the input instead of losing it; the
+// deterministic output MessageID makes that retry idempotent. Service Bus
+// transactions would make this atomic, but the Go SDK does not support them.
+func runRelay(ctx context.Context, client *azservicebus.Client, inputQueue string, outputEntity string) error {
+	receiver, err := client.NewReceiverForQueue(inputQueue, nil)
+	if err != nil {
+		return fmt.Errorf("new receiver: %w", err)
+	}
+	defer receiver.Close(ctx)
+
+	sender, err := client.NewSender(outputEntity, nil)
+	if err != nil {
+		return fmt.Errorf("new sender: %w", err)
+	}
+	defer sender.Close(ctx)
+
+	log.Printf("Relaying queue=%s -> entity=%s using AAD...", inputQueue, outputEntity)
+
+	relayed := 0
+	for {
+		receiveCtx, receiveCancel := context.WithTimeout(ctx, 30*time.Second)
+		messages, err := receiver.ReceiveMessages(receiveCtx, 10, nil)
+		receiveCancel()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Printf("Relayed %d message(s)", relayed)
+				return nil
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				continue
+			}
+			return fmt.Errorf("receive messages: %w", err)
+		}
+
+		for _, input := range messages {
+			output := &azservicebus.Message{
+				MessageID:     ptr.To(relayMessageID(input)),
+				CorrelationID: ptr.To(input.MessageID),
+				ContentType:   input.ContentType,
+				Body:          []byte(fmt.Sprintf(`{"relayedAt":"%s","input":%s}`, time.Now().UTC().Format(time.RFC3339Nano), quoteIfNotJSON(input.Body))),
+				ApplicationProperties: map[string]any{
+					"inputSequenceNumber": ptr.Deref(input.SequenceNumber),
+				},
+			}
+
+			if err := sender.SendMessage(ctx, output, nil); err != nil {
+				// Abandoning releases the lock so the input is redelivered right away
+				log.Printf("Relay failed: messageId=%s: %v", input.MessageID, err)
+				if err := receiver.AbandonMessage(ctx, input, nil); err != nil {
+					log.Printf("abandon message %s: %v", input.MessageID, err)
+				}
+				continue
+			}
+
+			if err := receiver.CompleteMessage(ctx, input, nil); err != nil {
+				// The output is already sent; the redelivered input produces the same output MessageID
+				log.Printf("complete message %s (output %s already sent): %v", input.MessageID, relayMessageID(input), err)
+				continue
+			}
+
+			relayed++
+			log.Printf("Relayed: messageId=%s -> %s", input.MessageID, relayMessageID(input))
+		}
+	}
+}
+
+// quoteIfNotJSON embeds body as is when it is valid JSON, otherwise as a string.
+func quoteIfNotJSON(body []byte) string {
+	if json.Valid(body) {
+		return string(body)
+	}
+	quoted, _ := json.Marshal(string(body))
+	return string(quoted)
+}
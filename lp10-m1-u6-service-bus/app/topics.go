@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
+
+	"github.com/neovasili/training-az-204/pkg/loadgen"
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// propertiesFlag collects repeated -property key=value flags. Values that
+// parse as integers, floats or booleans keep that type, so SQL filters such as
+// "priority > 5" compare numbers rather than strings.
+type propertiesFlag map[string]any
+
+func (p propertiesFlag) String() string {
+	return formatProperties(p)
+}
+
+func (p propertiesFlag) Set(value string) error {
+	key, raw, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("property must be key=value, got %q", value)
+	}
+	p[key] = loadgen.ParseValue(raw)
+	return nil
+}
+
+func formatProperties(properties map[string]any) string {
+	pairs := make([]string, 0, len(properties))
+	for key, value := range properties {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", key, value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// ruleOptions describes a subscription rule from flags. Exactly one of SQL and
+// Correlation may be set; neither means a TrueFilter (every message).
+type ruleOptions struct {
+	Name string
+	// SQL is a SQL filter expression, e.g. "priority > 5 AND region = 'eu'".
+	SQL string
+	// Correlation is a comma-separated list of key=value pairs matched exactly.
+	// The keys subject, correlationId, contentType, messageId, to, replyTo and
+	// sessionId match system properties, anything else an application property.
+	Correlation string
+	// Action is an optional SQL action run on matching messages, e.g.
+	// "SET sys.Label = 'urgent'".
+	Action string
+}
+
+func (o ruleOptions) properties() (admin.RuleProperties, error) {
+	rule := admin.RuleProperties{Name: o.Name, Filter: &admin.TrueFilter{}}
+
+	switch {
+	case o.SQL != "" && o.Correlation != "":
+		return rule, errors.New("use either -sql or -correlation, not both")
+	case o.SQL != "":
+		rule.Filter = &admin.SQLFilter{Expression: o.SQL}
+	case o.Correlation != "":
+		filter, err := parseCorrelationFilter(o.Correlation)
+		if err != nil {
+			return rule, err
+		}
+		rule.Filter = filter
+	}
+
+	if o.Action != "" {
+		rule.Action = &admin.SQLAction{Expression: o.Action}
+	}
+	return rule, nil
+}
+
+func parseCorrelationFilter(value string) (*admin.CorrelationFilter, error) {
+	filter := &admin.CorrelationFilter{ApplicationProperties: map[string]any{}}
+
+	for _, pair := range strings.Split(value, ",") {
+		key, raw, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("correlation filter must be key=value pairs, got %q", pair)
+		}
+
+		switch key {
+		case "subject":
+			filter.Subject = &raw
+		case "correlationId":
+			filter.CorrelationID = &raw
+		case "contentType":
+			filter.ContentType = &raw
+		case "messageId":
+			filter.MessageID = &raw
+		case "to":
+			filter.To = &raw
+		case "replyTo":
+			filter.ReplyTo = &raw
+		case "sessionId":
+			filter.SessionID = &raw
+		default:
+			filter.ApplicationProperties[key] = loadgen.ParseValue(raw)
+		}
+	}
+
+	return filter, nil
+}
+
+func describeRule(rule admin.RuleProperties) string {
+	var filter string
+	switch f := rule.Filter.(type) {
+	case *admin.TrueFilter:
+		filter = "true"
+	case *admin.FalseFilter:
+		filter = "false"
+	case *admin.SQLFilter:
+		filter = "sql(" + f.Expression + ")"
+	case *admin.CorrelationFilter:
+		var parts []string
+		for name, value := range map[string]*string{
+			"subject": f.Subject, "correlationId": f.CorrelationID, "contentType": f.ContentType,
+			"messageId": f.MessageID, "to": f.To, "replyTo": f.ReplyTo, "sessionId": f.SessionID,
+		} {
+			if value != nil {
+				parts = append(parts, name+"="+*value)
+			}
+		}
+		if len(f.ApplicationProperties) > 0 {
+			parts = append(parts, formatProperties(f.ApplicationProperties))
+		}
+		sort.Strings(parts)
+		filter = "correlation(" + strings.Join(parts, ",") + ")"
+	default:
+		filter = fmt.Sprintf("%T", f)
+	}
+
+	description := rule.Name + ": " + filter
+	if action, ok := rule.Action.(*admin.SQLAction); ok {
+		description += " action(" + action.Expression + ")"
+	}
+	return description
+}
+
+func isStatus(err error, statusCode int) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == statusCode
+}
+
+func newAdminClient(namespaceFqdn string, credential azcore.TokenCredential, emulator bool) (*admin.Client, error) {
+	if emulator {
+		return admin.NewClientFromConnectionString(emulatorConnectionString, nil)
+	}
+	return admin.NewClient(namespaceFqdn, credential, nil)
+}
+
+func createTopic(ctx context.Context, adminClient *admin.Client, topicName string, settings entitySettings) error {
+	properties := &admin.TopicProperties{}
+	if err := settings.applyToTopic(properties); err != nil {
+		return err
+	}
+
+	_, err := adminClient.CreateTopic(ctx, topicName, &admin.CreateTopicOptions{Properties: properties})
+	if isStatus(err, http.StatusConflict) {
+		log.Printf("Topic %s already exists", topicName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("create topic: %w", err)
+	}
+
+	log.Printf("Created topic %s", topicName)
+	return nil
+}
+
+// createSubscription creates a subscription whose default rule is rule, so no
+// message is matched by the implicit $Default TrueFilter in between.
+func createSubscription(ctx context.Context, adminClient *admin.Client, topicName string, subscriptionName string, rule admin.RuleProperties) error {
+	if rule.Name == "" {
+		rule.Name = "$Default"
+	}
+
+	_, err := adminClient.CreateSubscription(ctx, topicName, subscriptionName, &admin.CreateSubscriptionOptions{
+		Properties: &admin.SubscriptionProperties{DefaultRule: &rule},
+	})
+	if isStatus(err, http.StatusConflict) {
+		log.Printf("Subscription %s/%s already exists, rules unchanged", topicName, subscriptionName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("create subscription: %w", err)
+	}
+
+	log.Printf("Created subscription %s/%s with rule %s", topicName, subscriptionName, describeRule(rule))
+	return nil
+}
+
+func deleteSubscription(ctx context.Context, adminClient *admin.Client, topicName string, subscriptionName string) error {
+	_, err := adminClient.DeleteSubscription(ctx, topicName, subscriptionName, nil)
+	if err != nil && !isStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("delete subscription: %w", err)
+	}
+	return nil
+}
+
+// addRule adds a rule to a subscription. A message is delivered once if any
+// rule matches, and each matching rule with an action adds its own copy.
+func addRule(ctx context.Context, adminClient *admin.Client, topicName string, subscriptionName string, rule admin.RuleProperties) error {
+	if rule.Name == "" {
+		return errors.New("-rule is required")
+	}
+
+	_, err := adminClient.CreateRule(ctx, topicName, subscriptionName, &admin.CreateRuleOptions{
+		Name:   &rule.Name,
+		Filter: rule.Filter,
+		Action: rule.Action,
+	})
+	if err != nil {
+		return fmt.Errorf("create rule: %w", err)
+	}
+
+	log.Printf("Added rule to %s/%s: %s", topicName, subscriptionName, describeRule(rule))
+	return nil
+}
+
+func deleteRule(ctx context.Context, adminClient *admin.Client, topicName string, subscriptionName string, ruleName string) error {
+	_, err := adminClient.DeleteRule(ctx, topicName, subscriptionName, ruleName, nil)
+	if err != nil {
+		return fmt.Errorf("delete rule: %w", err)
+	}
+
+	log.Printf("Deleted rule %s from %s/%s", ruleName, topicName, subscriptionName)
+	return nil
+}
+
+// listRules prints the rules of one subscription, or of every subscription of
+// the topic when subscriptionName is empty.
+func listRules(ctx context.Context, adminClient *admin.Client, topicName string, subscriptionName string) error {
+	subscriptions := []string{subscriptionName}
+	if subscriptionName == "" {
+		subscriptions = nil
+		pager := adminClient.NewListSubscriptionsPager(topicName, nil)
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("list subscriptions: %w", err)
+			}
+			for _, subscription := range page.Subscriptions {
+				subscriptions = append(subscriptions, subscription.SubscriptionName)
+			}
+		}
+	}
+
+	for _, name := range subscriptions {
+		fmt.Printf("%s/%s\n", topicName, name)
+
+		pager := adminClient.NewListRulesPager(topicName, name, nil)
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("list rules of %s: %w", name, err)
+			}
+			for _, rule := range page.Rules {
+				fmt.Printf("- %s\n", describeRule(rule))
+			}
+		}
+	}
+
+	return nil
+}
+
+// routingDemoSubscriptions shows the three kinds of filters side by side.
+var routingDemoSubscriptions = []struct {
+	name string
+	rule ruleOptions
+}{
+	{"demo-all", ruleOptions{}},
+	{"demo-eu-orders", ruleOptions{Correlation: "region=eu,type=order"}},
+	{"demo-urgent", ruleOptions{SQL: "priority >= 7", Action: "SET sys.Label = 'urgent'; SET escalated = true"}},
+}
+
+var routingDemoMessages = []map[string]any{
+	{"region": "eu", "type": "order", "priority": int64(8)},
+	{"region": "us", "type": "order", "priority": int64(2)},
+	{"region": "eu", "type": "refund", "priority": int64(3)},
+	{"region": "apac", "type": "order", "priority": int64(9)},
+	{"region": "eu", "type": "order", "priority": int64(1)},
+}
+
+// routingDemo recreates the demo subscriptions, publishes messages with
+// different application properties and shows which subscriptions got them.
+func routingDemo(ctx context.Context, client *azservicebus.Client, adminClient *admin.Client, topicName string) error {
+	if err := createTopic(ctx, adminClient, topicName, entitySettings{}); err != nil {
+		return err
+	}
+
+	for _, subscription := range routingDemoSubscriptions {
+		rule, err := subscription.rule.properties()
+		if err != nil {
+			return err
+		}
+		// Recreate so the rules and the (empty) backlog are always the expected ones
+		if err := deleteSubscription(ctx, adminClient, topicName, subscription.name); err != nil {
+			return err
+		}
+		if err := createSubscription(ctx, adminClient, topicName, subscription.name, rule); err != nil {
+			return err
+		}
+	}
+
+	sender, err := client.NewSender(topicName, nil)
+	if err != nil {
+		return fmt.Errorf("new sender: %w", err)
+	}
+	defer sender.Close(ctx)
+
+	fmt.Println("Published:")
+	for i, properties := range routingDemoMessages {
+		message := &azservicebus.Message{
+			MessageID:             ptr.To(fmt.Sprintf("demo-%d", i+1)),
+			Body:                  []byte(fmt.Sprintf(`{"demo":%d}`, i+1)),
+			ApplicationProperties: properties,
+		}
+		if err := sender.SendMessage(ctx, message, nil); err != nil {
+			return fmt.Errorf("publish: %w", err)
+		}
+		fmt.Printf("- %s [%s]\n", *message.MessageID, formatProperties(properties))
+	}
+
+	fmt.Println("Delivered:")
+	for _, subscription := range routingDemoSubscriptions {
+		received, err := drainSubscription(ctx, client, topicName, subscription.name)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("- %s (%d):\n", subscription.name, len(received))
+		for _, message := range received {
+			fmt.Printf("    %s subject=%s [%s]\n", message.MessageID, ptr.Deref(message.Subject), formatProperties(message.ApplicationProperties))
+		}
+	}
+
+	return nil
+}
+
+// drainSubscription receives and completes everything currently in a subscription.
+func drainSubscription(ctx context.Context, client *azservicebus.Client, topicName string, subscriptionName string) ([]*azservicebus.ReceivedMessage, error) {
+	receiver, err := client.NewReceiverForSubscription(topicName, subscriptionName, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new receiver: %w", err)
+	}
+	defer receiver.Close(ctx)
+
+	var received []*azservicebus.ReceivedMessage
+	for {
+		receiveCtx, receiveCancel := context.WithTimeout(ctx, 5*time.Second)
+		messages, err := receiver.ReceiveMessages(receiveCtx, 10, nil)
+		receiveCancel()
+
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return received, fmt.Errorf("receive from %s: %w", subscriptionName, err)
+		}
+		if len(messages) == 0 {
+			return received, nil
+		}
+
+		for _, message := range messages {
+			if err := receiver.CompleteMessage(ctx, message, nil); err != nil {
+				return received, fmt.Errorf("complete message: %w", err)
+			}
+			received = append(received, message)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import {
   Queue,
   SkuName,
   SkuTier,
+  Subscription,
+  Topic,
 } from "@pulumi/azure-native/servicebus";
 
 const tags = {
@@ -55,9 +57,64 @@ const queue = new Queue(
   { parent: serviceBusNamespace }
 );
 
+// Output of the relay mode: duplicate detection drops outputs re-sent for redelivered inputs
+new Queue(
+  "OutputQueue",
+  {
+    resourceGroupName: resourceGroup.name,
+    namespaceName: serviceBusNamespace.name,
+    queueName: "training-output-queue",
+    requiresDuplicateDetection: true,
+    duplicateDetectionHistoryTimeWindow: "PT10M",
+    defaultMessageTimeToLive: "P1D",
+  },
+  { parent: serviceBusNamespace }
+);
+
+// Session-enabled queue: messages with the same SessionID are processed in order
+new Queue(
+  "SessionQueue",
+  {
+    resourceGroupName: resourceGroup.name,
+    namespaceName: serviceBusNamespace.name,
+    queueName: "training-session-queue",
+    requiresSession: true,
+    lockDuration: "PT30S",
+    maxDeliveryCount: 10,
+    defaultMessageTimeToLive: "P1D",
+  },
+  { parent: serviceBusNamespace }
+);
+
+// Topic + subscription for the publish/subscribe modes (more are created by the app)
+const topic = new Topic(
+  "Topic",
+  {
+    resourceGroupName: resourceGroup.name,
+    namespaceName: serviceBusNamespace.name,
+    topicName: "training-topic",
+    defaultMessageTimeToLive: "P1D",
+  },
+  { parent: serviceBusNamespace }
+);
+
+new Subscription(
+  "Subscription",
+  {
+    resourceGroupName: resourceGroup.name,
+    namespaceName: serviceBusNamespace.name,
+    topicName: topic.name,
+    subscriptionName: "training-subscription",
+    lockDuration: "PT30S",
+    maxDeliveryCount: 10,
+  },
+  { parent: topic }
+);
+
 // Built-in role IDs (RBAC)
 const serviceBusDataSenderRoleDefinitionId = pulumi.interpolate`/subscriptions/${azureClient.subscriptionId}/providers/Microsoft.Authorization/roleDefinitions/69a216fc-b8fb-44d8-bc22-1f3c2cd27a39`;
 const serviceBusDataReceiverRoleDefinitionId = pulumi.interpolate`/subscriptions/${azureClient.subscriptionId}/providers/Microsoft.Authorization/roleDefinitions/4f6d3b9b-027b-4f4c-9142-0e5a2a2247e0`;
+const serviceBusDataOwnerRoleDefinitionId = pulumi.interpolate`/subscriptions/${azureClient.subscriptionId}/providers/Microsoft.Authorization/roleDefinitions/090c5cfd-751d-490a-894a-3ce6f1109419`;
 
 // Least-privilege scope: the queue
 new RoleAssignment(
@@ -82,7 +139,20 @@ new RoleAssignment(
   { parent: queue }
 );
 
+// Admin commands (topics, subscriptions, rules) need Data Owner on the namespace
+new RoleAssignment(
+  "ServiceBusDataOwnerRoleAssignment",
+  {
+    principalId: azureClient.objectId,
+    principalType: "User",
+    roleDefinitionId: serviceBusDataOwnerRoleDefinitionId,
+    scope: serviceBusNamespace.id,
+  },
+  { parent: serviceBusNamespace }
+);
+
 // Outputs for the upcoming Go app (AAD + DefaultAzureCredential)
 export const serviceBusNamespaceFqdn = pulumi.interpolate`${serviceBusNamespace.name}.servicebus.windows.net`;
 export const serviceBusQueueName = queue.name;
+export const serviceBusTopicName = topic.name;
 export const resourceGroupName = resourceGroup.name;
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue/queueerror"
+
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// metadataFlag collects repeated -metadata key=value flags.
+type metadataFlag map[string]*string
+
+func (m metadataFlag) String() string {
+	return formatMetadata(m)
+}
+
+func (m metadataFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("metadata must be key=value, got %q", value)
+	}
+	m[key] = &val
+	return nil
+}
+
+// policyFlag collects repeated -policy id:permissions:duration flags for
+// stored access policies, e.g. "readers:rp:24h".
+type policyFlag []*azqueue.SignedIdentifier
+
+func (p *policyFlag) String() string {
+	var ids []string
+	for _, identifier := range *p {
+		ids = append(ids, ptr.Deref(identifier.ID))
+	}
+	return strings.Join(ids, ",")
+}
+
+func (p *policyFlag) Set(value string) error {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 || parts[0] == "" {
+		return fmt.Errorf("policy must be id:permissions:duration, got %q", value)
+	}
+
+	// Queue permissions: read, add, update, process
+	if strings.Trim(parts[1], "raup") != "" {
+		return fmt.Errorf("policy %s: permissions must be a combination of r, a, u, p", parts[0])
+	}
+
+	validFor, err := time.ParseDuration(parts[2])
+	if err != nil {
+		return fmt.Errorf("policy %s: %w", parts[0], err)
+	}
+
+	start := time.Now().UTC()
+	*p = append(*p, &azqueue.SignedIdentifier{
+		ID: ptr.To(parts[0]),
+		AccessPolicy: &azqueue.AccessPolicy{
+			Permission: ptr.To(parts[1]),
+			Start:      ptr.To(start),
+			Expiry:     ptr.To(start.Add(validFor)),
+		},
+	})
+	return nil
+}
+
+func formatMetadata(metadata map[string]*string) string {
+	var pairs []string
+	for key, value := range metadata {
+		pairs = append(pairs, key+"="+ptr.Deref(value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func createQueue(ctx context.Context, queueClient *azqueue.QueueClient, metadata map[string]*string) error {
+	_, err := queueClient.Create(ctx, &azqueue.CreateOptions{Metadata: metadata})
+	if queueerror.HasCode(err, queueerror.QueueAlreadyExists) {
+		// Create is idempotent only when the metadata matches, otherwise the
+		// service returns a conflict and the requested metadata is not applied
+		return fmt.Errorf("queue %s already exists with different metadata, change it with -mode set-metadata: %w", queueClient.URL(), err)
+	}
+	if err != nil {
+		return fmt.Errorf("create queue: %w", err)
+	}
+
+	log.Printf("Created queue %s metadata=[%s]", queueClient.URL(), formatMetadata(metadata))
+	return nil
+}
+
+func deleteQueue(ctx context.Context, queueClient *azqueue.QueueClient) error {
+	_, err := queueClient.Delete(ctx, nil)
+	if queueerror.HasCode(err, queueerror.QueueNotFound) {
+		log.Printf("Queue %s does not exist", queueClient.URL())
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("delete queue: %w", err)
+	}
+
+	log.Printf("Deleted queue %s (the name cannot be reused for about 30 seconds)", queueClient.URL())
+	return nil
+}
+
+func setQueueMetadata(ctx context.Context, queueClient *azqueue.QueueClient, metadata map[string]*string) error {
+	// SetMetadata replaces all existing metadata
+	_, err := queueClient.SetMetadata(ctx, &azqueue.SetMetadataOptions{Metadata: metadata})
+	if err != nil {
+		return fmt.Errorf("set metadata: %w", err)
+	}
+
+	log.Printf("Metadata of %s set to [%s]", queueClient.URL(), formatMetadata(metadata))
+	return nil
+}
+
+func listQueues(ctx context.Context, serviceClient *azqueue.ServiceClient, prefix string) error {
+	options := &azqueue.ListQueuesOptions{Include: azqueue.ListQueuesInclude{Metadata: true}}
+	if prefix != "" {
+		options.Prefix = &prefix
+	}
+
+	total := 0
+	pager := serviceClient.NewListQueuesPager(options)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("list queues: %w", err)
+		}
+
+		for _, queue := range page.Queues {
+			total++
+			fmt.Printf("- %s", ptr.Deref(queue.Name))
+			if len(queue.Metadata) > 0 {
+				fmt.Printf(" metadata=[%s]", formatMetadata(queue.Metadata))
+			}
+			fmt.Println()
+		}
+	}
+
+	fmt.Printf("%d queue(s) with prefix %q\n", total, prefix)
+	return nil
+}
+
+// peekMessages shows up to count messages from the front of the queue without
+// changing their visibility or dequeue count.
+func peekMessages(ctx context.Context, queueClient *azqueue.QueueClient, count int32) error {
+	resp, err := queueClient.PeekMessages(ctx, &azqueue.PeekMessagesOptions{NumberOfMessages: &count})
+	if err != nil {
+		return fmt.Errorf("peek messages: %w", err)
+	}
+
+	for _, message := range resp.Messages {
+		var inserted, expires string
+		if message.InsertionTime != nil {
+			inserted = message.InsertionTime.Format(time.RFC3339)
+		}
+		if message.ExpirationTime != nil {
+			expires = message.ExpirationTime.Format(time.RFC3339)
+		}
+
+		var dequeueCount int64
+		if message.DequeueCount != nil {
+			dequeueCount = *message.DequeueCount
+		}
+
+		fmt.Printf("- messageId=%s dequeueCount=%d inserted=%s expires=%s body=%s\n",
+			ptr.Deref(message.MessageID), dequeueCount, inserted, expires, ptr.Deref(message.MessageText))
+	}
+
+	fmt.Printf("Peeked %d message(s)\n", len(resp.Messages))
+	return nil
+}
+
+func clearQueue(ctx context.Context, queueClient *azqueue.QueueClient) error {
+	_, err := queueClient.ClearMessages(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("clear messages: %w", err)
+	}
+
+	log.Printf("Cleared all messages from %s", queueClient.URL())
+	return nil
+}
+
+// printQueueStats shows the approximate message count (the service value may
+// lag behind recent operations) and the queue metadata.
+func printQueueStats(ctx context.Context, queueClient *azqueue.QueueClient) error {
+	props, err := queueClient.GetProperties(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("get queue properties: %w", err)
+	}
+
+	var count int32
+	if props.ApproximateMessagesCount != nil {
+		count = *props.ApproximateMessagesCount
+	}
+
+	fmt.Printf("Queue: %s\n", queueClient.URL())
+	fmt.Printf("Approximate message count: %d\n", count)
+	fmt.Printf("Metadata: [%s]\n", formatMetadata(props.Metadata))
+	return nil
+}
+
+// setAccessPolicies replaces the stored access policies of the queue. SAS
+// tokens can then reference a policy by id, and revoking the policy revokes
+// every token that uses it. An empty list removes all policies.
+func setAccessPolicies(ctx context.Context, queueClient *azqueue.QueueClient, policies []*azqueue.SignedIdentifier) error {
+	if len(policies) > 5 {
+		return fmt.Errorf("a queue supports at most 5 stored access policies, got %d", len(policies))
+	}
+
+	_, err := queueClient.SetAccessPolicy(ctx, &azqueue.SetAccessPolicyOptions{QueueACL: policies})
+	if err != nil {
+		return fmt.Errorf("set access policy: %w", err)
+	}
+
+	log.Printf("Set %d stored access policies on %s", len(policies), queueClient.URL())
+	return printAccessPolicies(ctx, queueClient)
+}
+
+func printAccessPolicies(ctx context.Context, queueClient *azqueue.QueueClient) error {
+	resp, err := queueClient.GetAccessPolicy(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("get access policy: %w", err)
+	}
+
+	for _, identifier := range resp.SignedIdentifiers {
+		fmt.Printf("- %s", ptr.Deref(identifier.ID))
+		if policy := identifier.AccessPolicy; policy != nil {
+			fmt.Printf(" permissions=%s", ptr.Deref(policy.Permission))
+			if policy.Start != nil {
+				fmt.Printf(" start=%s", policy.Start.Format(time.RFC3339))
+			}
+			if policy.Expiry != nil {
+				fmt.Printf(" expiry=%s", policy.Expiry.Format(time.RFC3339))
+			}
+		}
+		fmt.Println()
+	}
+
+	fmt.Printf("%d stored access policies\n", len(resp.SignedIdentifiers))
+	return nil
+}
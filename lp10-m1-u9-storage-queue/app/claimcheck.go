@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// maxMessageSize is the storage queue limit for a message as sent on the wire.
+const maxMessageSize = 64 * 1024
+
+// claimCheck is the queue message that replaces a payload too large for the
+// queue. The payload itself is stored as a blob.
+type claimCheck struct {
+	Container string `json:"container"`
+	Blob      string `json:"blob"`
+	Size      int    `json:"size"`
+}
+
+type claimCheckMessage struct {
+	ClaimCheck *claimCheck `json:"claimCheck"`
+}
+
+// claimCheckStore uploads oversized payloads to a blob container and resolves
+// claim-check messages back to their payload.
+type claimCheckStore struct {
+	client    *azblob.Client
+	container string
+
+	createOnce sync.Once
+	createErr  error
+}
+
+func newClaimCheckStore(client *azblob.Client, container string) *claimCheckStore {
+	return &claimCheckStore{client: client, container: container}
+}
+
+// wireSize is the size of body once XML-escaped in the enqueue request, which
+// is what the 64 KiB limit applies to.
+func wireSize(body string) int {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(body))
+	return buf.Len()
+}
+
+func (s *claimCheckStore) ensureContainer(ctx context.Context) error {
+	s.createOnce.Do(func() {
+		_, err := s.client.CreateContainer(ctx, s.container, nil)
+		if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+			s.createErr = fmt.Errorf("create claim-check container: %w", err)
+		}
+	})
+	return s.createErr
+}
+
+// messageFor returns the encoded body when it fits in a queue message,
+// otherwise uploads it as is and returns an encoded claim-check message
+// pointing to the blob.
+func (s *claimCheckStore) messageFor(ctx context.Context, body string, useBase64 bool) (string, error) {
+	if encoded := encodeMessage(body, useBase64); wireSize(encoded) <= maxMessageSize {
+		return encoded, nil
+	}
+
+	if err := s.ensureContainer(ctx); err != nil {
+		return "", err
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("blob name: %w", err)
+	}
+	blobName := time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+
+	_, err := s.client.UploadBuffer(ctx, s.container, blobName, []byte(body), nil)
+	if err != nil {
+		return "", fmt.Errorf("upload claim-check payload: %w", err)
+	}
+
+	reference, err := json.Marshal(claimCheckMessage{ClaimCheck: &claimCheck{
+		Container: s.container,
+		Blob:      blobName,
+		Size:      len(body),
+	}})
+	if err != nil {
+		return "", fmt.Errorf("marshal claim check: %w", err)
+	}
+
+	log.Printf("Payload of %d bytes stored as blob %s/%s", len(body), s.container, blobName)
+	return encodeMessage(string(reference), useBase64), nil
+}
+
+// parseClaimCheck returns the claim check in text, or nil for a plain message.
+func parseClaimCheck(text string) *claimCheck {
+	var message claimCheckMessage
+	if err := json.Unmarshal([]byte(text), &message); err != nil {
+		return nil
+	}
+	if message.ClaimCheck == nil || message.ClaimCheck.Blob == "" {
+		return nil
+	}
+	return message.ClaimCheck
+}
+
+// resolve returns message unchanged when it is not a claim check, otherwise a
+// copy whose text is the payload downloaded from the blob.
+func (s *claimCheckStore) resolve(ctx context.Context, message *azqueue.DequeuedMessage) (*azqueue.DequeuedMessage, *claimCheck, error) {
+	check := parseClaimCheck(ptr.Deref(message.MessageText))
+	if check == nil {
+		return message, nil, nil
+	}
+
+	resp, err := s.client.DownloadStream(ctx, check.Container, check.Blob, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("download claim-check payload %s/%s: %w", check.Container, check.Blob, err)
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read claim-check payload %s/%s: %w", check.Container, check.Blob, err)
+	}
+
+	resolved := *message
+	resolved.MessageText = ptr.To(string(payload))
+	log.Printf("Resolved claim check: messageId=%s blob=%s/%s size=%d", ptr.Deref(message.MessageID), check.Container, check.Blob, len(payload))
+	return &resolved, check, nil
+}
+
+// release deletes the payload blob once its message has been processed.
+func (s *claimCheckStore) release(ctx context.Context, check *claimCheck) error {
+	_, err := s.client.DeleteBlob(ctx, check.Container, check.Blob, nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return fmt.Errorf("delete claim-check payload %s/%s: %w", check.Container, check.Blob, err)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+
+	"github.com/neovasili/training-az-204/pkg/messaging"
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// MessageHandler processes one dequeued message. Returning an error leaves the
+// message in the queue, so it becomes visible again once its visibility
+// timeout expires and is retried with a higher DequeueCount.
+type MessageHandler func(ctx context.Context, message *azqueue.DequeuedMessage) error
+
+// newDemoHandler simulates work that takes workTime and fails with
+// probability failRate. Messages containing "poison" always fail, which makes
+// it easy to watch a message end up in the poison queue.
+func newDemoHandler(workTime time.Duration, failRate float64) MessageHandler {
+	return func(ctx context.Context, message *azqueue.DequeuedMessage) error {
+		body := ptr.Deref(message.MessageText)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(workTime):
+		}
+
+		if strings.Contains(body, "poison") {
+			return errors.New("message marked as poison")
+		}
+		if rand.Float64() < failRate {
+			return errors.New("simulated handler failure")
+		}
+
+		log.Printf("Processed: messageId=%s body=%s", ptr.Deref(message.MessageID), body)
+		return nil
+	}
+}
+
+// receiverOptions controls concurrency, polling, retries and lease handling of the receiver.
+type receiverOptions struct {
+	// MaxAttempts is the number of deliveries before a message is moved to the poison queue.
+	MaxAttempts int64
+	// VisibilityTimeout is how long a dequeued message stays hidden, in seconds.
+	VisibilityTimeout int32
+	// Workers is the number of messages processed in parallel.
+	Workers int
+	// Prefetch is the number of messages requested per dequeue call (max 32).
+	Prefetch int32
+	// PollInterval is the first wait after an empty poll, doubled up to MaxBackoff.
+	PollInterval time.Duration
+	MaxBackoff   time.Duration
+	// StatsInterval is how often the queue length is sampled and stats are logged.
+	StatsInterval time.Duration
+	// ClaimChecks resolves claim-check messages to their blob payload. Nil
+	// hands every message to the handler as is.
+	ClaimChecks *claimCheckStore
+	// Base64 decodes message text before it is resolved and handled.
+	Base64 bool
+	// Recorder, when set, records every message on its first dequeue, before
+	// it is handled. Claim checks are recorded resolved, as their payload.
+	Recorder *messaging.Recorder
+}
+
+// messageOutcome tells the receiver what happened to a message.
+type messageOutcome int
+
+const (
+	outcomeProcessed messageOutcome = iota
+	outcomeFailed
+	outcomePoisoned
+)
+
+// processMessage runs handler for one message while keeping it invisible, and
+// deletes it on success. Messages dequeued more than MaxAttempts times are
+// moved to the poison queue without calling the handler. Claim-check payloads
+// are downloaded before the handler runs and deleted only after the message,
+// so a failed attempt can still be retried.
+func processMessage(
+	ctx context.Context,
+	queueClient *azqueue.QueueClient,
+	poisonClient *azqueue.QueueClient,
+	message *azqueue.DequeuedMessage,
+	handler MessageHandler,
+	options receiverOptions,
+) (messageOutcome, error) {
+	messageID := ptr.Deref(message.MessageID)
+	dequeueCount := getDequeueCount(message)
+
+	if dequeueCount > options.MaxAttempts {
+		return outcomePoisoned, moveToPoison(ctx, queueClient, poisonClient, message)
+	}
+
+	// The handler gets a decoded copy; the original text is still needed to extend visibility
+	text, err := decodeMessage(ptr.Deref(message.MessageText), options.Base64)
+	if err != nil {
+		return outcomeFailed, err
+	}
+	payload := &azqueue.DequeuedMessage{}
+	*payload = *message
+	payload.MessageText = &text
+
+	var check *claimCheck
+	if options.ClaimChecks != nil {
+		payload, check, err = options.ClaimChecks.resolve(ctx, payload)
+		if err != nil {
+			return outcomeFailed, err
+		}
+	}
+
+	// The payload blob is deleted once the message is processed, so a
+	// recorded claim check could never be replayed
+	if options.Recorder != nil {
+		recordMessage(options.Recorder, payload)
+	}
+
+	lease := &messageLease{popReceipt: ptr.Deref(message.PopReceipt)}
+
+	// Closing stop ends the extensions without cancelling one in flight: the
+	// service may already have applied it, and its new pop receipt is the
+	// only one that can delete the message
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		extendVisibility(ctx, stop, queueClient, message, lease, options.VisibilityTimeout)
+	}()
+
+	handlerErr := handler(ctx, payload)
+	close(stop)
+	wg.Wait()
+
+	if handlerErr != nil {
+		// Leave the message alone: it reappears after the visibility timeout
+		log.Printf("Handler failed: messageId=%s attempt=%d/%d: %v", messageID, dequeueCount, options.MaxAttempts, handlerErr)
+		return outcomeFailed, nil
+	}
+
+	// Delete using messageId + the latest popReceipt (each update issues a new one)
+	_, err = queueClient.DeleteMessage(ctx, messageID, lease.get(), nil)
+	if err != nil {
+		return outcomeFailed, fmt.Errorf("delete message: %w", err)
+	}
+
+	if check != nil {
+		if err := options.ClaimChecks.release(ctx, check); err != nil {
+			return outcomeProcessed, err
+		}
+	}
+
+	return outcomeProcessed, nil
+}
+
+func getDequeueCount(message *azqueue.DequeuedMessage) int64 {
+	if message.DequeueCount == nil {
+		return 0
+	}
+	return *message.DequeueCount
+}
+
+// messageLease tracks the current pop receipt of a message being processed.
+type messageLease struct {
+	mu         sync.Mutex
+	popReceipt string
+}
+
+func (l *messageLease) get() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.popReceipt
+}
+
+func (l *messageLease) set(popReceipt string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.popReceipt = popReceipt
+}
+
+// extendVisibility pushes the visibility timeout of a message forward at half
+// the timeout interval until stop is closed, so long-running handlers keep
+// exclusive access to it.
+func extendVisibility(ctx context.Context, stop <-chan struct{}, queueClient *azqueue.QueueClient, message *azqueue.DequeuedMessage, lease *messageLease, visibilityTimeout int32) {
+	interval := time.Duration(visibilityTimeout) * time.Second / 2
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		// UpdateMessage always rewrites the content, so send the original text back
+		resp, err := queueClient.UpdateMessage(ctx, ptr.Deref(message.MessageID), lease.get(), ptr.Deref(message.MessageText), &azqueue.UpdateMessageOptions{
+			VisibilityTimeout: ptr.To(visibilityTimeout),
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("extend visibility: messageId=%s: %v", ptr.Deref(message.MessageID), err)
+			}
+			continue
+		}
+
+		lease.set(ptr.Deref(resp.PopReceipt))
+		log.Printf("Extended visibility: messageId=%s by %ds", ptr.Deref(message.MessageID), visibilityTimeout)
+	}
+}
+
+// moveToPoison copies a message to the poison queue and removes it from the
+// source queue. The poison queue must exist: the Pulumi stack provisions it,
+// and with -azurite the app creates it on startup.
+func moveToPoison(ctx context.Context, queueClient *azqueue.QueueClient, poisonClient *azqueue.QueueClient, message *azqueue.DequeuedMessage) error {
+	messageID := ptr.Deref(message.MessageID)
+
+	// TTL -1: poison messages never expire, they wait for someone to look at them
+	_, err := poisonClient.EnqueueMessage(ctx, ptr.Deref(message.MessageText), &azqueue.EnqueueMessageOptions{
+		TimeToLive: ptr.To(int32(-1)),
+	})
+	if err != nil {
+		return fmt.Errorf("enqueue poison message: %w", err)
+	}
+
+	_, err = queueClient.DeleteMessage(ctx, messageID, ptr.Deref(message.PopReceipt), nil)
+	if err != nil {
+		return fmt.Errorf("delete poison message: %w", err)
+	}
+
+	log.Printf("Moved to poison queue: messageId=%s dequeueCount=%d", messageID, getDequeueCount(message))
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// newAzuriteQueues creates a fresh queue and its poison queue on the local
+// Azurite emulator, or skips the test when Azurite is not running.
+func newAzuriteQueues(t *testing.T) (queueClient *azqueue.QueueClient, poisonClient *azqueue.QueueClient) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:10001", time.Second)
+	if err != nil {
+		t.Skip("Azurite queue service is not running on 127.0.0.1:10001 (start it with `azurite-queue`)")
+	}
+	conn.Close()
+
+	serviceClient, err := newServiceClient("", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	name := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	queueClient = serviceClient.NewQueueClient(name)
+	poisonClient = serviceClient.NewQueueClient(name + "-poison")
+	for _, client := range []*azqueue.QueueClient{queueClient, poisonClient} {
+		if _, err := client.Create(ctx, nil); err != nil {
+			t.Fatalf("create queue: %v", err)
+		}
+		t.Cleanup(func() { client.Delete(context.Background(), nil) })
+	}
+	return queueClient, poisonClient
+}
+
+func dequeueOne(t *testing.T, queueClient *azqueue.QueueClient, visibilityTimeout int32) *azqueue.DequeuedMessage {
+	t.Helper()
+
+	resp, err := queueClient.DequeueMessage(context.Background(), &azqueue.DequeueMessageOptions{
+		VisibilityTimeout: ptr.To(visibilityTimeout),
+	})
+	if err != nil {
+		t.Fatalf("dequeue message: %v", err)
+	}
+	if len(resp.Messages) != 1 {
+		t.Fatalf("dequeued %d messages, want 1", len(resp.Messages))
+	}
+	return resp.Messages[0]
+}
+
+// messageCount includes invisible messages, unlike a peek.
+func messageCount(t *testing.T, queueClient *azqueue.QueueClient) int32 {
+	t.Helper()
+
+	resp, err := queueClient.GetProperties(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("get queue properties: %v", err)
+	}
+	return ptr.Deref(resp.ApproximateMessagesCount)
+}
+
+func TestProcessMessagePoisonsAfterMaxAttempts(t *testing.T) {
+	queueClient, poisonClient := newAzuriteQueues(t)
+	ctx := context.Background()
+
+	if _, err := queueClient.EnqueueMessage(ctx, "hello", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dequeue once and make the message visible again right away, so the
+	// second dequeue has DequeueCount 2
+	first := dequeueOne(t, queueClient, 30)
+	_, err := queueClient.UpdateMessage(ctx, ptr.Deref(first.MessageID), ptr.Deref(first.PopReceipt), ptr.Deref(first.MessageText),
+		&azqueue.UpdateMessageOptions{VisibilityTimeout: ptr.To(int32(0))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := dequeueOne(t, queueClient, 30)
+
+	handlerCalled := false
+	handler := func(ctx context.Context, message *azqueue.DequeuedMessage) error {
+		handlerCalled = true
+		return nil
+	}
+
+	outcome, err := processMessage(ctx, queueClient, poisonClient, message, handler, receiverOptions{MaxAttempts: 1, VisibilityTimeout: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != outcomePoisoned {
+		t.Errorf("outcome = %d, want outcomePoisoned", outcome)
+	}
+	if handlerCalled {
+		t.Error("handler was called for a message past MaxAttempts")
+	}
+	if n := messageCount(t, queueClient); n != 0 {
+		t.Errorf("source queue has %d messages, want 0", n)
+	}
+
+	poisoned := dequeueOne(t, poisonClient, 30)
+	if got := ptr.Deref(poisoned.MessageText); got != "hello" {
+		t.Errorf("poison message text = %q, want %q", got, "hello")
+	}
+}
+
+func TestProcessMessageExtendsVisibility(t *testing.T) {
+	queueClient, poisonClient := newAzuriteQueues(t)
+	ctx := context.Background()
+
+	if _, err := queueClient.EnqueueMessage(ctx, "slow", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// With a 2s timeout visibility is extended every second
+	const visibilityTimeout = 2
+	message := dequeueOne(t, queueClient, visibilityTimeout)
+
+	handler := func(ctx context.Context, message *azqueue.DequeuedMessage) error {
+		// Outlive the original visibility timeout; an unextended message
+		// would be visible to other receivers by now
+		time.Sleep(3 * time.Second)
+
+		resp, err := queueClient.DequeueMessages(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if len(resp.Messages) > 0 {
+			return errors.New("message became visible while the handler was running")
+		}
+		return nil
+	}
+
+	outcome, err := processMessage(ctx, queueClient, poisonClient, message, handler, receiverOptions{MaxAttempts: 5, VisibilityTimeout: visibilityTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != outcomeProcessed {
+		t.Errorf("outcome = %d, want outcomeProcessed", outcome)
+	}
+	// Deleting needs the pop receipt of the last extension
+	if n := messageCount(t, queueClient); n != 0 {
+		t.Errorf("queue has %d messages after processing, want 0", n)
+	}
+}
+
+func TestProcessMessageDeletesOnlyOnSuccess(t *testing.T) {
+	queueClient, poisonClient := newAzuriteQueues(t)
+	ctx := context.Background()
+	options := receiverOptions{MaxAttempts: 5, VisibilityTimeout: 1}
+
+	if _, err := queueClient.EnqueueMessage(ctx, "retry me", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	failing := func(ctx context.Context, message *azqueue.DequeuedMessage) error {
+		return errors.New("handler failure")
+	}
+	outcome, err := processMessage(ctx, queueClient, poisonClient, dequeueOne(t, queueClient, 1), failing, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != outcomeFailed {
+		t.Errorf("outcome = %d, want outcomeFailed", outcome)
+	}
+	if n := messageCount(t, queueClient); n != 1 {
+		t.Fatalf("queue has %d messages after a failure, want 1", n)
+	}
+
+	// Wait for the failed message to become visible again
+	time.Sleep(1500 * time.Millisecond)
+
+	var handled string
+	succeeding := func(ctx context.Context, message *azqueue.DequeuedMessage) error {
+		handled = ptr.Deref(message.MessageText)
+		return nil
+	}
+	outcome, err = processMessage(ctx, queueClient, poisonClient, dequeueOne(t, queueClient, 1), succeeding, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != outcomeProcessed {
+		t.Errorf("outcome = %d, want outcomeProcessed", outcome)
+	}
+	if handled != "retry me" {
+		t.Errorf("handler got %q, want %q", handled, "retry me")
+	}
+	if n := messageCount(t, queueClient); n != 0 {
+		t.Errorf("queue has %d messages after success, want 0", n)
+	}
+}
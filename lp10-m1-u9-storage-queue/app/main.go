@@ -5,29 +5,118 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue/queueerror"
+
+	"github.com/neovasili/training-az-204/pkg/messaging"
+	"github.com/neovasili/training-az-204/pkg/ptr"
 )
 
+// Well-known Azurite development account (not a secret)
+const azuriteConnectionString = "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;" +
+	"AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;" +
+	"BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;" +
+	"QueueEndpoint=http://127.0.0.1:10001/devstoreaccount1;"
+
 func main() {
 	var (
-		mode     = flag.String("mode", "", "send|receive")
-		interval = flag.Duration("interval", 2*time.Second, "send interval (send mode) / poll interval (receive mode)")
-		count    = flag.Int("count", 0, "messages to send (0 = forever) (send mode)")
+		mode      = flag.String("mode", "", "send|receive|replay|create|delete|set-metadata|list|peek|clear|stats|set-acl|get-acl")
+		queueName = flag.String("queue", "training-queue", "queue name; receive mode also needs <queue>-poison, which the Pulumi stack provisions for training-queue only")
+		interval  = flag.Duration("interval", 2*time.Second, "send interval (send mode) / poll interval (receive mode)")
+		count     = flag.Int("count", 0, "messages to send (0 = forever) (send mode) / to peek, 1-32 (peek mode)")
+		prefix    = flag.String("prefix", "", "queue name prefix (list mode)")
+
+		source              = flag.String("source", "counter", "payload source: counter|lines|template|random (send mode)")
+		payloadFile         = flag.String("file", "-", `file to read payload lines from, "-" for stdin (lines source)`)
+		payloadTemplate     = flag.String("template", "", "Go text/template for payloads, or @path to a template file (template source)")
+		payloadSize         = flag.Int("payload-size", 1024, "bytes of random data per message; over 64 KiB it is sent as a claim check (random source)")
+		useBase64           = flag.Bool("base64", false, "base64-encode message text, as Functions queue triggers expect (send mode) / decode it (receive mode)")
+		messageTTL          = flag.Duration("message-ttl", 0, "message time-to-live, 0 = service default (7 days), negative = never expires (send mode)")
+		delay               = flag.Duration("delay", 0, "initial visibility delay of each message (send mode)")
+		claimCheckContainer = flag.String("claim-check-container", "claim-checks", "blob container for payloads that do not fit in a queue message")
+
+		maxAttempts       = flag.Int64("max-attempts", 5, "deliveries before a message is moved to <queue>-poison (receive mode)")
+		visibilityTimeout = flag.Int("visibility-timeout", 30, "seconds a dequeued message stays invisible, extended while the handler runs (receive mode)")
+		workTime          = flag.Duration("work", 0, "simulated processing time per message (receive mode)")
+		failRate          = flag.Float64("fail-rate", 0, "probability that the demo handler fails (receive mode)")
+		workers           = flag.Int("workers", 1, "parallel message handlers (receive mode)")
+		prefetch          = flag.Int("prefetch", 10, "messages per dequeue call, 1-32 (receive mode)")
+		maxBackoff        = flag.Duration("max-backoff", 30*time.Second, "maximum wait between polls of an empty queue (receive mode)")
+		statsInterval     = flag.Duration("stats-interval", 10*time.Second, "how often to sample the queue length and log stats (receive mode)")
+		azurite           = flag.Bool("azurite", false, "use the local Azurite emulator instead of the storage account")
+		recording         = flag.String("recording", "", "NDJSON file dequeued messages are appended to (receive mode) or replayed from (replay mode)")
+		speed             = flag.Float64("speed", 1, "replay timing: 1 = original gaps, 2 = twice as fast, 0 = no gaps (replay mode)")
+		transport         = flag.String("transport", "", "storagequeue|servicebus|eventhubs: send or receive through the shared messaging package to compare transports (send/receive modes)")
 	)
+	metadata := metadataFlag{}
+	flag.Var(metadata, "metadata", "queue metadata key=value, repeatable (create/set-metadata modes)")
+	var policies policyFlag
+	flag.Var(&policies, "policy", "stored access policy id:permissions(raup):duration, repeatable (set-acl mode)")
 	flag.Parse()
 
-	if *mode != "send" && *mode != "receive" {
-		log.Fatal(`-mode is required and must be "send" or "receive"`)
+	switch *mode {
+	case "send", "receive", "replay", "create", "delete", "set-metadata", "list", "peek", "clear", "stats", "set-acl", "get-acl":
+	default:
+		log.Fatal(`-mode is required and must be one of send, receive, replay, create, delete, set-metadata, list, peek, clear, stats, set-acl, get-acl`)
+	}
+
+	if *delay < 0 || *delay > 7*24*time.Hour {
+		log.Fatal("-delay must be between 0 and 7 days")
+	}
+	if *messageTTL > 0 && *delay >= *messageTTL {
+		log.Fatal("-delay must be shorter than -message-ttl")
+	}
+
+	if *mode == "peek" && *count == 0 {
+		*count = 32
+	}
+	if *mode == "peek" && (*count < 1 || *count > 32) {
+		log.Fatal("-count must be between 1 and 32 in peek mode")
+	}
+
+	if *visibilityTimeout < 1 {
+		log.Fatal("-visibility-timeout must be at least 1 second")
+	}
+
+	if *prefetch < 1 || *prefetch > 32 {
+		log.Fatal("-prefetch must be between 1 and 32")
+	}
+
+	if *workers < 1 {
+		log.Fatal("-workers must be at least 1")
+	}
+
+	if *statsInterval <= 0 {
+		log.Fatal("-stats-interval must be positive")
+	}
+
+	// The receiver's jittered backoff needs a positive poll interval
+	if *interval < 0 {
+		log.Fatal("-interval must not be negative")
+	}
+	if *mode == "receive" && (*interval == 0 || *maxBackoff <= 0) {
+		log.Fatal("-interval and -max-backoff must be positive in receive mode")
+	}
+
+	if *speed < 0 {
+		log.Fatal("-speed must not be negative")
+	}
+	if *mode == "replay" && *recording == "" {
+		log.Fatal("-recording is required in replay mode")
 	}
 
 	queueServiceURL := "https://storagequeuetestaz204q.queue.core.windows.net"
-	queueName := "training-queue"
+	blobServiceURL := "https://storagequeuetestaz204q.blob.core.windows.net/"
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -46,55 +135,280 @@ func main() {
 		log.Fatalf("credential: %v", err)
 	}
 
-	serviceClient, err := azqueue.NewServiceClient(queueServiceURL, credential, nil)
+	// -transport runs the shared messaging demo instead of runSender and
+	// runReceiver below. Those stay on the SDK because the Sender and Receiver
+	// interfaces cannot express the poison queue, claim checks, visibility extension and TTLs.
+	if *transport != "" {
+		if *azurite {
+			log.Fatal("-transport does not support -azurite")
+		}
+
+		endpoints := messaging.LabEndpoints
+		endpoints.StorageQueueService = queueServiceURL
+		endpoints.StorageQueue = *queueName
+		demoOptions := messaging.DemoOptions{
+			Endpoints: endpoints,
+			Interval:  *interval,
+			Count:     *count,
+			WorkTime:  *workTime,
+			FailRate:  *failRate,
+		}
+		if *recording != "" && *mode == "receive" {
+			if demoOptions.Recorder, err = messaging.CreateRecorder(*recording); err != nil {
+				log.Fatal(err)
+			}
+			defer demoOptions.Recorder.Close()
+		}
+
+		err = messaging.RunDemo(ctx, *mode, *transport, credential, demoOptions)
+		if err != nil {
+			log.Fatalf("%s failed: %v", *mode, err)
+		}
+		return
+	}
+
+	serviceClient, err := newServiceClient(queueServiceURL, credential, *azurite)
 	if err != nil {
 		log.Fatalf("queue service client: %v", err)
 	}
 
-	queueClient := serviceClient.NewQueueClient(queueName)
+	blobClient, err := newBlobClient(blobServiceURL, credential, *azurite)
+	if err != nil {
+		log.Fatalf("blob client: %v", err)
+	}
+	claimChecks := newClaimCheckStore(blobClient, *claimCheckContainer)
+
+	queueClient := serviceClient.NewQueueClient(*queueName)
+	poisonClient := serviceClient.NewQueueClient(*queueName + "-poison")
+
+	// Azurite starts empty, so create the queues the Pulumi stack would provide
+	if *azurite && (*mode == "send" || *mode == "receive" || *mode == "replay") {
+		for _, client := range []*azqueue.QueueClient{queueClient, poisonClient} {
+			_, err := client.Create(ctx, nil)
+			if err != nil && !queueerror.HasCode(err, queueerror.QueueAlreadyExists) {
+				log.Fatalf("create queue: %v", err)
+			}
+		}
+	}
 
 	switch *mode {
 	case "send":
-		if err := runSender(ctx, queueClient, *interval, *count); err != nil {
+		payloadSource, err := newPayloadSource(payloadOptions{
+			Source:   *source,
+			File:     *payloadFile,
+			Template: *payloadTemplate,
+			Size:     *payloadSize,
+		})
+		if err != nil {
+			log.Fatalf("payload source: %v", err)
+		}
+
+		options := senderOptions{
+			Interval: *interval,
+			Count:    *count,
+			Base64:   *useBase64,
+			TTL:      *messageTTL,
+			Delay:    *delay,
+		}
+		if err := runSender(ctx, queueClient, claimChecks, payloadSource, options); err != nil {
 			log.Fatalf("send failed: %v", err)
 		}
 	case "receive":
-		if err := runReceiver(ctx, queueClient, *interval); err != nil {
+		options := receiverOptions{
+			MaxAttempts:       *maxAttempts,
+			VisibilityTimeout: int32(*visibilityTimeout),
+			Workers:           *workers,
+			Prefetch:          int32(*prefetch),
+			PollInterval:      *interval,
+			MaxBackoff:        *maxBackoff,
+			StatsInterval:     *statsInterval,
+			ClaimChecks:       claimChecks,
+			Base64:            *useBase64,
+		}
+		if *recording != "" {
+			recorder, err := messaging.CreateRecorder(*recording)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer recorder.Close()
+			options.Recorder = recorder
+		}
+		handler := newDemoHandler(*workTime, *failRate)
+		if err := runReceiver(ctx, queueClient, poisonClient, handler, options); err != nil {
 			log.Fatalf("receive failed: %v", err)
 		}
+	case "replay":
+		err = runReplay(ctx, queueClient, claimChecks, *recording, *speed, *useBase64)
+	case "create":
+		err = createQueue(ctx, queueClient, metadata)
+	case "delete":
+		err = deleteQueue(ctx, queueClient)
+	case "set-metadata":
+		err = setQueueMetadata(ctx, queueClient, metadata)
+	case "list":
+		err = listQueues(ctx, serviceClient, *prefix)
+	case "peek":
+		err = peekMessages(ctx, queueClient, int32(*count))
+	case "clear":
+		err = clearQueue(ctx, queueClient)
+	case "stats":
+		err = printQueueStats(ctx, queueClient)
+	case "set-acl":
+		err = setAccessPolicies(ctx, queueClient, policies)
+	case "get-acl":
+		err = printAccessPolicies(ctx, queueClient)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %v", *mode, err)
 	}
 }
 
-func runSender(ctx context.Context, queueClient *azqueue.QueueClient, interval time.Duration, count int) error {
+// senderOptions controls what the sender enqueues and how.
+type senderOptions struct {
+	Interval time.Duration
+	// Count stops after this many messages; 0 sends until the source is exhausted or Ctrl+C.
+	Count  int
+	Base64 bool
+	// TTL is the message time-to-live; 0 keeps the service default (7 days), negative never expires.
+	TTL time.Duration
+	// Delay keeps each new message invisible for this long after it is enqueued.
+	Delay time.Duration
+}
+
+func (o senderOptions) enqueueOptions() *azqueue.EnqueueMessageOptions {
+	options := &azqueue.EnqueueMessageOptions{}
+	switch {
+	case o.TTL < 0:
+		options.TimeToLive = ptr.To(int32(-1))
+	case o.TTL > 0:
+		options.TimeToLive = ptr.To(int32(o.TTL / time.Second))
+	}
+	if o.Delay > 0 {
+		options.VisibilityTimeout = ptr.To(int32(o.Delay / time.Second))
+	}
+	return options
+}
+
+func runSender(ctx context.Context, queueClient *azqueue.QueueClient, claimChecks *claimCheckStore, source PayloadSource, options senderOptions) error {
 	log.Printf("Sending to storage queue=%s using AAD...", queueClient.URL())
 
+	enqueueOptions := options.enqueueOptions()
+
 	sent := 0
 	for {
-		if count > 0 && sent >= count {
+		if options.Count > 0 && sent >= options.Count {
 			log.Printf("Done. Sent %d messages.", sent)
 			return nil
 		}
 
-		body := fmt.Sprintf(`{"counter":%d,"ts":"%s"}`, sent, time.Now().UTC().Format(time.RFC3339Nano))
+		body, err := source.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			log.Printf("Done. Payload source exhausted after %d messages.", sent)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Oversized bodies are uploaded to blob storage and replaced by a reference
+		message, err := claimChecks.messageFor(ctx, body, options.Base64)
+		if err != nil {
+			return err
+		}
 
-		_, err := queueClient.EnqueueMessage(ctx, body, nil)
+		_, err = queueClient.EnqueueMessage(ctx, message, enqueueOptions)
 		if err != nil {
 			return fmt.Errorf("enqueue message: %w", err)
 		}
 
 		sent++
-		log.Printf("Sent message #%d", sent)
+		log.Printf("Sent message #%d (%d bytes)", sent, len(body))
 
 		select {
 		case <-ctx.Done():
 			return nil
-		case <-time.After(interval):
+		case <-time.After(options.Interval):
 		}
 	}
 }
 
-func runReceiver(ctx context.Context, queueClient *azqueue.QueueClient, pollInterval time.Duration) error {
-	log.Printf("Receiving from storage queue=%s using AAD...", queueClient.URL())
+func newServiceClient(queueServiceURL string, credential *azidentity.DefaultAzureCredential, azurite bool) (*azqueue.ServiceClient, error) {
+	if azurite {
+		return azqueue.NewServiceClientFromConnectionString(azuriteConnectionString, nil)
+	}
+	return azqueue.NewServiceClient(queueServiceURL, credential, nil)
+}
+
+func newBlobClient(blobServiceURL string, credential *azidentity.DefaultAzureCredential, azurite bool) (*azblob.Client, error) {
+	if azurite {
+		return azblob.NewClientFromConnectionString(azuriteConnectionString, nil)
+	}
+	return azblob.NewClient(blobServiceURL, credential, nil)
+}
+
+// runReceiver dequeues up to Prefetch messages at a time and hands them to a
+// pool of Workers. Empty polls back off exponentially (with jitter) from
+// PollInterval up to MaxBackoff. On Ctrl+C it stops dequeuing, lets the
+// workers finish every message already dequeued, and prints final stats.
+func runReceiver(
+	ctx context.Context,
+	queueClient *azqueue.QueueClient,
+	poisonClient *azqueue.QueueClient,
+	handler MessageHandler,
+	options receiverOptions,
+) error {
+	// Fail now rather than on the first poison message: the Pulumi stack only
+	// provisions the poison queue of training-queue
+	if _, err := poisonClient.GetProperties(ctx, nil); err != nil {
+		if queueerror.HasCode(err, queueerror.QueueNotFound) {
+			return fmt.Errorf("poison queue %s does not exist, create it with -mode create -queue <queue>-poison", poisonClient.URL())
+		}
+		return fmt.Errorf("get poison queue properties: %w", err)
+	}
+
+	log.Printf("Receiving from storage queue=%s with %d worker(s) using AAD...", queueClient.URL(), options.Workers)
+
+	stats := newReceiverStats()
+	go stats.sampleQueueLength(ctx, queueClient, options.StatsInterval)
+
+	// In-flight work must survive Ctrl+C, so workers use a context that is not cancelled with ctx
+	processCtx := context.WithoutCancel(ctx)
+	jobs := make(chan *azqueue.DequeuedMessage)
+
+	var wg sync.WaitGroup
+	for w := 0; w < options.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for message := range jobs {
+				var queueTime time.Duration
+				if message.InsertionTime != nil {
+					queueTime = time.Since(*message.InsertionTime)
+				}
+
+				start := time.Now()
+				outcome, err := processMessage(processCtx, queueClient, poisonClient, message, handler, options)
+				if err != nil {
+					log.Printf("process message %s: %v", ptr.Deref(message.MessageID), err)
+				}
+				stats.record(outcome, time.Since(start), queueTime)
+			}
+		}()
+	}
+
+	err := dispatchMessages(ctx, queueClient, jobs, options)
+
+	close(jobs)
+	wg.Wait()
+	stats.finalReport()
+
+	return err
+}
+
+// dispatchMessages polls the queue until ctx is cancelled and feeds every
+// dequeued message to jobs.
+func dispatchMessages(ctx context.Context, queueClient *azqueue.QueueClient, jobs chan<- *azqueue.DequeuedMessage, options receiverOptions) error {
+	backoff := options.PollInterval
 
 	for {
 		select {
@@ -105,44 +419,41 @@ func runReceiver(ctx context.Context, queueClient *azqueue.QueueClient, pollInte
 
 		receiveCtx, receiveCancel := context.WithTimeout(ctx, 30*time.Second)
 		dequeueResponse, err := queueClient.DequeueMessages(receiveCtx, &azqueue.DequeueMessagesOptions{
-			NumberOfMessages:  toPtr(int32(10)),
-			VisibilityTimeout: toPtr(int32(30)), // seconds (messages become visible again if not deleted)
+			NumberOfMessages:  ptr.To(options.Prefetch),
+			VisibilityTimeout: ptr.To(options.VisibilityTimeout), // seconds (messages become visible again if not deleted)
 		})
 		receiveCancel()
 
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			// If nothing is returned before the timeout, treat it as "no messages right now".
-			if errors.Is(err, context.DeadlineExceeded) {
-				time.Sleep(pollInterval)
-				continue
+			if !errors.Is(err, context.DeadlineExceeded) {
+				return fmt.Errorf("dequeue messages: %w", err)
 			}
-			return fmt.Errorf("dequeue messages: %w", err)
 		}
 
-		if len(dequeueResponse.Messages) == 0 {
-			time.Sleep(pollInterval)
+		if err != nil || len(dequeueResponse.Messages) == 0 {
+			// Full jitter: sleep a random duration up to the current backoff
+			wait := time.Duration(rand.Int64N(int64(backoff) + 1))
+			backoff = min(backoff*2, options.MaxBackoff)
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(wait):
+			}
 			continue
 		}
 
-		for _, message := range dequeueResponse.Messages {
-			log.Printf("Received: messageId=%s body=%s", safeString(message.MessageID), safeString(message.MessageText))
+		backoff = options.PollInterval
 
-			// Delete using messageId + popReceipt
-			_, err := queueClient.DeleteMessage(ctx, safeString(message.MessageID), safeString(message.PopReceipt), nil)
-			if err != nil {
-				return fmt.Errorf("delete message: %w", err)
-			}
+		// Dequeued messages are ours until their visibility timeout, so they are
+		// always handed to a worker, even if Ctrl+C arrives meanwhile.
+		for _, message := range dequeueResponse.Messages {
+			log.Printf("Received: messageId=%s dequeueCount=%d body=%s", ptr.Deref(message.MessageID), getDequeueCount(message), ptr.Deref(message.MessageText))
+			jobs <- message
 		}
 	}
 }
-
-func safeString(value *string) string {
-	if value == nil {
-		return ""
-	}
-	return *value
-}
-
-func toPtr[T any](value T) *T {
-	return &value
-}
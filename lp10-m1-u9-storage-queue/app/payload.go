@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PayloadSource produces message bodies for the sender. Next returns io.EOF
+// when the source is exhausted.
+type PayloadSource interface {
+	Next(ctx context.Context) (string, error)
+}
+
+// payloadOptions selects and configures a PayloadSource from flags.
+type payloadOptions struct {
+	Source   string // counter|lines|template|random
+	File     string // lines: file path, "-" for stdin
+	Template string // template: inline text, or @path to read it from a file
+	Size     int    // random: payload size in bytes
+}
+
+func newPayloadSource(options payloadOptions) (PayloadSource, error) {
+	switch options.Source {
+	case "", "counter":
+		return &counterSource{}, nil
+	case "lines":
+		return newLinesSource(options.File)
+	case "template":
+		return newTemplateSource(options.Template)
+	case "random":
+		if options.Size < 1 {
+			return nil, fmt.Errorf("random source needs a positive -payload-size")
+		}
+		return &randomSource{size: options.Size}, nil
+	default:
+		return nil, fmt.Errorf("unknown payload source %q (counter|lines|template|random)", options.Source)
+	}
+}
+
+// counterSource is the original demo payload: a counter and a timestamp.
+type counterSource struct {
+	counter int
+}
+
+func (s *counterSource) Next(ctx context.Context) (string, error) {
+	body := fmt.Sprintf(`{"counter":%d,"ts":"%s"}`, s.counter, time.Now().UTC().Format(time.RFC3339Nano))
+	s.counter++
+	return body, nil
+}
+
+// linesSource sends one message per non-empty line of a file or stdin.
+type linesSource struct {
+	scanner *bufio.Scanner
+}
+
+func newLinesSource(path string) (*linesSource, error) {
+	var reader io.Reader = os.Stdin
+	if path != "" && path != "-" {
+		// The file stays open for the life of the process
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("open payload file: %w", err)
+		}
+		reader = file
+	}
+
+	scanner := bufio.NewScanner(reader)
+	// Lines may be larger than a queue message; those go out as claim checks
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	return &linesSource{scanner: scanner}, nil
+}
+
+func (s *linesSource) Next(ctx context.Context) (string, error) {
+	for s.scanner.Scan() {
+		if line := strings.TrimSpace(s.scanner.Text()); line != "" {
+			return line, nil
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return "", fmt.Errorf("read payload lines: %w", err)
+	}
+	return "", io.EOF
+}
+
+// templateData is what a payload template can reference.
+type templateData struct {
+	Counter int
+	Time    time.Time
+}
+
+// templateSource renders a Go text/template per message, e.g.
+// {"id":{{.Counter}},"at":"{{.Time.Format "15:04:05"}}","code":"{{randString 8}}"}.
+type templateSource struct {
+	tmpl    *template.Template
+	counter int
+}
+
+var templateFuncs = template.FuncMap{
+	"randInt":    func(n int) int { return rand.IntN(n) },
+	"randString": randomString,
+	"randChoice": func(values ...string) string { return values[rand.IntN(len(values))] },
+}
+
+func newTemplateSource(text string) (*templateSource, error) {
+	if path, ok := strings.CutPrefix(text, "@"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read template: %w", err)
+		}
+		text = string(data)
+	}
+	if text == "" {
+		return nil, fmt.Errorf("template source needs -template")
+	}
+
+	tmpl, err := template.New("payload").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse template: %w", err)
+	}
+	return &templateSource{tmpl: tmpl}, nil
+}
+
+func (s *templateSource) Next(ctx context.Context) (string, error) {
+	var buf bytes.Buffer
+	if err := s.tmpl.Execute(&buf, templateData{Counter: s.counter, Time: time.Now().UTC()}); err != nil {
+		return "", fmt.Errorf("render template: %w", err)
+	}
+	s.counter++
+	return buf.String(), nil
+}
+
+// randomSource sends random alphanumeric text of a fixed size.
+type randomSource struct {
+	size int
+}
+
+func (s *randomSource) Next(ctx context.Context) (string, error) {
+	return randomString(s.size), nil
+}
+
+const alphanumeric = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = alphanumeric[rand.IntN(len(alphanumeric))]
+	}
+	return string(b)
+}
+
+// encodeMessage applies the message encoding. Functions queue triggers expect
+// base64 by default.
+func encodeMessage(text string, useBase64 bool) string {
+	if !useBase64 {
+		return text
+	}
+	return base64.StdEncoding.EncodeToString([]byte(text))
+}
+
+func decodeMessage(text string, useBase64 bool) (string, error) {
+	if !useBase64 {
+		return text, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return "", fmt.Errorf("decode base64 message: %w", err)
+	}
+	return string(data), nil
+}
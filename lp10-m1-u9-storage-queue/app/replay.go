@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+
+	"github.com/neovasili/training-az-204/pkg/messaging"
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// recordMessage appends a message to the recording. message is the payload
+// handed to the handler: decoded and with its claim check resolved, so a
+// replay sends the same payload with or without -base64, even once the
+// claim-check blob has been deleted.
+func recordMessage(recorder *messaging.Recorder, message *azqueue.DequeuedMessage) {
+	delivery := messaging.StorageQueueDelivery(message, []byte(ptr.Deref(message.MessageText)))
+	if err := recorder.Write("storagequeue", delivery); err != nil {
+		log.Print(err)
+	}
+}
+
+// claimCheckSender enqueues like the Storage queue sender, except that
+// payloads too large for a queue message go through the claim-check store again.
+type claimCheckSender struct {
+	*messaging.StorageQueueSender
+	queueClient *azqueue.QueueClient
+	claimChecks *claimCheckStore
+	base64      bool
+}
+
+func (s *claimCheckSender) Send(ctx context.Context, messages ...messaging.Message) error {
+	for _, m := range messages {
+		text, err := s.claimChecks.messageFor(ctx, string(m.Body), s.base64)
+		if err != nil {
+			return err
+		}
+		if _, err := s.queueClient.EnqueueMessage(ctx, text, nil); err != nil {
+			return fmt.Errorf("enqueue message: %w", err)
+		}
+	}
+	return nil
+}
+
+// runReplay enqueues the messages of a recording made with -recording,
+// keeping their original gaps divided by speed. Recorded payloads that do not
+// fit in a queue message are uploaded as new claim checks.
+func runReplay(ctx context.Context, queueClient *azqueue.QueueClient, claimChecks *claimCheckStore, path string, speed float64, useBase64 bool) error {
+	records, err := messaging.ReadRecording(path)
+	if err != nil {
+		return err
+	}
+
+	sender := &claimCheckSender{
+		StorageQueueSender: messaging.NewStorageQueueSender(queueClient, &messaging.StorageQueueOptions{Base64: useBase64}),
+		queueClient:        queueClient,
+		claimChecks:        claimChecks,
+		base64:             useBase64,
+	}
+
+	log.Printf("Replaying %d message(s) from %s to %s at speed %g...", len(records), path, queueClient.URL(), speed)
+	sent, err := messaging.Replay(ctx, sender, records, speed)
+	log.Printf("Done. Replayed %d of %d message(s).", sent, len(records))
+	return err
+}
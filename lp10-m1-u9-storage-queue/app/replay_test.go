@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+
+	"github.com/neovasili/training-az-204/pkg/messaging"
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// newAzuriteClaimChecks returns a claim-check store with its own container on
+// the local Azurite emulator, or skips the test when Azurite is not running.
+func newAzuriteClaimChecks(t *testing.T) *claimCheckStore {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:10000", time.Second)
+	if err != nil {
+		t.Skip("Azurite blob service is not running on 127.0.0.1:10000 (start it with `azurite-blob`)")
+	}
+	conn.Close()
+
+	blobClient, err := newBlobClient("", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	t.Cleanup(func() { blobClient.DeleteContainer(context.Background(), container, nil) })
+	return newClaimCheckStore(blobClient, container)
+}
+
+func TestReplayClaimCheck(t *testing.T) {
+	queueClient, poisonClient := newAzuriteQueues(t)
+	claimChecks := newAzuriteClaimChecks(t)
+	ctx := context.Background()
+
+	body := strings.Repeat("x", maxMessageSize+1)
+	text, err := claimChecks.messageFor(ctx, body, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := parseClaimCheck(text)
+	if check == nil {
+		t.Fatalf("oversized body was enqueued as is")
+	}
+	if _, err := queueClient.EnqueueMessage(ctx, text, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "recording.ndjson")
+	recorder, err := messaging.CreateRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handled []string
+	handler := func(ctx context.Context, message *azqueue.DequeuedMessage) error {
+		handled = append(handled, ptr.Deref(message.MessageText))
+		return nil
+	}
+	options := receiverOptions{MaxAttempts: 5, VisibilityTimeout: 30, ClaimChecks: claimChecks, Recorder: recorder}
+
+	if _, err := processMessage(ctx, queueClient, poisonClient, dequeueOne(t, queueClient, 30), handler, options); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Processing released the payload, the replay cannot rely on it
+	_, err = claimChecks.client.DownloadStream(ctx, check.Container, check.Blob, nil)
+	if !bloberror.HasCode(err, bloberror.BlobNotFound) {
+		t.Fatalf("download of a released payload = %v, want BlobNotFound", err)
+	}
+
+	if err := runReplay(ctx, queueClient, claimChecks, path, 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := dequeueOne(t, queueClient, 30)
+	if parseClaimCheck(ptr.Deref(replayed.MessageText)) == nil {
+		t.Errorf("replayed payload was not sent as a claim check")
+	}
+	options.Recorder = nil
+	outcome, err := processMessage(ctx, queueClient, poisonClient, replayed, handler, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != outcomeProcessed {
+		t.Errorf("outcome = %d, want outcomeProcessed", outcome)
+	}
+
+	if len(handled) != 2 || handled[0] != body || handled[1] != body {
+		t.Errorf("handler got %d payload(s), want the original payload twice", len(handled))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+)
+
+// receiverStats aggregates what the workers did, for periodic and final reports.
+type receiverStats struct {
+	mu sync.Mutex
+
+	started   time.Time
+	processed int
+	failed    int
+	poisoned  int
+
+	processTimes []time.Duration // handler + delete, per message
+	queueTimes   []time.Duration // insertion to dequeue, per message
+	queueLengths []int32         // approximate message count samples
+}
+
+func newReceiverStats() *receiverStats {
+	return &receiverStats{started: time.Now()}
+}
+
+func (s *receiverStats) record(outcome messageOutcome, processTime time.Duration, queueTime time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch outcome {
+	case outcomeProcessed:
+		s.processed++
+		s.processTimes = append(s.processTimes, processTime)
+		s.queueTimes = append(s.queueTimes, queueTime)
+	case outcomeFailed:
+		s.failed++
+	case outcomePoisoned:
+		s.poisoned++
+	}
+}
+
+// sampleQueueLength records the approximate queue length from GetProperties
+// every interval until ctx is cancelled.
+func (s *receiverStats) sampleQueueLength(ctx context.Context, queueClient *azqueue.QueueClient, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		props, err := queueClient.GetProperties(ctx, nil)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("get queue properties: %v", err)
+			}
+			continue
+		}
+
+		var length int32
+		if props.ApproximateMessagesCount != nil {
+			length = *props.ApproximateMessagesCount
+		}
+
+		s.mu.Lock()
+		s.queueLengths = append(s.queueLengths, length)
+		s.mu.Unlock()
+
+		s.report(length)
+	}
+}
+
+func durationPercentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func sortedCopy(values []time.Duration) []time.Duration {
+	sorted := append([]time.Duration(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// report logs throughput and latency so far. queueLength < 0 means "no sample".
+func (s *receiverStats) report(queueLength int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := time.Since(s.started)
+	processTimes := sortedCopy(s.processTimes)
+	queueTimes := sortedCopy(s.queueTimes)
+
+	log.Printf("Stats: processed=%d failed=%d poisoned=%d throughput=%.2f msg/s",
+		s.processed, s.failed, s.poisoned, float64(s.processed)/elapsed.Seconds())
+	log.Printf("Stats: process time p50=%s p95=%s max=%s, time in queue p50=%s p95=%s",
+		durationPercentile(processTimes, 0.50), durationPercentile(processTimes, 0.95), durationPercentile(processTimes, 1),
+		durationPercentile(queueTimes, 0.50), durationPercentile(queueTimes, 0.95))
+	if queueLength >= 0 {
+		log.Printf("Stats: approximate queue length=%d", queueLength)
+	}
+}
+
+func (s *receiverStats) finalReport() {
+	s.report(-1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queueLengths) > 0 {
+		maxLength := int32(0)
+		for _, l := range s.queueLengths {
+			maxLength = max(maxLength, l)
+		}
+		log.Printf("Stats: queue length samples=%d last=%d max=%d", len(s.queueLengths), s.queueLengths[len(s.queueLengths)-1], maxLength)
+	}
+}
@@ -9,7 +9,11 @@ import {
   Kind,
   SkuName as StorageSkuName,
 } from "@pulumi/azure-native/storage";
-import { Queue } from "@pulumi/azure-native/storage";
+import {
+  BlobContainer,
+  PublicAccess,
+  Queue,
+} from "@pulumi/azure-native/storage";
 
 const tags = {
   project: pulumi.getProject(),
@@ -58,13 +62,42 @@ const storageQueue = new Queue(
   { parent: storageAccount },
 );
 
+// Messages that fail -max-attempts times are moved here by the receiver
+const poisonQueue = new Queue(
+  "PoisonQueue",
+  {
+    resourceGroupName: resourceGroup.name,
+    accountName: storageAccount.name,
+    queueName: pulumi.interpolate`${storageQueue.name}-poison`,
+  },
+  { parent: storageAccount },
+);
+
+// Payloads over the 64 KiB queue limit are stored here (claim-check pattern)
+const claimCheckContainer = new BlobContainer(
+  "ClaimCheckContainer",
+  {
+    resourceGroupName: resourceGroup.name,
+    accountName: storageAccount.name,
+    containerName: "claim-checks",
+    publicAccess: PublicAccess.None,
+  },
+  { parent: storageAccount },
+);
+
 // Built-in role IDs (data-plane)
 // Storage Queue Data Message Sender:   c6a89b2d-59bc-44d0-9896-0f6e12d7b80a
 // Storage Queue Data Message Processor: 8a0f0c08-91a1-4084-bc3d-661d67233fed
 const storageQueueDataMessageSenderRoleDefinitionId = pulumi.interpolate`/subscriptions/${azureClient.subscriptionId}/providers/Microsoft.Authorization/roleDefinitions/c6a89b2d-59bc-44d0-9896-0f6e12d7b80a`;
 const storageQueueDataMessageProcessorRoleDefinitionId = pulumi.interpolate`/subscriptions/${azureClient.subscriptionId}/providers/Microsoft.Authorization/roleDefinitions/8a0f0c08-91a1-4084-bc3d-661d67233fed`;
+// Storage Queue Data Contributor:       974c5e8b-45b9-4653-ba55-5f855dd0fb88
+const storageQueueDataContributorRoleDefinitionId = pulumi.interpolate`/subscriptions/${azureClient.subscriptionId}/providers/Microsoft.Authorization/roleDefinitions/974c5e8b-45b9-4653-ba55-5f855dd0fb88`;
+// Storage Blob Data Contributor:        ba92f5b4-2d11-453d-a403-e96b0029c9fe
+const storageBlobDataContributorRoleDefinitionId = pulumi.interpolate`/subscriptions/${azureClient.subscriptionId}/providers/Microsoft.Authorization/roleDefinitions/ba92f5b4-2d11-453d-a403-e96b0029c9fe`;
 
-// Least privilege: scope to the queue itself
+// Send and receive only need these queue-scoped roles. The same principal also
+// gets Data Contributor on the account below for the admin modes, so for this
+// user they document what each mode needs rather than limit it.
 new RoleAssignment(
   "StorageQueueMessageSenderRoleAssignment",
   {
@@ -87,7 +120,47 @@ new RoleAssignment(
   { parent: storageQueue },
 );
 
+// The receiver only enqueues to the poison queue
+new RoleAssignment(
+  "PoisonQueueMessageSenderRoleAssignment",
+  {
+    principalId: azureClient.objectId,
+    principalType: "User",
+    roleDefinitionId: storageQueueDataMessageSenderRoleDefinitionId,
+    scope: poisonQueue.id,
+  },
+  { parent: poisonQueue },
+);
+
+// Admin modes need account scope: create and delete work on queues that do not
+// exist yet or are gone afterwards, and list enumerates the whole account, so
+// no queue-level scope can grant them
+new RoleAssignment(
+  "StorageQueueDataContributorRoleAssignment",
+  {
+    principalId: azureClient.objectId,
+    principalType: "User",
+    roleDefinitionId: storageQueueDataContributorRoleDefinitionId,
+    scope: storageAccount.id,
+  },
+  { parent: storageAccount },
+);
+
+new RoleAssignment(
+  "ClaimCheckBlobDataContributorRoleAssignment",
+  {
+    principalId: azureClient.objectId,
+    principalType: "User",
+    roleDefinitionId: storageBlobDataContributorRoleDefinitionId,
+    // Account scope: the app creates the container when it is missing
+    scope: storageAccount.id,
+  },
+  { parent: claimCheckContainer },
+);
+
 // Outputs for the upcoming Go app
 export const storageQueueServiceUrl = pulumi.interpolate`https://${storageAccount.name}.queue.core.windows.net`;
 export const storageQueueName = storageQueue.name;
+export const poisonQueueName = poisonQueue.name;
+export const claimCheckContainerName = claimCheckContainer.name;
 export const resourceGroupName = resourceGroup.name;
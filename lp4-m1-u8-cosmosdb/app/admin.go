@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// ProvisionOptions holds the settings used by the create-db and
+// create-container modes.
+type ProvisionOptions struct {
+	Throughput         int
+	Autoscale          bool
+	PartitionKeyPath   string
+	IndexingPolicyFile string
+	DefaultTTL         int
+	UniqueKeys         []string
+}
+
+// uniqueKeys collects repeated -unique-key flags; each flag is one unique key
+// made of comma-separated paths, e.g. -unique-key /name,/category
+type uniqueKeys []string
+
+func (u *uniqueKeys) String() string {
+	return strings.Join(*u, " ")
+}
+
+func (u *uniqueKeys) Set(value string) error {
+	*u = append(*u, value)
+	return nil
+}
+
+// throughputProperties returns nil when no dedicated throughput was requested,
+// which creates a serverless or shared-throughput resource.
+func (o ProvisionOptions) throughputProperties() *azcosmos.ThroughputProperties {
+	if o.Throughput <= 0 {
+		return nil
+	}
+
+	var tp azcosmos.ThroughputProperties
+	if o.Autoscale {
+		// With autoscale the value is the max RU/s, the floor is 10% of it
+		tp = azcosmos.NewAutoscaleThroughputProperties(int32(o.Throughput))
+	} else {
+		tp = azcosmos.NewManualThroughputProperties(int32(o.Throughput))
+	}
+	return &tp
+}
+
+func isNotFound(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
+
+func createDatabase(ctx context.Context, client *azcosmos.Client, dbName string, options ProvisionOptions) error {
+	resp, err := client.CreateDatabase(ctx, azcosmos.DatabaseProperties{ID: dbName}, &azcosmos.CreateDatabaseOptions{
+		ThroughputProperties: options.throughputProperties(),
+	})
+	if err != nil {
+		return fmt.Errorf("create database %s: %w", dbName, err)
+	}
+
+	fmt.Printf("Created database %s\n", dbName)
+	fmt.Printf("RU charge: %.2f\n", resp.RequestCharge)
+	return nil
+}
+
+func deleteDatabase(ctx context.Context, client *azcosmos.Client, dbName string) error {
+	database, err := client.NewDatabase(dbName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := database.Delete(ctx, nil); err != nil {
+		return fmt.Errorf("delete database %s: %w", dbName, err)
+	}
+
+	fmt.Printf("Deleted database %s (and all its containers)\n", dbName)
+	return nil
+}
+
+func loadIndexingPolicy(path string) (*azcosmos.IndexingPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read indexing policy: %w", err)
+	}
+
+	var policy azcosmos.IndexingPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("parse indexing policy: %w", err)
+	}
+	return &policy, nil
+}
+
+func createContainer(ctx context.Context, client *azcosmos.Client, dbName string, containerName string, options ProvisionOptions) error {
+	database, err := client.NewDatabase(dbName)
+	if err != nil {
+		return err
+	}
+
+	properties := azcosmos.ContainerProperties{
+		ID: containerName,
+		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
+			Paths: []string{options.PartitionKeyPath},
+		},
+	}
+
+	if options.IndexingPolicyFile != "" {
+		properties.IndexingPolicy, err = loadIndexingPolicy(options.IndexingPolicyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 0 leaves TTL off, -1 turns it on without expiring items by default
+	if options.DefaultTTL != 0 {
+		ttl := int32(options.DefaultTTL)
+		properties.DefaultTimeToLive = &ttl
+	}
+
+	if len(options.UniqueKeys) > 0 {
+		policy := &azcosmos.UniqueKeyPolicy{}
+		for _, key := range options.UniqueKeys {
+			policy.UniqueKeys = append(policy.UniqueKeys, azcosmos.UniqueKey{Paths: strings.Split(key, ",")})
+		}
+		properties.UniqueKeyPolicy = policy
+	}
+
+	resp, err := database.CreateContainer(ctx, properties, &azcosmos.CreateContainerOptions{
+		ThroughputProperties: options.throughputProperties(),
+	})
+	if err != nil {
+		return fmt.Errorf("create container %s/%s: %w", dbName, containerName, err)
+	}
+
+	fmt.Printf("Created container %s/%s\n", dbName, containerName)
+	fmt.Printf("RU charge: %.2f\n", resp.RequestCharge)
+	return nil
+}
+
+func deleteContainer(ctx context.Context, client *azcosmos.Client, dbName string, containerName string) error {
+	container, err := client.NewContainer(dbName, containerName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := container.Delete(ctx, nil); err != nil {
+		return fmt.Errorf("delete container %s/%s: %w", dbName, containerName, err)
+	}
+
+	fmt.Printf("Deleted container %s/%s\n", dbName, containerName)
+	return nil
+}
+
+func printThroughput(scope string, tp *azcosmos.ThroughputProperties, resp azcosmos.ThroughputResponse) {
+	if manual, ok := tp.ManualThroughput(); ok {
+		fmt.Printf("Throughput (%s): manual %d RU/s\n", scope, manual)
+	}
+	if maxRU, ok := tp.AutoscaleMaxThroughput(); ok {
+		fmt.Printf("Throughput (%s): autoscale max %d RU/s (min %d RU/s)\n", scope, maxRU, maxRU/10)
+	}
+	if resp.MinThroughput != nil {
+		fmt.Printf("Minimum allowed throughput: %d RU/s\n", *resp.MinThroughput)
+	}
+	if resp.IsReplacePending {
+		fmt.Println("A throughput change is still being applied")
+	}
+}
+
+// describeContainer prints the offer, partition key definition and policies of
+// a container. Throughput may be provisioned on the container itself or shared
+// from the database, so both are checked.
+func describeContainer(ctx context.Context, client *azcosmos.Client, dbName string, containerName string) error {
+	container, err := client.NewContainer(dbName, containerName)
+	if err != nil {
+		return err
+	}
+
+	resp, err := container.Read(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("read container %s/%s: %w", dbName, containerName, err)
+	}
+	properties := resp.ContainerProperties
+
+	fmt.Printf("Container: %s/%s\n", dbName, properties.ID)
+	fmt.Printf("Last modified: %s\n", properties.LastModified.UTC().Format("2006-01-02T15:04:05Z"))
+	fmt.Printf("Partition key: %s (%s, version %d)\n",
+		strings.Join(properties.PartitionKeyDefinition.Paths, ","),
+		properties.PartitionKeyDefinition.Kind,
+		properties.PartitionKeyDefinition.Version)
+
+	switch {
+	case properties.DefaultTimeToLive == nil:
+		fmt.Println("Default TTL: off")
+	case *properties.DefaultTimeToLive == -1:
+		fmt.Println("Default TTL: on (no default expiry, per-item ttl only)")
+	default:
+		fmt.Printf("Default TTL: %d seconds\n", *properties.DefaultTimeToLive)
+	}
+
+	if properties.UniqueKeyPolicy != nil && len(properties.UniqueKeyPolicy.UniqueKeys) > 0 {
+		for _, key := range properties.UniqueKeyPolicy.UniqueKeys {
+			fmt.Printf("Unique key: %s\n", strings.Join(key.Paths, ","))
+		}
+	} else {
+		fmt.Println("Unique keys: none")
+	}
+
+	if properties.IndexingPolicy != nil {
+		policy, err := json.MarshalIndent(properties.IndexingPolicy, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal indexing policy: %w", err)
+		}
+		fmt.Printf("Indexing policy:\n%s\n", policy)
+	}
+
+	throughput, err := container.ReadThroughput(ctx, nil)
+	if err == nil {
+		printThroughput("container", throughput.ThroughputProperties, throughput)
+		return nil
+	}
+	if !isNotFound(err) {
+		return fmt.Errorf("read container throughput: %w", err)
+	}
+
+	database, err := client.NewDatabase(dbName)
+	if err != nil {
+		return err
+	}
+
+	throughput, err = database.ReadThroughput(ctx, nil)
+	if err != nil {
+		if isNotFound(err) {
+			fmt.Println("Throughput: none provisioned (serverless account)")
+			return nil
+		}
+		return fmt.Errorf("read database throughput: %w", err)
+	}
+	printThroughput("shared from database", throughput.ThroughputProperties, throughput)
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// BatchFile describes a transactional batch on disk. All operations must
+// target the same partition key, e.g.
+//
+//	{
+//	  "partitionKey": "whatever",
+//	  "operations": [
+//	    {"op": "create", "item": {"id": "a", "name": "first"}},
+//	    {"op": "upsert", "item": {"id": "b", "name": "second"}},
+//	    {"op": "replace", "id": "a", "item": {"id": "a", "name": "renamed"}, "ifMatch": "\"...\""},
+//	    {"op": "read", "id": "b"},
+//	    {"op": "delete", "id": "old-item"}
+//	  ]
+//	}
+type BatchFile struct {
+	PartitionKey string           `json:"partitionKey"`
+	Operations   []BatchOperation `json:"operations"`
+}
+
+type BatchOperation struct {
+	Op      string          `json:"op"` // create|upsert|replace|delete|read
+	ID      string          `json:"id,omitempty"`
+	Item    json.RawMessage `json:"item,omitempty"`
+	IfMatch string          `json:"ifMatch,omitempty"`
+}
+
+func loadBatchFile(path string) (*BatchFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read batch file: %w", err)
+	}
+
+	var batchFile BatchFile
+	if err := json.Unmarshal(data, &batchFile); err != nil {
+		return nil, fmt.Errorf("parse batch file: %w", err)
+	}
+
+	if batchFile.PartitionKey == "" {
+		return nil, fmt.Errorf("batch file: partitionKey is required")
+	}
+	if len(batchFile.Operations) == 0 {
+		return nil, fmt.Errorf("batch file: no operations")
+	}
+	// Service limit for a single transactional batch
+	if len(batchFile.Operations) > 100 {
+		return nil, fmt.Errorf("batch file: %d operations exceeds the limit of 100", len(batchFile.Operations))
+	}
+
+	return &batchFile, nil
+}
+
+// withPartitionKey makes sure the document carries the batch partition key so
+// the service does not reject it for targeting a different logical partition.
+func withPartitionKey(item json.RawMessage, partitionKey string) ([]byte, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(item, &doc); err != nil {
+		return nil, fmt.Errorf("item is not a JSON object: %w", err)
+	}
+
+	if _, ok := doc["id"]; !ok {
+		return nil, fmt.Errorf("item is missing an id")
+	}
+
+	if _, ok := doc["mypartitionkey"]; !ok {
+		doc["mypartitionkey"] = partitionKey
+	}
+
+	return json.Marshal(doc)
+}
+
+func buildBatch(container *azcosmos.ContainerClient, batchFile *BatchFile) (azcosmos.TransactionalBatch, error) {
+	batch := container.NewTransactionalBatch(azcosmos.NewPartitionKeyString(batchFile.PartitionKey))
+
+	for i, operation := range batchFile.Operations {
+		var itemOptions *azcosmos.TransactionalBatchItemOptions
+		if operation.IfMatch != "" {
+			itemOptions = &azcosmos.TransactionalBatchItemOptions{IfMatchETag: toETag(operation.IfMatch)}
+		}
+
+		switch operation.Op {
+		case "create", "upsert", "replace":
+			if len(operation.Item) == 0 {
+				return batch, fmt.Errorf("operation #%d (%s): item is required", i, operation.Op)
+			}
+			body, err := withPartitionKey(operation.Item, batchFile.PartitionKey)
+			if err != nil {
+				return batch, fmt.Errorf("operation #%d (%s): %w", i, operation.Op, err)
+			}
+
+			switch operation.Op {
+			case "create":
+				batch.CreateItem(body, nil)
+			case "upsert":
+				batch.UpsertItem(body, itemOptions)
+			case "replace":
+				if operation.ID == "" {
+					return batch, fmt.Errorf("operation #%d (replace): id is required", i)
+				}
+				var item struct {
+					ID any `json:"id"`
+				}
+				if err := json.Unmarshal(body, &item); err != nil {
+					return batch, fmt.Errorf("operation #%d (replace): %w", i, err)
+				}
+				if item.ID != operation.ID {
+					return batch, fmt.Errorf("operation #%d (replace): id %q does not match item id %v", i, operation.ID, item.ID)
+				}
+				batch.ReplaceItem(operation.ID, body, itemOptions)
+			}
+		case "delete":
+			if operation.ID == "" {
+				return batch, fmt.Errorf("operation #%d (delete): id is required", i)
+			}
+			batch.DeleteItem(operation.ID, itemOptions)
+		case "read":
+			if operation.ID == "" {
+				return batch, fmt.Errorf("operation #%d (read): id is required", i)
+			}
+			batch.ReadItem(operation.ID, nil)
+		default:
+			return batch, fmt.Errorf("operation #%d: unknown op %q (create/upsert/replace/delete/read)", i, operation.Op)
+		}
+	}
+
+	return batch, nil
+}
+
+func runBatch(container *azcosmos.ContainerClient, path string) error {
+	batchFile, err := loadBatchFile(path)
+	if err != nil {
+		return err
+	}
+
+	batch, err := buildBatch(container, batchFile)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	resp, err := container.ExecuteTransactionalBatch(context.Background(), batch, nil)
+	elapsed := time.Since(start)
+	if err != nil {
+		return fmt.Errorf("execute batch (pk=%s): %w", batchFile.PartitionKey, err)
+	}
+
+	fmt.Printf("Batch of %d operations on partition %s\n", len(batchFile.Operations), batchFile.PartitionKey)
+	for i, result := range resp.OperationResults {
+		op := "?"
+		if i < len(batchFile.Operations) {
+			op = batchFile.Operations[i].Op
+		}
+		fmt.Printf("- #%d %-7s status=%d RU=%.2f\n", i, op, result.StatusCode, result.RequestCharge)
+		if op == "read" && result.StatusCode == http.StatusOK {
+			fmt.Printf("  body: %s\n", string(result.ResourceBody))
+		}
+	}
+
+	fmt.Printf("Client latency: %d ms\n", elapsed.Milliseconds())
+	if resp.RawResponse != nil {
+		if v := resp.RawResponse.Header.Get("x-ms-server-time-ms"); v != "" {
+			fmt.Printf("Server latency: %s ms\n", v)
+		} else {
+			fmt.Println("Server latency: not provided by service")
+		}
+	}
+	fmt.Printf("Total RU charge: %.2f\n", resp.RequestCharge)
+
+	if resp.Success {
+		fmt.Println("Batch committed: all operations were applied atomically")
+		return nil
+	}
+
+	// The batch runs as a single transaction inside the logical partition. The
+	// first failing operation reports its own status code, every other
+	// operation reports 424 (Failed Dependency) and nothing is persisted.
+	for i, result := range resp.OperationResults {
+		if result.StatusCode != http.StatusFailedDependency && i < len(batchFile.Operations) {
+			return fmt.Errorf("batch rolled back, no operation was applied: operation #%d (%s) failed with status %d", i, batchFile.Operations[i].Op, result.StatusCode)
+		}
+	}
+
+	return fmt.Errorf("batch rolled back, no operation was applied")
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// BenchConfig describes the workload of a bench run. Every document lives in
+// its own logical partition ("bench-<n>"), so the key distribution controls
+// how hot the individual partitions get.
+type BenchConfig struct {
+	Label        string         `json:"label"`
+	Duration     time.Duration  `json:"duration"`
+	Rate         int            `json:"rate"`
+	Workers      int            `json:"workers"`
+	Mix          map[string]int `json:"mix"`
+	DocSize      int            `json:"docSize"`
+	Keys         int            `json:"keys"`
+	Distribution string         `json:"distribution"`
+}
+
+type BenchDocument struct {
+	PK      string `json:"mypartitionkey"`
+	ID      string `json:"id"`
+	Seq     int64  `json:"seq"`
+	Payload string `json:"payload"`
+}
+
+type benchSample struct {
+	op        string
+	latency   time.Duration
+	serverMs  float64
+	ru        float32
+	throttled int
+	err       error
+}
+
+// OpResult is the summary of one operation type in a bench run. Throttled
+// counts 429 responses, including the ones the SDK retried.
+type OpResult struct {
+	Operation   string  `json:"operation"`
+	Count       int     `json:"count"`
+	Errors      int     `json:"errors"`
+	Throttled   int     `json:"throttled"`
+	P50Ms       float64 `json:"p50Ms"`
+	P95Ms       float64 `json:"p95Ms"`
+	P99Ms       float64 `json:"p99Ms"`
+	ServerAvgMs float64 `json:"serverAvgMs"`
+	ServerP99Ms float64 `json:"serverP99Ms"`
+	RUTotal     float64 `json:"ruTotal"`
+	RUPerOp     float64 `json:"ruPerOp"`
+}
+
+type BenchResult struct {
+	Config     BenchConfig `json:"config"`
+	StartedAt  string      `json:"startedAt"`
+	Elapsed    float64     `json:"elapsedSeconds"`
+	Missed     int         `json:"missedTicks"`
+	Throughput float64     `json:"opsPerSecond"`
+	Operations []OpResult  `json:"operations"`
+}
+
+// parseMix parses "read=70,write=20,query=10" into weights.
+func parseMix(value string) (map[string]int, error) {
+	mix := map[string]int{}
+	for _, part := range strings.Split(value, ",") {
+		op, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid mix entry %q (expected op=weight)", part)
+		}
+		if op != "read" && op != "write" && op != "query" {
+			return nil, fmt.Errorf("unknown mix operation %q (read/write/query)", op)
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight for %s: %q", op, weight)
+		}
+		mix[op] = w
+	}
+
+	total := 0
+	for _, w := range mix {
+		total += w
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("mix weights must add up to more than 0")
+	}
+
+	return mix, nil
+}
+
+// pickOp returns an operation according to the mix weights.
+func pickOp(rng *rand.Rand, mix map[string]int) string {
+	total := 0
+	for _, op := range []string{"read", "write", "query"} {
+		total += mix[op]
+	}
+
+	n := rng.IntN(total)
+	for _, op := range []string{"read", "write", "query"} {
+		if n < mix[op] {
+			return op
+		}
+		n -= mix[op]
+	}
+	return "read"
+}
+
+func benchKey(n uint64) string {
+	return "bench-" + strconv.FormatUint(n, 10)
+}
+
+func newBenchDocument(key string, seq int64, size int, rng *rand.Rand) []byte {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = letters[rng.IntN(len(letters))]
+	}
+
+	body, _ := json.Marshal(BenchDocument{PK: key, ID: key, Seq: seq, Payload: string(payload)})
+	return body
+}
+
+func serverTime(resp *http.Response) float64 {
+	if resp == nil {
+		return 0
+	}
+	v, err := strconv.ParseFloat(resp.Header.Get("x-ms-server-time-ms"), 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+type throttleCounterKey struct{}
+
+// throttleCountingPolicy counts 429 responses into the counter of the request
+// context, if any. It runs per retry, so it also sees the throttled attempts
+// the SDK retries on its own and that never reach the caller as an error.
+type throttleCountingPolicy struct{}
+
+func (throttleCountingPolicy) Do(req *policy.Request) (*http.Response, error) {
+	resp, err := req.Next()
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		if counter, ok := req.Raw().Context().Value(throttleCounterKey{}).(*atomic.Int32); ok {
+			counter.Add(1)
+		}
+	}
+	return resp, err
+}
+
+func runBenchOp(ctx context.Context, container *azcosmos.ContainerClient, op string, key string, body []byte) benchSample {
+	sample := benchSample{op: op}
+	pk := azcosmos.NewPartitionKeyString(key)
+
+	throttled := &atomic.Int32{}
+	ctx = context.WithValue(ctx, throttleCounterKey{}, throttled)
+
+	start := time.Now()
+	switch op {
+	case "read":
+		resp, err := container.ReadItem(ctx, pk, key, nil)
+		sample.err = err
+		if err == nil {
+			sample.ru = resp.RequestCharge
+			sample.serverMs = serverTime(resp.RawResponse)
+		}
+	case "write":
+		resp, err := container.UpsertItem(ctx, pk, body, nil)
+		sample.err = err
+		if err == nil {
+			sample.ru = resp.RequestCharge
+			sample.serverMs = serverTime(resp.RawResponse)
+		}
+	case "query":
+		pager := container.NewQueryItemsPager("SELECT * FROM c WHERE c.seq >= 0", pk, nil)
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				sample.err = err
+				break
+			}
+			sample.ru += page.RequestCharge
+			sample.serverMs += serverTime(page.RawResponse)
+		}
+	}
+	// Latency includes the SDK retries of throttled attempts
+	sample.latency = time.Since(start)
+	sample.throttled = int(throttled.Load())
+
+	return sample
+}
+
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * p)
+	return sorted[idx]
+}
+
+func summarize(op string, samples []benchSample) OpResult {
+	result := OpResult{Operation: op}
+
+	var latencies, server []float64
+	for _, s := range samples {
+		result.Count++
+		result.Throttled += s.throttled
+		if s.err != nil {
+			result.Errors++
+			continue
+		}
+		latencies = append(latencies, float64(s.latency.Microseconds())/1000)
+		server = append(server, s.serverMs)
+		result.RUTotal += float64(s.ru)
+	}
+
+	sort.Float64s(latencies)
+	sort.Float64s(server)
+
+	result.P50Ms = percentile(latencies, 0.50)
+	result.P95Ms = percentile(latencies, 0.95)
+	result.P99Ms = percentile(latencies, 0.99)
+	result.ServerP99Ms = percentile(server, 0.99)
+	if n := len(server); n > 0 {
+		var total float64
+		for _, v := range server {
+			total += v
+		}
+		result.ServerAvgMs = total / float64(n)
+		result.RUPerOp = result.RUTotal / float64(n)
+	}
+
+	return result
+}
+
+// seedBench makes sure every key has a document so reads never miss.
+func seedBench(ctx context.Context, container *azcosmos.ContainerClient, cfg BenchConfig, rng *rand.Rand) error {
+	log.Printf("Seeding %d documents of %d bytes...", cfg.Keys, cfg.DocSize)
+	for n := 0; n < cfg.Keys; n++ {
+		key := benchKey(uint64(n))
+		body := newBenchDocument(key, 0, cfg.DocSize, rng)
+		if _, err := container.UpsertItem(ctx, azcosmos.NewPartitionKeyString(key), body, nil); err != nil {
+			return fmt.Errorf("seed %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func runBench(ctx context.Context, container *azcosmos.ContainerClient, cfg BenchConfig, outPrefix string) error {
+	rng := rand.New(rand.NewPCG(uint64(time.Now().UnixNano()), 0))
+
+	if err := seedBench(ctx, container, cfg, rng); err != nil {
+		return err
+	}
+
+	var nextKey func() uint64
+	switch cfg.Distribution {
+	case "uniform":
+		nextKey = func() uint64 { return uint64(rng.IntN(cfg.Keys)) }
+	case "zipf":
+		// s=1.1 concentrates most traffic on a handful of hot partitions
+		zipf := rand.NewZipf(rng, 1.1, 1, uint64(cfg.Keys-1))
+		nextKey = zipf.Uint64
+	default:
+		return fmt.Errorf("unknown key distribution %q (uniform/zipf)", cfg.Distribution)
+	}
+
+	type job struct {
+		op   string
+		key  string
+		body []byte
+	}
+
+	jobs := make(chan job, cfg.Workers)
+	samples := make(chan benchSample, cfg.Workers*2)
+
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				samples <- runBenchOp(ctx, container, j.op, j.key, j.body)
+			}
+		}()
+	}
+
+	collected := map[string][]benchSample{}
+	collectDone := make(chan struct{})
+	go func() {
+		for s := range samples {
+			collected[s.op] = append(collected[s.op], s)
+		}
+		close(collectDone)
+	}()
+
+	log.Printf("Running %s workload at %d ops/s with %d workers for %s...", cfg.Label, cfg.Rate, cfg.Workers, cfg.Duration)
+
+	startedAt := time.Now()
+	deadline := time.After(cfg.Duration)
+	ticker := time.NewTicker(time.Second / time.Duration(cfg.Rate))
+	defer ticker.Stop()
+
+	missed := 0
+	seq := int64(0)
+dispatch:
+	for {
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case <-deadline:
+			break dispatch
+		case <-ticker.C:
+			op := pickOp(rng, cfg.Mix)
+			key := benchKey(nextKey())
+			var body []byte
+			if op == "write" {
+				seq++
+				body = newBenchDocument(key, seq, cfg.DocSize, rng)
+			}
+
+			select {
+			case jobs <- job{op: op, key: key, body: body}:
+			default:
+				// All workers busy: the target rate is not reachable
+				missed++
+			}
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+	close(samples)
+	<-collectDone
+	elapsed := time.Since(startedAt)
+
+	result := BenchResult{
+		Config:    cfg,
+		StartedAt: startedAt.UTC().Format(time.RFC3339),
+		Elapsed:   elapsed.Seconds(),
+		Missed:    missed,
+	}
+
+	total := 0
+	for _, op := range []string{"read", "write", "query"} {
+		if len(collected[op]) == 0 {
+			continue
+		}
+		summary := summarize(op, collected[op])
+		total += summary.Count
+		result.Operations = append(result.Operations, summary)
+	}
+	result.Throughput = float64(total) / elapsed.Seconds()
+
+	printBenchResult(result)
+
+	return writeBenchResult(result, outPrefix)
+}
+
+func printBenchResult(result BenchResult) {
+	fmt.Printf("Bench %q: %.1f ops/s over %.1fs (missed ticks: %d)\n",
+		result.Config.Label, result.Throughput, result.Elapsed, result.Missed)
+	for _, r := range result.Operations {
+		fmt.Printf("- %-5s count=%d errors=%d throttled=%d p50=%.2fms p95=%.2fms p99=%.2fms server(avg)=%.2fms RU/op=%.2f\n",
+			r.Operation, r.Count, r.Errors, r.Throttled, r.P50Ms, r.P95Ms, r.P99Ms, r.ServerAvgMs, r.RUPerOp)
+	}
+}
+
+func writeBenchResult(result BenchResult, outPrefix string) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal result: %w", err)
+	}
+	if err := os.WriteFile(outPrefix+".json", data, 0o644); err != nil {
+		return fmt.Errorf("write json result: %w", err)
+	}
+
+	file, err := os.Create(outPrefix + ".csv")
+	if err != nil {
+		return fmt.Errorf("create csv result: %w", err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	header := []string{"label", "operation", "count", "errors", "throttled", "p50_ms", "p95_ms", "p99_ms", "server_avg_ms", "server_p99_ms", "ru_total", "ru_per_op"}
+	if err := w.Write(header); err != nil {
+		return fmt.Errorf("write csv header: %w", err)
+	}
+
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) }
+	for _, r := range result.Operations {
+		row := []string{
+			result.Config.Label, r.Operation,
+			strconv.Itoa(r.Count), strconv.Itoa(r.Errors), strconv.Itoa(r.Throttled),
+			f(r.P50Ms), f(r.P95Ms), f(r.P99Ms), f(r.ServerAvgMs), f(r.ServerP99Ms), f(r.RUTotal), f(r.RUPerOp),
+		}
+		if err := w.Write(row); err != nil {
+			return fmt.Errorf("write csv row: %w", err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("flush csv: %w", err)
+	}
+
+	fmt.Printf("Results written to %s.json and %s.csv\n", outPrefix, outPrefix)
+	return nil
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs/v2"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// The Go SDK (azcosmos v1.4) has no change feed API yet, so this mode talks to
+// the REST endpoint directly: a GET on the documents feed with the
+// "A-IM: Incremental feed" header, one partition key range (feed range) at a
+// time. The ETag of each response is the continuation token for that range.
+
+const cosmosAPIVersion = "2020-11-05"
+
+// cosmosAADPolicy signs requests with an Entra ID token in the format the
+// Cosmos data plane expects (type=aad&ver=1.0&sig=<token>).
+type cosmosAADPolicy struct {
+	cred   azcore.TokenCredential
+	scopes []string
+
+	mu    sync.Mutex
+	token azcore.AccessToken
+}
+
+func (p *cosmosAADPolicy) Do(req *policy.Request) (*http.Response, error) {
+	p.mu.Lock()
+	if time.Until(p.token.ExpiresOn) < 5*time.Minute {
+		token, err := p.cred.GetToken(req.Raw().Context(), policy.TokenRequestOptions{Scopes: p.scopes})
+		if err != nil {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("get token: %w", err)
+		}
+		p.token = token
+	}
+	token := p.token.Token
+	p.mu.Unlock()
+
+	req.Raw().Header.Set("Authorization", "type=aad&ver=1.0&sig="+token)
+	req.Raw().Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Raw().Header.Set("x-ms-version", cosmosAPIVersion)
+	return req.Next()
+}
+
+type feedRange struct {
+	ID      string   `json:"id"`
+	Min     string   `json:"minInclusive"`
+	Max     string   `json:"maxExclusive"`
+	Parents []string `json:"parents"`
+}
+
+type changeFeedClient struct {
+	pipeline      runtime.Pipeline
+	containerLink string
+}
+
+func newChangeFeedClient(endpoint string, cred azcore.TokenCredential, dbName string, containerName string) *changeFeedClient {
+	account := strings.TrimSuffix(strings.TrimSuffix(endpoint, "/"), ":443")
+	pipeline := runtime.NewPipeline("cosmos-changefeed", "v0.1.0", runtime.PipelineOptions{
+		PerRetry: []policy.Policy{&cosmosAADPolicy{
+			cred:   cred,
+			scopes: []string{account + "/.default"},
+		}},
+	}, nil)
+
+	return &changeFeedClient{
+		pipeline:      pipeline,
+		containerLink: strings.TrimSuffix(endpoint, "/") + "/dbs/" + dbName + "/colls/" + containerName,
+	}
+}
+
+func (c *changeFeedClient) feedRanges(ctx context.Context) ([]feedRange, error) {
+	req, err := runtime.NewRequest(ctx, http.MethodGet, c.containerLink+"/pkranges")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.pipeline.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("list partition key ranges: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if !runtime.HasStatusCode(resp, http.StatusOK) {
+		return nil, fmt.Errorf("list partition key ranges: %w", runtime.NewResponseError(resp))
+	}
+
+	var body struct {
+		PartitionKeyRanges []feedRange `json:"PartitionKeyRanges"`
+	}
+	if err := runtime.UnmarshalAsJSON(resp, &body); err != nil {
+		return nil, fmt.Errorf("decode partition key ranges: %w", err)
+	}
+
+	return body.PartitionKeyRanges, nil
+}
+
+type changeFeedPage struct {
+	Documents     []json.RawMessage
+	Continuation  string
+	RequestCharge string
+	NotModified   bool
+}
+
+// errFeedRangeGone is returned when a partition split retired the feed range.
+var errFeedRangeGone = errors.New("feed range is gone (partition split)")
+
+// readChanges fetches the next page of changes for one feed range. Without a
+// continuation, startFrom decides where the feed begins: the zero time means
+// "from the beginning", and a nil pointer means "from now".
+func (c *changeFeedClient) readChanges(ctx context.Context, rangeID string, continuation string, startFrom *time.Time, maxItems int) (changeFeedPage, error) {
+	req, err := runtime.NewRequest(ctx, http.MethodGet, c.containerLink+"/docs")
+	if err != nil {
+		return changeFeedPage{}, err
+	}
+
+	h := req.Raw().Header
+	h.Set("A-IM", "Incremental feed")
+	h.Set("x-ms-documentdb-partitionkeyrangeid", rangeID)
+	h.Set("x-ms-max-item-count", fmt.Sprint(maxItems))
+
+	switch {
+	case continuation != "":
+		h.Set("If-None-Match", continuation)
+	case startFrom == nil:
+		h.Set("If-None-Match", "*")
+	case !startFrom.IsZero():
+		h.Set("If-Modified-Since", startFrom.UTC().Format(http.TimeFormat))
+	}
+
+	resp, err := c.pipeline.Do(req)
+	if err != nil {
+		return changeFeedPage{}, fmt.Errorf("read change feed (range=%s): %w", rangeID, err)
+	}
+	defer resp.Body.Close()
+
+	page := changeFeedPage{
+		Continuation:  resp.Header.Get("ETag"),
+		RequestCharge: resp.Header.Get("x-ms-request-charge"),
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		page.NotModified = true
+		return page, nil
+	case http.StatusGone:
+		return page, errFeedRangeGone
+	case http.StatusOK:
+	default:
+		return page, fmt.Errorf("read change feed (range=%s): %w", rangeID, runtime.NewResponseError(resp))
+	}
+
+	var body struct {
+		Documents []json.RawMessage `json:"Documents"`
+	}
+	if err := runtime.UnmarshalAsJSON(resp, &body); err != nil {
+		return page, fmt.Errorf("decode change feed (range=%s): %w", rangeID, err)
+	}
+	page.Documents = body.Documents
+
+	return page, nil
+}
+
+// LeaseStore persists the continuation token of every feed range, so a
+// restarted processor resumes where it stopped instead of replaying the feed.
+type LeaseStore interface {
+	Load(ctx context.Context) (map[string]string, error)
+	Save(ctx context.Context, rangeID string, continuation string) error
+}
+
+// fileLeaseStore keeps all continuations in one local JSON file.
+type fileLeaseStore struct {
+	path string
+
+	mu     sync.Mutex
+	leases map[string]string
+}
+
+func newFileLeaseStore(path string) *fileLeaseStore {
+	return &fileLeaseStore{path: path, leases: map[string]string{}}
+}
+
+func (s *fileLeaseStore) Load(ctx context.Context) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read lease file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &s.leases); err != nil {
+		return nil, fmt.Errorf("parse lease file: %w", err)
+	}
+	if s.leases == nil {
+		s.leases = map[string]string{}
+	}
+
+	leases := make(map[string]string, len(s.leases))
+	for k, v := range s.leases {
+		leases[k] = v
+	}
+	return leases, nil
+}
+
+func (s *fileLeaseStore) Save(ctx context.Context, rangeID string, continuation string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.leases[rangeID] = continuation
+	data, err := json.MarshalIndent(s.leases, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal leases: %w", err)
+	}
+
+	// Write + rename so a crash never leaves a half-written lease file behind
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("write lease file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("replace lease file: %w", err)
+	}
+
+	return nil
+}
+
+// containerLeaseStore keeps one document per feed range in a Cosmos container
+// partitioned on /id, similar to what the .NET change feed processor does.
+type containerLeaseStore struct {
+	container *azcosmos.ContainerClient
+	prefix    string
+}
+
+type leaseDocument struct {
+	ID           string `json:"id"`
+	Prefix       string `json:"prefix"`
+	RangeID      string `json:"rangeId"`
+	Continuation string `json:"continuation"`
+	UpdatedAt    string `json:"updatedAt"`
+}
+
+func (s *containerLeaseStore) Load(ctx context.Context) (map[string]string, error) {
+	query := "SELECT * FROM c WHERE c.prefix = @prefix"
+	pager := s.container.NewQueryItemsPager(query, azcosmos.NewPartitionKey(), &azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@prefix", Value: s.prefix}},
+	})
+
+	leases := map[string]string{}
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("query leases: %w", err)
+		}
+
+		for _, b := range page.Items {
+			var lease leaseDocument
+			if err := json.Unmarshal(b, &lease); err != nil {
+				return nil, fmt.Errorf("unmarshal lease: %w", err)
+			}
+			leases[lease.RangeID] = lease.Continuation
+		}
+	}
+
+	return leases, nil
+}
+
+func (s *containerLeaseStore) Save(ctx context.Context, rangeID string, continuation string) error {
+	lease := leaseDocument{
+		ID:           s.prefix + "-" + rangeID,
+		Prefix:       s.prefix,
+		RangeID:      rangeID,
+		Continuation: continuation,
+		UpdatedAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+
+	body, err := json.Marshal(lease)
+	if err != nil {
+		return fmt.Errorf("marshal lease: %w", err)
+	}
+
+	_, err = s.container.UpsertItem(ctx, azcosmos.NewPartitionKeyString(lease.ID), body, nil)
+	if err != nil {
+		return fmt.Errorf("upsert lease %s: %w", lease.ID, err)
+	}
+
+	return nil
+}
+
+// ChangeHandler is called with every non-empty page of changes. The
+// continuation is only saved after it returns nil, so changes are delivered
+// at least once.
+type ChangeHandler func(ctx context.Context, rangeID string, docs []json.RawMessage) error
+
+func logChanges(ctx context.Context, rangeID string, docs []json.RawMessage) error {
+	for _, doc := range docs {
+		var item Item
+		if err := json.Unmarshal(doc, &item); err != nil {
+			return fmt.Errorf("unmarshal change: %w", err)
+		}
+		log.Printf("Change: range=%s id=%s pk=%s name=%s", rangeID, item.ID, item.PK, item.Name)
+	}
+	return nil
+}
+
+// forwardToServiceBus sends every changed document as one Service Bus message.
+func forwardToServiceBus(sender *azservicebus.Sender) ChangeHandler {
+	return func(ctx context.Context, rangeID string, docs []json.RawMessage) error {
+		if err := logChanges(ctx, rangeID, docs); err != nil {
+			return err
+		}
+
+		for _, doc := range docs {
+			message := &azservicebus.Message{
+				Body:                  doc,
+				ContentType:           ptr.To("application/json"),
+				ApplicationProperties: map[string]any{"source": "cosmos-changefeed", "feedRange": rangeID},
+			}
+			if err := sender.SendMessage(ctx, message, nil); err != nil {
+				return fmt.Errorf("send to service bus: %w", err)
+			}
+		}
+		return nil
+	}
+}
+
+// forwardToEventHubs sends each page of changes as event batches.
+func forwardToEventHubs(producer *azeventhubs.ProducerClient) ChangeHandler {
+	return func(ctx context.Context, rangeID string, docs []json.RawMessage) error {
+		if err := logChanges(ctx, rangeID, docs); err != nil {
+			return err
+		}
+
+		batch, err := producer.NewEventDataBatch(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("new batch: %w", err)
+		}
+
+		for _, doc := range docs {
+			event := &azeventhubs.EventData{
+				Body:        doc,
+				ContentType: ptr.To("application/json"),
+				Properties:  map[string]any{"source": "cosmos-changefeed", "feedRange": rangeID},
+			}
+
+			err := batch.AddEventData(event, nil)
+			if errors.Is(err, azeventhubs.ErrEventDataTooLarge) {
+				if batch.NumEvents() == 0 {
+					return fmt.Errorf("change document too large for an event: %w", err)
+				}
+				if err := producer.SendEventDataBatch(ctx, batch, nil); err != nil {
+					return fmt.Errorf("send batch: %w", err)
+				}
+				if batch, err = producer.NewEventDataBatch(ctx, nil); err != nil {
+					return fmt.Errorf("new batch: %w", err)
+				}
+				err = batch.AddEventData(event, nil)
+			}
+			if err != nil {
+				return fmt.Errorf("add event: %w", err)
+			}
+		}
+
+		if batch.NumEvents() > 0 {
+			if err := producer.SendEventDataBatch(ctx, batch, nil); err != nil {
+				return fmt.Errorf("send batch: %w", err)
+			}
+		}
+		return nil
+	}
+}
+
+// parseChangeFeedStart maps the -start flag to readChanges semantics.
+func parseChangeFeedStart(value string) (*time.Time, error) {
+	switch value {
+	case "beginning":
+		return &time.Time{}, nil
+	case "now":
+		return nil, nil
+	default:
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -start %q (beginning|now|RFC3339 time): %w", value, err)
+		}
+		return &t, nil
+	}
+}
+
+func runChangeFeed(
+	ctx context.Context,
+	feed *changeFeedClient,
+	leases LeaseStore,
+	handler ChangeHandler,
+	startFrom *time.Time,
+	pollInterval time.Duration,
+) error {
+	continuations, err := leases.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	ranges, err := feed.feedRanges(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Reading change feed from %d feed range(s), %d with a saved continuation...", len(ranges), len(continuations))
+
+	for {
+		caughtUp := true
+
+		for i := 0; i < len(ranges); i++ {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			r := ranges[i]
+			page, err := feed.readChanges(ctx, r.ID, continuations[r.ID], startFrom, 100)
+			if errors.Is(err, errFeedRangeGone) {
+				// Children of a split range continue from the parent's token
+				log.Printf("Feed range %s was split, refreshing ranges", r.ID)
+				if ranges, err = feed.feedRanges(ctx); err != nil {
+					return err
+				}
+				for _, child := range ranges {
+					if _, ok := continuations[child.ID]; ok {
+						continue
+					}
+					for _, parent := range child.Parents {
+						if token, ok := continuations[parent]; ok {
+							continuations[child.ID] = token
+						}
+					}
+				}
+				caughtUp = false
+				break
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+
+			if page.NotModified {
+				// Remember "now" for ranges that started empty, otherwise a restart
+				// with -start now would skip whatever arrived in between.
+				if continuations[r.ID] == "" && page.Continuation != "" {
+					continuations[r.ID] = page.Continuation
+					if err := leases.Save(ctx, r.ID, page.Continuation); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			log.Printf("Range %s: %d change(s), RU charge: %s", r.ID, len(page.Documents), page.RequestCharge)
+
+			if len(page.Documents) > 0 {
+				if err := handler(ctx, r.ID, page.Documents); err != nil {
+					// Keep the old continuation so the same page is retried
+					log.Printf("handler error on range %s (will retry): %v", r.ID, err)
+					continue
+				}
+			}
+
+			caughtUp = false
+			continuations[r.ID] = page.Continuation
+			if err := leases.Save(ctx, r.ID, page.Continuation); err != nil {
+				return err
+			}
+		}
+
+		if caughtUp {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(pollInterval):
+			}
+		}
+	}
+}
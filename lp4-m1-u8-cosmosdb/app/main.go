@@ -3,31 +3,86 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs/v2"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
 )
 
 type Item struct {
 	PK        string `json:"mypartitionkey,omitempty"`
 	ID        string `json:"id"`
-	Category  string `json:"category"` // partition key
+	Category  string `json:"category"`
 	Name      string `json:"name"`
 	CreatedAt string `json:"createdAt"`
+	Counter   int64  `json:"counter"`
+	TTL       *int32 `json:"ttl,omitempty"` // seconds, -1 = never expires (needs TTL enabled on the container)
+	Timestamp int64  `json:"_ts,omitempty"` // last modified, set by the service
 }
 
-func insertItem(container *azcosmos.ContainerClient) error {
+// patchOps collects repeated -op flags, e.g. -op set:/name=Bob -op incr:/counter=1
+type patchOps []string
+
+func (p *patchOps) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patchOps) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// printItemStats prints the same client/server latency and RU figures for every point operation.
+func printItemStats(resp azcosmos.ItemResponse, elapsed time.Duration) {
+	fmt.Printf("Client latency: %d ms\n", elapsed.Milliseconds())
+
+	if resp.RawResponse != nil {
+		h := resp.RawResponse.Header
+		// Some Cosmos APIs include server-time style headers; if present you can print them:
+		serverLatency := h.Get("x-ms-server-time-ms")
+		if serverLatency != "" {
+			fmt.Printf("Server latency: %s ms\n", serverLatency)
+		} else {
+			fmt.Println("Server latency: not provided by service")
+		}
+	}
+	fmt.Printf("RU charge: %.2f\n", resp.RequestCharge)
+	if resp.SessionToken != nil {
+		fmt.Printf("Session token: %s\n", *resp.SessionToken)
+	}
+}
+
+func printItem(doc Item, etag azcore.ETag) {
+	fmt.Printf("- Item ID: %s, Name: %s, Counter: %d, CreatedAt: %s, ETag: %s\n",
+		doc.ID, doc.Name, doc.Counter, doc.CreatedAt, etag)
+}
+
+func isPreconditionFailed(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusPreconditionFailed
+}
+
+func insertItem(container *azcosmos.ContainerClient, partitionKey string, sessionFile string, ttl int) error {
 	item := Item{
-		PK:        "whatever",
+		PK:        partitionKey,
 		ID:        "item-" + fmt.Sprint(time.Now().Unix()),
 		Category:  "demo",
 		Name:      "Hello Cosmos",
 		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		TTL:       itemTTL(ttl),
 	}
 
 	body, err := json.Marshal(item)
@@ -50,30 +105,276 @@ func insertItem(container *azcosmos.ContainerClient) error {
 	}
 
 	fmt.Printf("Inserted item\n")
-	fmt.Printf("Client latency: %d ms\n", elapsed.Milliseconds())
+	printItemStats(resp, elapsed)
+
+	return saveSessionToken(sessionFile, resp.SessionToken)
+}
+
+func readItem(container *azcosmos.ContainerClient, partitionKey string, itemID string, options *azcosmos.ItemOptions) error {
+	ctx := context.Background()
+	pk := azcosmos.NewPartitionKeyString(partitionKey)
+
+	start := time.Now()
+	resp, err := container.ReadItem(ctx, pk, itemID, options)
+	elapsed := time.Since(start)
+	if err != nil {
+		return fmt.Errorf("read item (id=%s pk=%s): %w", itemID, partitionKey, err)
+	}
+
+	var doc Item
+	if err := json.Unmarshal(resp.Value, &doc); err != nil {
+		return fmt.Errorf("unmarshal item: %w", err)
+	}
+
+	fmt.Printf("Read item\n")
+	printItem(doc, resp.ETag)
+	printItemStats(resp, elapsed)
+
+	return nil
+}
+
+func upsertItem(container *azcosmos.ContainerClient, partitionKey string, itemID string, name string, sessionFile string, ttl int) error {
+	if itemID == "" {
+		itemID = "item-" + fmt.Sprint(time.Now().Unix())
+	}
+
+	item := Item{
+		PK:        partitionKey,
+		ID:        itemID,
+		Category:  "demo",
+		Name:      name,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		TTL:       itemTTL(ttl),
+	}
+
+	body, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("marshal item: %v", err)
+	}
+
+	pk := azcosmos.NewPartitionKeyString(partitionKey)
+
+	start := time.Now()
+	resp, err := container.UpsertItem(context.Background(), pk, body, nil)
+	elapsed := time.Since(start)
+	if err != nil {
+		return fmt.Errorf("upsert item (id=%s pk=%s): %w", itemID, partitionKey, err)
+	}
 
+	// 201 means the item did not exist yet, 200 means it was overwritten
 	if resp.RawResponse != nil {
-		h := resp.RawResponse.Header
-		// Some Cosmos APIs include server-time style headers; if present you can print them:
-		serverLatency := h.Get("x-ms-server-time-ms")
-		if serverLatency != "" {
-			fmt.Printf("Server latency: %s ms\n", serverLatency)
-		} else {
-			fmt.Println("Server latency: not provided by service")
+		fmt.Printf("Upserted item %s (status %d)\n", itemID, resp.RawResponse.StatusCode)
+	} else {
+		fmt.Printf("Upserted item %s\n", itemID)
+	}
+	printItemStats(resp, elapsed)
+
+	return saveSessionToken(sessionFile, resp.SessionToken)
+}
+
+// replaceItem reads the current document, renames it and writes it back.
+// When etag is set the write is conditional (If-Match) and fails with 412 if
+// someone else changed the document in between.
+func replaceItem(container *azcosmos.ContainerClient, partitionKey string, itemID string, name string, etag string) error {
+	ctx := context.Background()
+	pk := azcosmos.NewPartitionKeyString(partitionKey)
+
+	current, err := container.ReadItem(ctx, pk, itemID, nil)
+	if err != nil {
+		return fmt.Errorf("read item (id=%s pk=%s): %w", itemID, partitionKey, err)
+	}
+
+	var doc Item
+	if err := json.Unmarshal(current.Value, &doc); err != nil {
+		return fmt.Errorf("unmarshal item: %w", err)
+	}
+	doc.Name = name
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("marshal item: %v", err)
+	}
+
+	options := &azcosmos.ItemOptions{EnableContentResponseOnWrite: true}
+	if etag != "" {
+		options.IfMatchEtag = toETag(etag)
+	}
+
+	start := time.Now()
+	resp, err := container.ReplaceItem(ctx, pk, itemID, body, options)
+	elapsed := time.Since(start)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			return fmt.Errorf("replace item (id=%s): etag %s is stale (412 precondition failed): %w", itemID, etag, err)
 		}
+		return fmt.Errorf("replace item (id=%s pk=%s): %w", itemID, partitionKey, err)
+	}
+
+	fmt.Printf("Replaced item\n")
+	fmt.Printf("ETag: %s -> %s\n", current.ETag, resp.ETag)
+	printItemStats(resp, elapsed)
+
+	return nil
+}
+
+// parsePatchOps turns "op:/path=value" strings into PatchOperations. Supported
+// ops are set, add, remove (no value) and incr (integer value). Values are
+// decoded as JSON when possible so numbers, booleans and arrays keep their type.
+func parsePatchOps(ops []string) (azcosmos.PatchOperations, error) {
+	var patch azcosmos.PatchOperations
+
+	for _, raw := range ops {
+		op, rest, ok := strings.Cut(raw, ":")
+		if !ok {
+			return patch, fmt.Errorf("invalid patch operation %q (expected op:/path=value)", raw)
+		}
+
+		path, value, hasValue := strings.Cut(rest, "=")
+		if !strings.HasPrefix(path, "/") {
+			return patch, fmt.Errorf("invalid patch path %q (must start with /)", path)
+		}
+		// Only remove goes without a value, "set:/name" must not silently set ""
+		if !hasValue && op != "remove" {
+			return patch, fmt.Errorf("invalid patch operation %q (expected %s:%s=value)", raw, op, path)
+		}
+
+		var decoded any = value
+		if hasValue {
+			if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+				decoded = value
+			}
+		}
+
+		switch op {
+		case "set":
+			patch.AppendSet(path, decoded)
+		case "add":
+			patch.AppendAdd(path, decoded)
+		case "remove":
+			patch.AppendRemove(path)
+		case "incr":
+			delta, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return patch, fmt.Errorf("invalid increment %q: %w", value, err)
+			}
+			patch.AppendIncrement(path, delta)
+		default:
+			return patch, fmt.Errorf("unknown patch op %q (set/add/remove/incr)", op)
+		}
+	}
+
+	return patch, nil
+}
+
+func patchItem(container *azcosmos.ContainerClient, partitionKey string, itemID string, ops []string, etag string) error {
+	if len(ops) == 0 {
+		return fmt.Errorf("at least one -op is required for patch mode")
+	}
+
+	patch, err := parsePatchOps(ops)
+	if err != nil {
+		return err
+	}
+
+	options := &azcosmos.ItemOptions{EnableContentResponseOnWrite: true}
+	if etag != "" {
+		options.IfMatchEtag = toETag(etag)
+	}
+
+	pk := azcosmos.NewPartitionKeyString(partitionKey)
+
+	start := time.Now()
+	resp, err := container.PatchItem(context.Background(), pk, itemID, patch, options)
+	elapsed := time.Since(start)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			return fmt.Errorf("patch item (id=%s): etag %s is stale (412 precondition failed): %w", itemID, etag, err)
+		}
+		return fmt.Errorf("patch item (id=%s pk=%s): %w", itemID, partitionKey, err)
+	}
+
+	var doc Item
+	if err := json.Unmarshal(resp.Value, &doc); err != nil {
+		return fmt.Errorf("unmarshal item: %w", err)
+	}
+
+	fmt.Printf("Patched item (%d operations)\n", len(ops))
+	printItem(doc, resp.ETag)
+	printItemStats(resp, elapsed)
+
+	return nil
+}
+
+// conflictDemo runs two concurrent writers that read the same version of a
+// document and then both patch it with If-Match at the same time. The service
+// applies one write, which changes the ETag, so the other one is rejected
+// with 412 Precondition Failed instead of silently overwriting it.
+func conflictDemo(container *azcosmos.ContainerClient, partitionKey string, itemID string) error {
+	ctx := context.Background()
+	pk := azcosmos.NewPartitionKeyString(partitionKey)
+
+	snapshot, err := container.ReadItem(ctx, pk, itemID, nil)
+	if err != nil {
+		return fmt.Errorf("read item (id=%s pk=%s): %w", itemID, partitionKey, err)
+	}
+	fmt.Printf("Writer A and writer B both read ETag %s\n", snapshot.ETag)
+
+	type writeResult struct {
+		resp    azcosmos.ItemResponse
+		elapsed time.Duration
+		err     error
+	}
+
+	writers := []string{"A", "B"}
+	results := make([]writeResult, len(writers))
+	// Closing start releases both writers at once
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, writer := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var patch azcosmos.PatchOperations
+			patch.AppendSet("/name", "updated by writer "+writer)
+			patch.AppendIncrement("/counter", 1)
+
+			<-start
+			begin := time.Now()
+			resp, err := container.PatchItem(ctx, pk, itemID, patch, &azcosmos.ItemOptions{
+				IfMatchEtag: &snapshot.ETag,
+			})
+			results[i] = writeResult{resp: resp, elapsed: time.Since(begin), err: err}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	for i, writer := range writers {
+		result := results[i]
+		if result.err != nil {
+			if isPreconditionFailed(result.err) {
+				fmt.Printf("Writer %s: 412 Precondition Failed (ETag %s is no longer current)\n", writer, snapshot.ETag)
+				fmt.Printf("Client latency: %d ms\n", result.elapsed.Milliseconds())
+				continue
+			}
+			return fmt.Errorf("patch item as writer %s: %w", writer, result.err)
+		}
+
+		fmt.Printf("Writer %s: patch accepted, new ETag %s\n", writer, result.resp.ETag)
+		printItemStats(result.resp, result.elapsed)
 	}
-	fmt.Printf("RU charge: %.2f\n", resp.RequestCharge)
 
 	return nil
 }
 
-func listItemsByPartition(container *azcosmos.ContainerClient, partitionKey string) error {
+func listItemsByPartition(container *azcosmos.ContainerClient, partitionKey string, options *azcosmos.QueryOptions) error {
 	ctx := context.Background()
 
 	query := "SELECT * FROM c"
 	pk := azcosmos.NewPartitionKeyString(partitionKey)
 
-	pager := container.NewQueryItemsPager(query, pk, nil)
+	pager := container.NewQueryItemsPager(query, pk, options)
 
 	start := time.Now()
 
@@ -161,16 +462,74 @@ func deleteItem(container *azcosmos.ContainerClient, partitionKey string, itemID
 	return nil
 }
 
+func toETag(value string) *azcore.ETag {
+	etag := azcore.ETag(value)
+	return &etag
+}
 
 func main() {
 	endpoint := "https://neovasilicosmosaz204.documents.azure.com:443/"
-	dbName := "mydatabase"
-	containerName := "mycontainer"
 
 	var mode string
+	var dbName string
+	var containerName string
 	var itemID string
-	flag.StringVar(&mode, "mode", "upload", "Specify mode (insert/list/delete)")
-	flag.StringVar(&itemID, "item", "", "Item ID for delete mode")
+	var partitionKey string
+	var name string
+	var etag string
+	var ops patchOps
+	var filePath string
+	var start string
+	var leaseFile string
+	var leaseContainer string
+	var forward string
+	var interval time.Duration
+	var bench BenchConfig
+	var mix string
+	var out string
+	var provision ProvisionOptions
+	var keys uniqueKeys
+	var emulator bool
+	var consistency string
+	var sessionToken string
+	var sessionFile string
+	var rounds int
+	var ttl int
+	flag.StringVar(&mode, "mode", "upload", "Specify mode (insert/list/read/upsert/replace/patch/conflict-demo/batch/changefeed/bench/consistency-demo/set-default-ttl/expire-report/delete/create-db/delete-db/create-container/delete-container/describe)")
+	flag.StringVar(&dbName, "db", "mydatabase", "Database name")
+	flag.StringVar(&containerName, "container", "mycontainer", "Container name")
+	flag.StringVar(&itemID, "item", "", "Item ID for read/upsert/replace/patch/conflict-demo/delete modes")
+	flag.StringVar(&partitionKey, "pk", "whatever", "Partition key value")
+	flag.StringVar(&name, "name", "Hello Cosmos", "Item name for upsert/replace modes")
+	flag.StringVar(&etag, "etag", "", "If-Match ETag for replace/patch modes (optimistic concurrency)")
+	flag.Var(&ops, "op", "Patch operation op:/path=value (set/add/remove/incr), repeatable")
+	flag.StringVar(&filePath, "file", "", "JSON file with the operations for batch mode")
+	flag.StringVar(&start, "start", "beginning", "Change feed start when no lease exists (beginning|now|RFC3339 time)")
+	flag.StringVar(&leaseFile, "lease-file", "changefeed-leases.json", "Local file to persist change feed continuations")
+	flag.StringVar(&leaseContainer, "lease-container", "", "Cosmos container (partitioned on /id) to persist change feed continuations instead of -lease-file")
+	flag.StringVar(&forward, "forward", "", "Forward changes to servicebus|eventhubs (default: only log)")
+	flag.DurationVar(&interval, "interval", 5*time.Second, "Change feed poll interval when caught up")
+	flag.StringVar(&bench.Label, "label", "default", "Bench run label (e.g. indexing policy or consistency level under test)")
+	flag.DurationVar(&bench.Duration, "duration", 30*time.Second, "Bench run duration")
+	flag.IntVar(&bench.Rate, "rate", 20, "Bench target operations per second")
+	flag.IntVar(&bench.Workers, "workers", 8, "Bench concurrent workers")
+	flag.StringVar(&mix, "mix", "read=70,write=20,query=10", "Bench workload mix as op=weight")
+	flag.IntVar(&bench.DocSize, "doc-size", 1024, "Bench document payload size in bytes")
+	flag.IntVar(&bench.Keys, "keys", 100, "Bench number of distinct documents/partition keys")
+	flag.StringVar(&bench.Distribution, "distribution", "uniform", "Bench key distribution (uniform|zipf)")
+	flag.StringVar(&out, "out", "bench-results", "Bench output file prefix (.json and .csv are appended)")
+	flag.IntVar(&provision.Throughput, "throughput", 0, "RU/s for create-db/create-container (0 = shared or serverless)")
+	flag.BoolVar(&provision.Autoscale, "autoscale", false, "Use -throughput as autoscale max RU/s instead of manual RU/s")
+	flag.StringVar(&provision.PartitionKeyPath, "partition-key-path", "/mypartitionkey", "Partition key path for create-container")
+	flag.StringVar(&provision.IndexingPolicyFile, "indexing-policy", "", "JSON file with the indexing policy for create-container")
+	flag.IntVar(&provision.DefaultTTL, "default-ttl", 0, "Default TTL in seconds for create-container/set-default-ttl (0 = off, -1 = on without default expiry)")
+	flag.Var(&keys, "unique-key", "Comma-separated unique key paths for create-container, repeatable")
+	flag.BoolVar(&emulator, "emulator", false, "Use the local Cosmos DB emulator (https://localhost:8081) with its well-known key")
+	flag.StringVar(&consistency, "consistency", "", "Consistency level override for reads, no stronger than the account default (Strong/BoundedStaleness/Session/ConsistentPrefix/Eventual)")
+	flag.StringVar(&sessionToken, "session-token", "", "Session token to replay on read/list")
+	flag.StringVar(&sessionFile, "session-file", "", "File where insert/upsert save the session token and read/list replay it from")
+	flag.IntVar(&rounds, "rounds", 20, "Write/read rounds for consistency-demo mode")
+	flag.IntVar(&ttl, "ttl", 0, "Per-item TTL in seconds for insert/upsert (0 = container default, -1 = never expire)")
 	flag.Parse()
 
 	cred, err := azidentity.NewDefaultAzureCredential(nil)
@@ -178,7 +537,17 @@ func main() {
 		log.Fatal(err)
 	}
 
-	client, err := azcosmos.NewClient(endpoint, cred, nil)
+	client, err := newCosmosClient(endpoint, cred, emulator)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	consistencyLevel, err := parseConsistency(consistency)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	session, err := loadSessionToken(sessionToken, sessionFile)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -188,16 +557,139 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Ctrl+C handling for the long-running modes
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	switch mode {
 	case "insert":
 		fmt.Println("Inserting item...")
-		err = insertItem(container)
+		err = insertItem(container, partitionKey, sessionFile, ttl)
 		if err != nil {
 			log.Fatal(err)
 		}
 	case "list":
 		fmt.Println("Listing items...")
-		err = listItemsByPartition(container, "whatever")
+		err = listItemsByPartition(container, partitionKey, &azcosmos.QueryOptions{
+			ConsistencyLevel: consistencyLevel,
+			SessionToken:     session,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "read":
+		if itemID == "" {
+			log.Fatal("item ID is required for read mode")
+		}
+		err = readItem(container, partitionKey, itemID, &azcosmos.ItemOptions{
+			ConsistencyLevel: consistencyLevel,
+			SessionToken:     session,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "upsert":
+		fmt.Println("Upserting item...")
+		err = upsertItem(container, partitionKey, itemID, name, sessionFile, ttl)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "replace":
+		if itemID == "" {
+			log.Fatal("item ID is required for replace mode")
+		}
+		err = replaceItem(container, partitionKey, itemID, name, etag)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "patch":
+		if itemID == "" {
+			log.Fatal("item ID is required for patch mode")
+		}
+		err = patchItem(container, partitionKey, itemID, ops, etag)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "conflict-demo":
+		if itemID == "" {
+			log.Fatal("item ID is required for conflict-demo mode")
+		}
+		err = conflictDemo(container, partitionKey, itemID)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "batch":
+		if filePath == "" {
+			log.Fatal("file is required for batch mode")
+		}
+		err = runBatch(container, filePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "changefeed":
+		if emulator {
+			log.Fatal("changefeed mode uses AAD auth and is not supported with -emulator")
+		}
+
+		startFrom, err := parseChangeFeedStart(start)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var leases LeaseStore = newFileLeaseStore(leaseFile)
+		if leaseContainer != "" {
+			leaseClient, err := client.NewContainer(dbName, leaseContainer)
+			if err != nil {
+				log.Fatal(err)
+			}
+			leases = &containerLeaseStore{container: leaseClient, prefix: containerName}
+		}
+
+		var handler ChangeHandler = logChanges
+		switch forward {
+		case "":
+		case "servicebus":
+			sbClient, err := azservicebus.NewClient("service-bus-test-sbns.servicebus.windows.net", cred, nil)
+			if err != nil {
+				log.Fatalf("service bus client: %v", err)
+			}
+			defer sbClient.Close(context.Background())
+
+			sender, err := sbClient.NewSender("training-queue", nil)
+			if err != nil {
+				log.Fatalf("new sender: %v", err)
+			}
+			defer sender.Close(context.Background())
+			handler = forwardToServiceBus(sender)
+		case "eventhubs":
+			producer, err := azeventhubs.NewProducerClient("event-hub-test-ehns.servicebus.windows.net", "training-events", cred, nil)
+			if err != nil {
+				log.Fatalf("new producer: %v", err)
+			}
+			defer producer.Close(context.Background())
+			handler = forwardToEventHubs(producer)
+		default:
+			log.Fatalf("unknown forward target: %s", forward)
+		}
+
+		feed := newChangeFeedClient(endpoint, cred, dbName, containerName)
+		err = runChangeFeed(ctx, feed, leases, handler, startFrom, interval)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "bench":
+		if bench.Rate <= 0 || bench.Workers <= 0 || bench.Keys <= 0 {
+			log.Fatal("rate, workers and keys must be positive for bench mode")
+		}
+		// One tick per operation, and ticks cannot be shorter than 1ns
+		if bench.Rate > int(time.Second) {
+			log.Fatalf("rate must be at most %d ops/s for bench mode", int(time.Second))
+		}
+		bench.Mix, err = parseMix(mix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = runBench(ctx, container, bench, out)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -205,7 +697,53 @@ func main() {
 		if itemID == "" {
 			log.Fatal("item ID is required for delete mode")
 		}
-		err = deleteItem(container, "whatever", itemID)
+		err = deleteItem(container, partitionKey, itemID)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "consistency-demo":
+		// A second, independent client plays the role of another app instance
+		readerClient, err := newCosmosClient(endpoint, cred, emulator)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = consistencyDemo(ctx, client, readerClient, dbName, containerName, partitionKey, consistencyLevel, rounds)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "set-default-ttl":
+		err = setDefaultTTL(ctx, container, provision.DefaultTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "expire-report":
+		err = expireReport(ctx, container, partitionKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "create-db":
+		err = createDatabase(ctx, client, dbName, provision)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "delete-db":
+		err = deleteDatabase(ctx, client, dbName)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "create-container":
+		provision.UniqueKeys = keys
+		err = createContainer(ctx, client, dbName, containerName, provision)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "delete-container":
+		err = deleteContainer(ctx, client, dbName, containerName)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "describe":
+		err = describeContainer(ctx, client, dbName, containerName)
 		if err != nil {
 			log.Fatal(err)
 		}
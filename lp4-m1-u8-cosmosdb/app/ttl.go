@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// itemTTL maps the -ttl flag to the document field: 0 leaves it out so the
+// container default applies.
+func itemTTL(seconds int) *int32 {
+	if seconds == 0 {
+		return nil
+	}
+	ttl := int32(seconds)
+	return &ttl
+}
+
+// setDefaultTTL replaces the container default TTL. 0 turns TTL off (per-item
+// ttl values are then ignored), -1 turns it on without a default expiry.
+func setDefaultTTL(ctx context.Context, container *azcosmos.ContainerClient, seconds int) error {
+	resp, err := container.Read(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("read container: %w", err)
+	}
+
+	properties := *resp.ContainerProperties
+	properties.DefaultTimeToLive = itemTTL(seconds)
+
+	replaced, err := container.Replace(ctx, properties, nil)
+	if err != nil {
+		return fmt.Errorf("replace container: %w", err)
+	}
+
+	switch seconds {
+	case 0:
+		fmt.Println("Default TTL: off")
+	case -1:
+		fmt.Println("Default TTL: on (no default expiry, per-item ttl only)")
+	default:
+		fmt.Printf("Default TTL: %d seconds\n", seconds)
+	}
+	fmt.Printf("RU charge: %.2f\n", replaced.RequestCharge)
+
+	return nil
+}
+
+type expiryEntry struct {
+	item      Item
+	effective *int32 // nil = never expires
+	remaining time.Duration
+}
+
+// effectiveTTL applies the service rules: without a container default TTL
+// nothing expires, an item ttl overrides the default, and -1 never expires.
+func effectiveTTL(containerTTL *int32, itemTTL *int32) *int32 {
+	if containerTTL == nil {
+		return nil
+	}
+
+	ttl := containerTTL
+	if itemTTL != nil {
+		ttl = itemTTL
+	}
+	if *ttl == -1 {
+		return nil
+	}
+	return ttl
+}
+
+// expireReport lists documents with their remaining lifetime computed from
+// _ts (last write) plus the effective TTL. Expired documents may still show
+// up until the background TTL deletion catches up, but they are no longer
+// returned by reads once their lifetime is over.
+func expireReport(ctx context.Context, container *azcosmos.ContainerClient, partitionKey string) error {
+	resp, err := container.Read(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("read container: %w", err)
+	}
+	containerTTL := resp.ContainerProperties.DefaultTimeToLive
+
+	switch {
+	case containerTTL == nil:
+		fmt.Println("Default TTL: off (no document expires, item ttl is ignored)")
+	case *containerTTL == -1:
+		fmt.Println("Default TTL: on (no default expiry, per-item ttl only)")
+	default:
+		fmt.Printf("Default TTL: %d seconds\n", *containerTTL)
+	}
+
+	// An empty -pk scans every partition (simple projections work cross-partition)
+	pk := azcosmos.NewPartitionKeyString(partitionKey)
+	if partitionKey == "" {
+		pk = azcosmos.NewPartitionKey()
+	}
+
+	query := "SELECT c.id, c.mypartitionkey, c.name, c.ttl, c._ts FROM c"
+	pager := container.NewQueryItemsPager(query, pk, nil)
+
+	var totalRU float32
+	var entries []expiryEntry
+	now := time.Now()
+
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("query page: %w", err)
+		}
+		totalRU += page.RequestCharge
+
+		for _, b := range page.Items {
+			var doc Item
+			if err := json.Unmarshal(b, &doc); err != nil {
+				return err
+			}
+
+			entry := expiryEntry{item: doc, effective: effectiveTTL(containerTTL, doc.TTL)}
+			if entry.effective != nil {
+				expiresAt := time.Unix(doc.Timestamp, 0).Add(time.Duration(*entry.effective) * time.Second)
+				entry.remaining = expiresAt.Sub(now)
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	// Soonest to expire first, documents that never expire last
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].effective == nil || entries[j].effective == nil {
+			return entries[j].effective == nil && entries[i].effective != nil
+		}
+		return entries[i].remaining < entries[j].remaining
+	})
+
+	expiring := 0
+	for _, entry := range entries {
+		lastWrite := time.Unix(entry.item.Timestamp, 0).UTC().Format(time.RFC3339)
+		if entry.effective == nil {
+			fmt.Printf("- Item ID: %s, PK: %s, LastWrite: %s, never expires\n", entry.item.ID, entry.item.PK, lastWrite)
+			continue
+		}
+
+		expiring++
+		remaining := entry.remaining.Truncate(time.Second).String()
+		if entry.remaining <= 0 {
+			remaining = "expired (pending deletion)"
+		}
+		fmt.Printf("- Item ID: %s, PK: %s, LastWrite: %s, TTL: %ds, Remaining: %s\n",
+			entry.item.ID, entry.item.PK, lastWrite, *entry.effective, remaining)
+	}
+
+	fmt.Printf("Items: %d (%d expiring)\n", len(entries), expiring)
+	fmt.Printf("Total RU charge: %.2f\n", totalRU)
+
+	return nil
+}
@@ -2,35 +2,63 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"os"
 	"os/signal"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs/v2"
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs/v2/checkpoints"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+
+	"github.com/neovasili/training-az-204/pkg/loadgen"
 )
 
 func main() {
 	var (
 		mode          = flag.String("mode", "", "send|process")
-		consumerGroup = flag.String("consumer-group", "training-cg", "Event Hubs consumer group")
-		interval      = flag.Duration("interval", 2*time.Second, "send interval (send mode) or log tick (process mode)")
+		consumerGroup = flag.String("consumer-group", "training-cg", "Event Hubs consumer group (process mode, send mode with -verify-keys)")
+		interval      = flag.Duration("interval", 2*time.Second, "wait between batches of each sender, 0 = as fast as possible (send mode)")
 		count         = flag.Int("count", 0, "number of events to send (0 = forever)")
+
+		// Send mode
+		concurrency     = flag.Int("concurrency", 1, "concurrent senders sharing the producer (send mode)")
+		batchSize       = flag.Int("batch-size", 0, "events per batch, 0 = fill every batch up to its size limit (send mode)")
+		maxBatchBytes   = flag.Uint64("max-batch-bytes", 0, "batch size limit in bytes, 0 = the limit of the event hub (send mode)")
+		payloadSize     = flag.Int("payload-size", 0, "bytes of padding added to every event body (send mode)")
+		partitionKeyExp = flag.String("partition-key", "", `Go template for the partition key, e.g. "device-{{mod .Counter 4}}" (send mode)`)
+		partitionID     = flag.String("partition-id", "", "partition to send every event to (send mode)")
+		verifyKeys      = flag.Bool("verify-keys", false, "read the sent events back to show the partitions of every partition key (send mode)")
 	)
+	properties := propertiesFlag{}
+	flag.Var(properties, "property", `event property key=template added to every event, e.g. "sender={{.Sender}}", repeatable (send mode)`)
 	flag.Parse()
 
 	if *mode != "send" && *mode != "process" {
 		log.Fatal(`-mode is required and must be "send" or "process"`)
 	}
+	if *concurrency < 1 || *batchSize < 0 || *payloadSize < 0 {
+		log.Fatal("-concurrency must be at least 1, -batch-size and -payload-size at least 0")
+	}
+
+	var partitionKey *template.Template
+	if *partitionKeyExp != "" {
+		var err error
+		if partitionKey, err = loadgen.NewTemplate("partition key", *partitionKeyExp); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Event Hubs identifiers
 	eventHubNamespaceFQDN := "event-hub-test-ehns.servicebus.windows.net" // ex: <namespace>.servicebus.windows.net
-	eventHubName := "training-events"               // ex: training-events
+	eventHubName := "training-events"                                     // ex: training-events
 
 	// Checkpoint store (required for Processor)
 	storageAccountURL := "https://eventhubtestaz204eh.blob.core.windows.net/" // ex: https://<account>.blob.core.windows.net/
@@ -55,7 +83,20 @@ func main() {
 
 	switch *mode {
 	case "send":
-		if err := runSender(ctx, credential, eventHubNamespaceFQDN, eventHubName, *interval, *count); err != nil {
+		err := runSender(ctx, credential, eventHubNamespaceFQDN, eventHubName, senderOptions{
+			Interval:      *interval,
+			Count:         *count,
+			Concurrency:   *concurrency,
+			BatchSize:     *batchSize,
+			MaxBatchBytes: *maxBatchBytes,
+			PayloadSize:   *payloadSize,
+			PartitionKey:  partitionKey,
+			PartitionID:   *partitionID,
+			Properties:    properties,
+			VerifyKeys:    *verifyKeys,
+			ConsumerGroup: *consumerGroup,
+		})
+		if err != nil {
 			log.Fatalf("send failed: %v", err)
 		}
 	case "process":
@@ -65,54 +106,6 @@ func main() {
 	}
 }
 
-func runSender(
-	ctx context.Context,
-	credential *azidentity.DefaultAzureCredential,
-	eventHubNamespaceFQDN string,
-	eventHubName string,
-	interval time.Duration,
-	count int,
-) error {
-	producerClient, err := azeventhubs.NewProducerClient(eventHubNamespaceFQDN, eventHubName, credential, nil)
-	if err != nil {
-		return fmt.Errorf("new producer: %w", err)
-	}
-	defer producerClient.Close(ctx)
-
-	log.Printf("Sending to %s/%s using AAD...", eventHubNamespaceFQDN, eventHubName)
-
-	sent := 0
-	for {
-		if count > 0 && sent >= count {
-			log.Printf("Done. Sent %d events.", sent)
-			return nil
-		}
-
-		batch, err := producerClient.NewEventDataBatch(ctx, nil)
-		if err != nil {
-			return fmt.Errorf("new batch: %w", err)
-		}
-
-		payload := []byte(fmt.Sprintf(`{"counter":%d,"ts":"%s"}`, sent, time.Now().UTC().Format(time.RFC3339Nano)))
-		if err := batch.AddEventData(&azeventhubs.EventData{Body: payload}, nil); err != nil {
-			return fmt.Errorf("add event: %w", err)
-		}
-
-		if err := producerClient.SendEventDataBatch(ctx, batch, nil); err != nil {
-			return fmt.Errorf("send batch: %w", err)
-		}
-
-		sent++
-		log.Printf("Sent event #%d", sent)
-
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-time.After(interval):
-		}
-	}
-}
-
 func runProcessor(
 	ctx context.Context,
 	credential *azidentity.DefaultAzureCredential,
@@ -126,7 +119,8 @@ func runProcessor(
 	if err != nil {
 		return fmt.Errorf("new consumer: %w", err)
 	}
-	defer consumerClient.Close(ctx)
+	// ctx is already cancelled when the partitions are done
+	defer consumerClient.Close(context.WithoutCancel(ctx))
 
 	containerClient, err := container.NewClient(storageAccountURL+storageContainerName, credential, nil)
 	if err != nil {
@@ -147,55 +141,126 @@ func runProcessor(
 
 	log.Printf("Processing from %s/%s consumerGroup=%s using AAD + blob checkpoints...", eventHubNamespaceFQDN, eventHubName, consumerGroup)
 
-	// Run the processor with event handler
-	dispatchPartitionClients := func() {
+	// Stops the partition goroutines too if the processor fails on its own
+	runCtx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+
+	// The dispatcher is counted too, so no partition can be added after Wait starts
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
 		for {
-			partitionClient := processor.NextPartitionClient(ctx)
+			partitionClient := processor.NextPartitionClient(runCtx)
 			if partitionClient == nil {
-				break
+				return
 			}
 
-			go func(pc *azeventhubs.ProcessorPartitionClient) {
-				defer pc.Close(ctx)
-				for {
-					receiveCtx, receiveCancel := context.WithTimeout(ctx, time.Minute)
-					events, err := pc.ReceiveEvents(receiveCtx, 100, nil)
-					receiveCancel()
-
-					if err != nil && ctx.Err() == nil {
-						log.Printf("receive error: %v", err)
-						continue
-					}
-
-					if len(events) == 0 {
-						continue
-					}
-
-					for _, event := range events {
-						log.Printf("Event: partition=%s sequence=%d body=%s",
-							pc.PartitionID(), event.SequenceNumber, string(event.Body))
-					}
-
-					// checkpoint the last event
-					lastEvent := events[len(events)-1]
-					if err := pc.UpdateCheckpoint(ctx, lastEvent, nil); err != nil {
-						log.Printf("checkpoint error: %v", err)
-					}
-				}
-			}(partitionClient)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				processPartition(runCtx, partitionClient)
+			}()
 		}
+	}()
+
+	// Run blocks until ctx is cancelled or the processor fails
+	err = processor.Run(runCtx)
+	cancelRun()
+
+	log.Println("Waiting for partitions to finish...")
+	wg.Wait()
+
+	if err != nil {
+		return fmt.Errorf("processor run: %w", err)
 	}
+	return nil
+}
+
+const (
+	minReceiveBackoff = time.Second
+	maxReceiveBackoff = 30 * time.Second
+)
 
-	go dispatchPartitionClients()
+// processPartition receives and checkpoints the events of one partition until
+// ctx is cancelled or another processor takes the partition over. Transient
+// receive errors are retried with exponential backoff and jitter. On shutdown
+// the last processed event is checkpointed if that did not happen yet.
+func processPartition(ctx context.Context, pc *azeventhubs.ProcessorPartitionClient) {
+	partitionID := pc.PartitionID()
+	defer pc.Close(context.WithoutCancel(ctx))
 
-	// Run the processor
-	go func() {
-		if err := processor.Run(ctx); err != nil {
-			log.Printf("processor run error: %v", err)
+	log.Printf("Partition %s: claimed", partitionID)
+
+	// Last processed event whose checkpoint has not been stored yet
+	var pending *azeventhubs.ReceivedEventData
+	backoff := minReceiveBackoff
+
+	for {
+		receiveCtx, receiveCancel := context.WithTimeout(ctx, time.Minute)
+		events, err := pc.ReceiveEvents(receiveCtx, 100, nil)
+		receiveCancel()
+
+		// Events can come back together with an error, handle them first
+		for _, event := range events {
+			log.Printf("Event: partition=%s sequence=%d body=%s", partitionID, event.SequenceNumber, string(event.Body))
+			pending = event
+		}
+		if len(events) > 0 {
+			if checkpointErr := pc.UpdateCheckpoint(ctx, pending, nil); checkpointErr != nil {
+				if ctx.Err() == nil {
+					log.Printf("Partition %s: checkpoint error: %v", partitionID, checkpointErr)
+				}
+			} else {
+				pending = nil
+			}
 		}
-	}()
 
-	// Block until context is cancelled
-	<-ctx.Done()
-	return nil
+		if ctx.Err() != nil {
+			finalCheckpoint(ctx, pc, pending)
+			return
+		}
+
+		var ehErr *azeventhubs.Error
+		switch {
+		case err == nil:
+			backoff = minReceiveBackoff
+		case errors.Is(err, context.DeadlineExceeded):
+			// No events within the receive timeout
+		case errors.As(err, &ehErr) && ehErr.Code == azeventhubs.ErrorCodeOwnershipLost:
+			// Another processor owns the partition now; checkpointing here would
+			// move its position, so stop without it
+			log.Printf("Partition %s: ownership lost, stopping", partitionID)
+			return
+		default:
+			wait := time.Duration(rand.Int64N(int64(backoff) + 1))
+			log.Printf("Partition %s: receive error, retrying in %s: %v", partitionID, wait.Round(time.Millisecond), err)
+			backoff = min(backoff*2, maxReceiveBackoff)
+
+			select {
+			case <-ctx.Done():
+				finalCheckpoint(ctx, pc, pending)
+				return
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// finalCheckpoint stores the checkpoint of event, the last processed one, on
+// shutdown, when ctx is already cancelled.
+func finalCheckpoint(ctx context.Context, pc *azeventhubs.ProcessorPartitionClient, event *azeventhubs.ReceivedEventData) {
+	if event == nil {
+		log.Printf("Partition %s: stopped, checkpoint up to date", pc.PartitionID())
+		return
+	}
+
+	checkpointCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+
+	if err := pc.UpdateCheckpoint(checkpointCtx, event, nil); err != nil {
+		log.Printf("Partition %s: final checkpoint at sequence %d failed: %v", pc.PartitionID(), event.SequenceNumber, err)
+		return
+	}
+	log.Printf("Partition %s: stopped, final checkpoint at sequence %d", pc.PartitionID(), event.SequenceNumber)
 }
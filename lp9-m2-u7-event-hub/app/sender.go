@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs/v2"
+
+	"github.com/neovasili/training-az-204/pkg/loadgen"
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// senderOptions controls how runSender builds and sends batches.
+type senderOptions struct {
+	Interval    time.Duration // wait between batches of each sender, 0 = as fast as possible
+	Count       int           // total events, 0 = until Ctrl+C
+	Concurrency int
+	// BatchSize is the number of events per batch; 0 fills every batch up to
+	// its size limit.
+	BatchSize     int
+	MaxBatchBytes uint64 // 0 = the limit of the event hub
+	PayloadSize   int
+	// PartitionKey is rendered per event; events with the same key always land
+	// in the same partition. nil lets the service spread the events.
+	PartitionKey *template.Template
+	PartitionID  string
+	Properties   propertiesFlag
+	// VerifyKeys reads the sent events back with ConsumerGroup to show which
+	// partitions every partition key landed in.
+	VerifyKeys    bool
+	ConsumerGroup string
+}
+
+// eventTemplateData is available to the partition key and property
+// templates, e.g. "device-{{mod .Counter 4}}" or "{{.Sender}}".
+type eventTemplateData struct {
+	Counter int
+	Sender  int
+}
+
+// propertiesFlag collects repeated -property key=template flags. Rendered
+// values that parse as integers, floats or booleans keep that type.
+type propertiesFlag map[string]*template.Template
+
+func (p propertiesFlag) String() string {
+	pairs := make([]string, 0, len(p))
+	for key, tmpl := range p {
+		pairs = append(pairs, key+"="+tmpl.Root.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (p propertiesFlag) Set(value string) error {
+	key, expression, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("property must be key=value, got %q", value)
+	}
+	tmpl, err := loadgen.NewTemplate("property "+key, expression)
+	if err != nil {
+		return err
+	}
+	p[key] = tmpl
+	return nil
+}
+
+func (p propertiesFlag) render(data eventTemplateData) (map[string]any, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	properties := make(map[string]any, len(p))
+	for key, tmpl := range p {
+		raw, err := loadgen.Render(tmpl, data)
+		if err != nil {
+			return nil, err
+		}
+		properties[key] = loadgen.ParseValue(raw)
+	}
+	return properties, nil
+}
+
+// sendStats collects the sent batches of all senders.
+type sendStats struct {
+	mu      sync.Mutex
+	events  int
+	bytes   uint64
+	batches int
+	failed  int
+	byKey   map[string]int
+}
+
+func (s *sendStats) record(key string, events int, bytes uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.failed++
+		return
+	}
+	s.events += events
+	s.bytes += bytes
+	s.batches++
+	if s.byKey == nil {
+		s.byKey = map[string]int{}
+	}
+	s.byKey[key] += events
+}
+
+func (s *sendStats) rates(elapsed time.Duration) (events int, eventsPerSec float64, kibPerSec float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.events, float64(s.events) / elapsed.Seconds(), float64(s.bytes) / 1024 / elapsed.Seconds()
+}
+
+func (s *sendStats) print(elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Printf("Sent %d events in %d batches over %s (%d failed batches)\n", s.events, s.batches, elapsed.Round(time.Millisecond), s.failed)
+	fmt.Printf("Throughput: %.1f events/s, %.1f KiB/s\n", float64(s.events)/elapsed.Seconds(), float64(s.bytes)/1024/elapsed.Seconds())
+	if s.batches > 0 {
+		fmt.Printf("Average batch: %.1f events, %d bytes\n", float64(s.events)/float64(s.batches), s.bytes/uint64(s.batches))
+	}
+
+	if _, unkeyed := s.byKey[""]; len(s.byKey) == 0 || unkeyed {
+		return
+	}
+	keys := make([]string, 0, len(s.byKey))
+	for key := range s.byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Println("Events per partition key:")
+	for _, key := range keys {
+		fmt.Printf("  %s: %d\n", key, s.byKey[key])
+	}
+}
+
+// runSender sends events with Concurrency concurrent senders sharing one
+// producer. Each sender fills batches per partition key, sends them, and
+// waits Interval before the next round. At the end it prints the throughput
+// and how the events spread over the partitions.
+func runSender(
+	ctx context.Context,
+	credential *azidentity.DefaultAzureCredential,
+	eventHubNamespaceFQDN string,
+	eventHubName string,
+	options senderOptions,
+) error {
+	if options.PartitionKey != nil && options.PartitionID != "" {
+		return errors.New("-partition-key and -partition-id are mutually exclusive")
+	}
+	if options.VerifyKeys && options.PartitionKey == nil {
+		return errors.New("-verify-keys requires -partition-key")
+	}
+
+	producerClient, err := azeventhubs.NewProducerClient(eventHubNamespaceFQDN, eventHubName, credential, nil)
+	if err != nil {
+		return fmt.Errorf("new producer: %w", err)
+	}
+	defer producerClient.Close(context.WithoutCancel(ctx))
+
+	hubProperties, err := producerClient.GetEventHubProperties(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("get event hub properties: %w", err)
+	}
+	before, err := partitionPositions(ctx, producerClient, hubProperties.PartitionIDs)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Sending to %s/%s (%d partitions) with %d sender(s) using AAD...", eventHubNamespaceFQDN, eventHubName, len(hubProperties.PartitionIDs), options.Concurrency)
+
+	var claimed atomic.Int64
+	stats := &sendStats{}
+	errs := make(chan error, options.Concurrency)
+
+	start := time.Now()
+	reportCtx, stopReport := context.WithCancel(ctx)
+	go reportProgress(reportCtx, stats, start)
+
+	var wg sync.WaitGroup
+	for s := 0; s < options.Concurrency; s++ {
+		wg.Add(1)
+		go func(senderIndex int) {
+			defer wg.Done()
+			errs <- sendEvents(ctx, producerClient, senderIndex, options, &claimed, stats)
+		}(s)
+	}
+	wg.Wait()
+	stopReport()
+	close(errs)
+
+	stats.print(time.Since(start))
+
+	// Ctrl+C may have cancelled ctx, the statistics are still worth reading
+	statsCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+
+	after, err := partitionPositions(statsCtx, producerClient, hubProperties.PartitionIDs)
+	if err != nil {
+		return errors.Join(append(loadgen.Collect(errs), err)...)
+	}
+	printPartitionDistribution(hubProperties.PartitionIDs, before, after)
+
+	if options.VerifyKeys {
+		if err := verifyKeys(statsCtx, credential, eventHubNamespaceFQDN, eventHubName, options.ConsumerGroup, hubProperties.PartitionIDs, before, after); err != nil {
+			return errors.Join(append(loadgen.Collect(errs), err)...)
+		}
+	}
+	return errors.Join(loadgen.Collect(errs)...)
+}
+
+// reportProgress logs the running throughput every 5 seconds.
+func reportProgress(ctx context.Context, stats *sendStats, start time.Time) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			events, eventsPerSec, kibPerSec := stats.rates(time.Since(start))
+			log.Printf("Progress: %d events, %.1f events/s, %.1f KiB/s", events, eventsPerSec, kibPerSec)
+		}
+	}
+}
+
+// defaultRoundBytes bounds a round without -max-batch-bytes: the batch limit
+// of the Standard tier.
+const defaultRoundBytes = 1024 * 1024
+
+// sendEvents is one sender. Every round it claims events until BatchSize
+// events are claimed or, with BatchSize 0, until a batch is full, then sends
+// the batch of every partition key. A batch only holds one partition key, so
+// with many keys no single batch may fill up: a round also ends once its
+// batches hold a batch worth of bytes or it has lasted Interval.
+func sendEvents(ctx context.Context, producer *azeventhubs.ProducerClient, senderIndex int, options senderOptions, claimed *atomic.Int64, stats *sendStats) error {
+	padding := strings.Repeat("x", options.PayloadSize)
+
+	// next claims the next event; with a total count the senders share it
+	next := func() (event *azeventhubs.EventData, key string, ok bool, err error) {
+		n := int(claimed.Add(1))
+		if options.Count > 0 && n > options.Count {
+			return nil, "", false, nil
+		}
+
+		data := eventTemplateData{Counter: n, Sender: senderIndex}
+		if options.PartitionKey != nil {
+			if key, err = loadgen.Render(options.PartitionKey, data); err != nil {
+				return nil, "", false, err
+			}
+		}
+		properties, err := options.Properties.render(data)
+		if err != nil {
+			return nil, "", false, err
+		}
+
+		body := fmt.Sprintf(`{"counter":%d,"sender":%d,"ts":"%s"`, n, senderIndex, time.Now().UTC().Format(time.RFC3339Nano))
+		if padding != "" {
+			body += fmt.Sprintf(`,"data":"%s"`, padding)
+		}
+		return &azeventhubs.EventData{Body: []byte(body + "}"), Properties: properties}, key, true, nil
+	}
+
+	send := func(key string, batch *azeventhubs.EventDataBatch) {
+		err := producer.SendEventDataBatch(ctx, batch, nil)
+		if err != nil && ctx.Err() != nil {
+			// Ctrl+C mid-send: not a failure of the batch
+			return
+		}
+		stats.record(key, int(batch.NumEvents()), batch.NumBytes(), err)
+		switch {
+		case err != nil:
+			log.Printf("sender %d: send batch: %v", senderIndex, err)
+		case options.Interval > 0:
+			log.Printf("Sent batch: sender=%d key=%q events=%d bytes=%d", senderIndex, key, batch.NumEvents(), batch.NumBytes())
+		}
+	}
+
+	roundBytes := options.MaxBatchBytes
+	if roundBytes == 0 {
+		roundBytes = defaultRoundBytes
+	}
+	// roundOver reports whether the round has claimed enough
+	roundOver := func(claimedInRound int, pendingBytes uint64, roundStart time.Time) bool {
+		if options.BatchSize > 0 && claimedInRound >= options.BatchSize {
+			return true
+		}
+		return pendingBytes >= roundBytes || (options.Interval > 0 && time.Since(roundStart) >= options.Interval)
+	}
+
+	batches := map[string]*azeventhubs.EventDataBatch{}
+	for ctx.Err() == nil {
+		done, full := false, false
+		// Bytes held by the unsent batches of this round
+		pendingBytes := uint64(0)
+		roundStart := time.Now()
+		for claimedInRound := 0; !full && ctx.Err() == nil && !roundOver(claimedInRound, pendingBytes, roundStart); claimedInRound++ {
+			event, key, ok, err := next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				done = true
+				break
+			}
+
+			batch := batches[key]
+			if batch == nil {
+				if batch, err = newBatch(ctx, producer, key, options); err != nil {
+					return err
+				}
+				batches[key] = batch
+			}
+
+			before := batch.NumBytes()
+			err = batch.AddEventData(event, nil)
+			if errors.Is(err, azeventhubs.ErrEventDataTooLarge) && batch.NumEvents() > 0 {
+				// Batch is full, the event goes into the next one of its key
+				send(key, batch)
+				pendingBytes -= before
+				before = 0
+				full = true
+				if batch, err = newBatch(ctx, producer, key, options); err != nil {
+					return err
+				}
+				batches[key] = batch
+				err = batch.AddEventData(event, nil)
+			}
+			if err != nil {
+				return fmt.Errorf("add event (%d bytes): %w", len(event.Body), err)
+			}
+			pendingBytes += batch.NumBytes() - before
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+		for key, batch := range batches {
+			if batch.NumEvents() > 0 {
+				send(key, batch)
+			}
+		}
+		clear(batches)
+
+		if done {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(options.Interval):
+		}
+	}
+
+	unsent := 0
+	for _, batch := range batches {
+		unsent += int(batch.NumEvents())
+	}
+	if unsent > 0 {
+		log.Printf("sender %d: dropped %d unsent event(s) on shutdown", senderIndex, unsent)
+	}
+	return nil
+}
+
+func newBatch(ctx context.Context, producer *azeventhubs.ProducerClient, key string, options senderOptions) (*azeventhubs.EventDataBatch, error) {
+	batchOptions := &azeventhubs.EventDataBatchOptions{MaxBytes: options.MaxBatchBytes}
+	if key != "" {
+		batchOptions.PartitionKey = ptr.To(key)
+	}
+	if options.PartitionID != "" {
+		batchOptions.PartitionID = ptr.To(options.PartitionID)
+	}
+
+	batch, err := producer.NewEventDataBatch(ctx, batchOptions)
+	if err != nil {
+		return nil, fmt.Errorf("new batch: %w", err)
+	}
+	return batch, nil
+}
+
+// partitionPositions returns the last enqueued sequence number of every
+// partition, -1 for a partition that never had an event.
+func partitionPositions(ctx context.Context, producer *azeventhubs.ProducerClient, partitionIDs []string) (map[string]int64, error) {
+	positions := make(map[string]int64, len(partitionIDs))
+	for _, partitionID := range partitionIDs {
+		properties, err := producer.GetPartitionProperties(ctx, partitionID, nil)
+		if err != nil {
+			return nil, fmt.Errorf("get partition %s properties: %w", partitionID, err)
+		}
+		positions[partitionID] = properties.LastEnqueuedSequenceNumber
+	}
+	return positions, nil
+}
+
+// printPartitionDistribution prints how many events every partition received
+// between the two positions. Other producers sending at the same time are
+// counted too.
+func printPartitionDistribution(partitionIDs []string, before map[string]int64, after map[string]int64) {
+	total := int64(0)
+	for _, partitionID := range partitionIDs {
+		total += after[partitionID] - before[partitionID]
+	}
+
+	fmt.Println("Events per partition:")
+	for _, partitionID := range partitionIDs {
+		received := after[partitionID] - before[partitionID]
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(received) / float64(total)
+		}
+		fmt.Printf("  partition %s: %d (%.1f%%) %s\n", partitionID, received, share, strings.Repeat("#", int(share/2)))
+	}
+}
+
+// verifyKeys reads back the events every partition received between the two
+// positions and prints the partitions each partition key landed in. With key
+// affinity every key shows exactly one partition.
+func verifyKeys(
+	ctx context.Context,
+	credential *azidentity.DefaultAzureCredential,
+	eventHubNamespaceFQDN string,
+	eventHubName string,
+	consumerGroup string,
+	partitionIDs []string,
+	before map[string]int64,
+	after map[string]int64,
+) error {
+	consumerClient, err := azeventhubs.NewConsumerClient(eventHubNamespaceFQDN, eventHubName, consumerGroup, credential, nil)
+	if err != nil {
+		return fmt.Errorf("new consumer: %w", err)
+	}
+	defer consumerClient.Close(context.WithoutCancel(ctx))
+
+	// partition key -> partition ID -> events
+	keys := map[string]map[string]int{}
+	for _, partitionID := range partitionIDs {
+		if after[partitionID] <= before[partitionID] {
+			continue
+		}
+
+		if err := readPartitionKeys(ctx, consumerClient, partitionID, before[partitionID], after[partitionID], keys); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(keys))
+	for key := range keys {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	fmt.Println("Partitions per partition key:")
+	broken := 0
+	for _, key := range names {
+		partitions := make([]string, 0, len(keys[key]))
+		for partitionID, events := range keys[key] {
+			partitions = append(partitions, fmt.Sprintf("%s (%d events)", partitionID, events))
+		}
+		sort.Strings(partitions)
+		if key == "" {
+			key = "(no key)"
+		} else if len(partitions) > 1 {
+			broken++
+		}
+		fmt.Printf("  %s -> %s\n", key, strings.Join(partitions, ", "))
+	}
+
+	if broken > 0 {
+		fmt.Printf("Key affinity broken for %d key(s)\n", broken)
+	} else {
+		fmt.Println("Key affinity held: every key landed in a single partition")
+	}
+	return nil
+}
+
+// readPartitionKeys counts the partition keys of the events after sequence
+// number from up to and including to.
+func readPartitionKeys(ctx context.Context, consumerClient *azeventhubs.ConsumerClient, partitionID string, from int64, to int64, keys map[string]map[string]int) error {
+	startPosition := azeventhubs.StartPosition{SequenceNumber: ptr.To(from)}
+	if from < 0 {
+		// The partition had no events before
+		startPosition = azeventhubs.StartPosition{Earliest: ptr.To(true)}
+	}
+
+	partitionClient, err := consumerClient.NewPartitionClient(partitionID, &azeventhubs.PartitionClientOptions{
+		StartPosition: startPosition,
+	})
+	if err != nil {
+		return fmt.Errorf("new partition client %s: %w", partitionID, err)
+	}
+	defer partitionClient.Close(context.WithoutCancel(ctx))
+
+	for last := from; last < to; {
+		receiveCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		events, err := partitionClient.ReceiveEvents(receiveCtx, int(min(to-last, 500)), nil)
+		cancel()
+
+		for _, event := range events {
+			last = event.SequenceNumber
+			if last > to {
+				break
+			}
+			key := ptr.Deref(event.PartitionKey)
+			if keys[key] == nil {
+				keys[key] = map[string]int{}
+			}
+			keys[key][partitionID]++
+		}
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				return fmt.Errorf("partition %s: read back stopped at sequence %d of %d", partitionID, last, to)
+			}
+			return fmt.Errorf("read back partition %s: %w", partitionID, err)
+		}
+	}
+	return nil
+}
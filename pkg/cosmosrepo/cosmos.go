@@ -0,0 +1,189 @@
+package cosmosrepo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// CosmosRepository stores T documents in a Cosmos DB container.
+type CosmosRepository[T any] struct {
+	container *azcosmos.ContainerClient
+	fields    keyFields
+}
+
+var _ Repository[struct{}] = (*CosmosRepository[struct{}])(nil)
+
+// NewCosmos returns a repository for T backed by container. It fails if T has
+// no id or partition key field.
+func NewCosmos[T any](container *azcosmos.ContainerClient) (*CosmosRepository[T], error) {
+	fields, err := newKeyFields[T]()
+	if err != nil {
+		return nil, err
+	}
+	return &CosmosRepository[T]{container: container, fields: fields}, nil
+}
+
+func responseStats(resp azcosmos.Response, elapsed time.Duration) OpStats {
+	stats := OpStats{
+		RequestCharge: resp.RequestCharge,
+		ClientLatency: elapsed,
+		ActivityID:    resp.ActivityID,
+		Pages:         1,
+	}
+
+	if resp.RawResponse != nil {
+		stats.StatusCode = resp.RawResponse.StatusCode
+		if v := resp.RawResponse.Header.Get("x-ms-server-time-ms"); v != "" {
+			if ms, err := strconv.ParseFloat(v, 64); err == nil {
+				stats.ServerLatency = time.Duration(ms * float64(time.Millisecond))
+			}
+		}
+	}
+
+	return stats
+}
+
+// mapError translates service status codes into the package sentinel errors
+// while keeping the original error in the chain.
+func mapError(op string, err error) error {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%s: %w: %w", op, ErrNotFound, err)
+		case http.StatusConflict:
+			return fmt.Errorf("%s: %w: %w", op, ErrConflict, err)
+		}
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+func errorStats(err error, elapsed time.Duration) OpStats {
+	stats := OpStats{ClientLatency: elapsed}
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		stats.StatusCode = respErr.StatusCode
+	}
+	return stats
+}
+
+func (r *CosmosRepository[T]) Get(ctx context.Context, partitionKey string, id string) (T, OpStats, error) {
+	var item T
+
+	start := time.Now()
+	resp, err := r.container.ReadItem(ctx, azcosmos.NewPartitionKeyString(partitionKey), id, nil)
+	elapsed := time.Since(start)
+	if err != nil {
+		return item, errorStats(err, elapsed), mapError("get "+id, err)
+	}
+
+	stats := responseStats(resp.Response, elapsed)
+	if err := json.Unmarshal(resp.Value, &item); err != nil {
+		return item, stats, fmt.Errorf("unmarshal %s: %w", id, err)
+	}
+	return item, stats, nil
+}
+
+func (r *CosmosRepository[T]) Create(ctx context.Context, item T) (OpStats, error) {
+	partitionKey, id := r.fields.keys(item)
+
+	body, err := json.Marshal(item)
+	if err != nil {
+		return OpStats{}, fmt.Errorf("marshal %s: %w", id, err)
+	}
+
+	start := time.Now()
+	resp, err := r.container.CreateItem(ctx, azcosmos.NewPartitionKeyString(partitionKey), body, nil)
+	elapsed := time.Since(start)
+	if err != nil {
+		return errorStats(err, elapsed), mapError("create "+id, err)
+	}
+	return responseStats(resp.Response, elapsed), nil
+}
+
+func (r *CosmosRepository[T]) Upsert(ctx context.Context, item T) (OpStats, error) {
+	partitionKey, id := r.fields.keys(item)
+
+	body, err := json.Marshal(item)
+	if err != nil {
+		return OpStats{}, fmt.Errorf("marshal %s: %w", id, err)
+	}
+
+	start := time.Now()
+	resp, err := r.container.UpsertItem(ctx, azcosmos.NewPartitionKeyString(partitionKey), body, nil)
+	elapsed := time.Since(start)
+	if err != nil {
+		return errorStats(err, elapsed), mapError("upsert "+id, err)
+	}
+	return responseStats(resp.Response, elapsed), nil
+}
+
+func (r *CosmosRepository[T]) Delete(ctx context.Context, partitionKey string, id string) (OpStats, error) {
+	start := time.Now()
+	resp, err := r.container.DeleteItem(ctx, azcosmos.NewPartitionKeyString(partitionKey), id, nil)
+	elapsed := time.Since(start)
+	if err != nil {
+		return errorStats(err, elapsed), mapError("delete "+id, err)
+	}
+	return responseStats(resp.Response, elapsed), nil
+}
+
+func (r *CosmosRepository[T]) Query(ctx context.Context, partitionKey string, query string, params ...azcosmos.QueryParameter) ([]T, OpStats, error) {
+	var stats OpStats
+	var items []T
+
+	for item, err := range r.All(ctx, partitionKey, query, &stats, params...) {
+		if err != nil {
+			return items, stats, err
+		}
+		items = append(items, item)
+	}
+	return items, stats, nil
+}
+
+func (r *CosmosRepository[T]) All(ctx context.Context, partitionKey string, query string, stats *OpStats, params ...azcosmos.QueryParameter) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		pk := azcosmos.NewPartitionKeyString(partitionKey)
+		if partitionKey == "" {
+			pk = azcosmos.NewPartitionKey()
+		}
+
+		pager := r.container.NewQueryItemsPager(query, pk, &azcosmos.QueryOptions{QueryParameters: params})
+		for pager.More() {
+			start := time.Now()
+			page, err := pager.NextPage(ctx)
+			elapsed := time.Since(start)
+			if err != nil {
+				if stats != nil {
+					stats.add(errorStats(err, elapsed))
+				}
+				var zero T
+				yield(zero, mapError("query", err))
+				return
+			}
+			if stats != nil {
+				stats.add(responseStats(page.Response, elapsed))
+			}
+
+			for _, b := range page.Items {
+				var item T
+				if err := json.Unmarshal(b, &item); err != nil {
+					yield(item, fmt.Errorf("unmarshal query result: %w", err))
+					return
+				}
+				if !yield(item, nil) {
+					return
+				}
+			}
+		}
+	}
+}
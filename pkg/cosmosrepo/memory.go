@@ -0,0 +1,177 @@
+package cosmosrepo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// MemoryRepository is an in-memory Repository for unit tests. Items are
+// stored as JSON so callers never share memory with the store, just like with
+// the real service. Stats are always zero except for StatusCode.
+//
+// SQL is not interpreted: Query and All return every item of the partition
+// (or of all partitions for an empty key) ordered by partition key and id,
+// filtered by Filter when set.
+type MemoryRepository[T any] struct {
+	// Filter decides whether item matches query/params. Nil matches everything.
+	Filter func(query string, params []azcosmos.QueryParameter, item T) bool
+
+	fields keyFields
+
+	mu         sync.RWMutex
+	partitions map[string]map[string][]byte
+}
+
+var _ Repository[struct{}] = (*MemoryRepository[struct{}])(nil)
+
+// NewMemory returns an empty in-memory repository for T.
+func NewMemory[T any]() (*MemoryRepository[T], error) {
+	fields, err := newKeyFields[T]()
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryRepository[T]{fields: fields, partitions: map[string]map[string][]byte{}}, nil
+}
+
+func (r *MemoryRepository[T]) Get(ctx context.Context, partitionKey string, id string) (T, OpStats, error) {
+	var item T
+
+	r.mu.RLock()
+	body, ok := r.partitions[partitionKey][id]
+	r.mu.RUnlock()
+	if !ok {
+		return item, OpStats{StatusCode: http.StatusNotFound}, fmt.Errorf("get %s: %w", id, ErrNotFound)
+	}
+
+	if err := json.Unmarshal(body, &item); err != nil {
+		return item, OpStats{}, fmt.Errorf("unmarshal %s: %w", id, err)
+	}
+	return item, OpStats{StatusCode: http.StatusOK}, nil
+}
+
+func (r *MemoryRepository[T]) write(item T, allowReplace bool) (OpStats, error) {
+	partitionKey, id := r.fields.keys(item)
+
+	body, err := json.Marshal(item)
+	if err != nil {
+		return OpStats{}, fmt.Errorf("marshal %s: %w", id, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	partition, ok := r.partitions[partitionKey]
+	if !ok {
+		partition = map[string][]byte{}
+		r.partitions[partitionKey] = partition
+	}
+
+	_, exists := partition[id]
+	if exists && !allowReplace {
+		return OpStats{StatusCode: http.StatusConflict}, fmt.Errorf("create %s: %w", id, ErrConflict)
+	}
+	partition[id] = body
+
+	if exists {
+		return OpStats{StatusCode: http.StatusOK}, nil
+	}
+	return OpStats{StatusCode: http.StatusCreated}, nil
+}
+
+func (r *MemoryRepository[T]) Create(ctx context.Context, item T) (OpStats, error) {
+	return r.write(item, false)
+}
+
+func (r *MemoryRepository[T]) Upsert(ctx context.Context, item T) (OpStats, error) {
+	return r.write(item, true)
+}
+
+func (r *MemoryRepository[T]) Delete(ctx context.Context, partitionKey string, id string) (OpStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.partitions[partitionKey][id]; !ok {
+		return OpStats{StatusCode: http.StatusNotFound}, fmt.Errorf("delete %s: %w", id, ErrNotFound)
+	}
+	delete(r.partitions[partitionKey], id)
+
+	return OpStats{StatusCode: http.StatusNoContent}, nil
+}
+
+func (r *MemoryRepository[T]) Query(ctx context.Context, partitionKey string, query string, params ...azcosmos.QueryParameter) ([]T, OpStats, error) {
+	var stats OpStats
+	var items []T
+
+	for item, err := range r.All(ctx, partitionKey, query, &stats, params...) {
+		if err != nil {
+			return items, stats, err
+		}
+		items = append(items, item)
+	}
+	return items, stats, nil
+}
+
+// snapshot copies the matching documents so iteration does not hold the lock.
+func (r *MemoryRepository[T]) snapshot(partitionKey string) [][]byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var keys []string
+	if partitionKey == "" {
+		for pk := range r.partitions {
+			keys = append(keys, pk)
+		}
+		sort.Strings(keys)
+	} else {
+		keys = []string{partitionKey}
+	}
+
+	var docs [][]byte
+	for _, pk := range keys {
+		ids := make([]string, 0, len(r.partitions[pk]))
+		for id := range r.partitions[pk] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			docs = append(docs, r.partitions[pk][id])
+		}
+	}
+	return docs
+}
+
+func (r *MemoryRepository[T]) All(ctx context.Context, partitionKey string, query string, stats *OpStats, params ...azcosmos.QueryParameter) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		if stats != nil {
+			stats.add(OpStats{Pages: 1, StatusCode: http.StatusOK})
+		}
+
+		for _, body := range r.snapshot(partitionKey) {
+			if err := ctx.Err(); err != nil {
+				var zero T
+				yield(zero, err)
+				return
+			}
+
+			var item T
+			if err := json.Unmarshal(body, &item); err != nil {
+				yield(item, fmt.Errorf("unmarshal query result: %w", err))
+				return
+			}
+			if r.Filter != nil && !r.Filter(query, params, item) {
+				continue
+			}
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package cosmosrepo
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+type order struct {
+	ID       string   `json:"id"`
+	Customer string   `json:"customer" cosmos:"pk"`
+	Total    int      `json:"total"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+func newOrders(t *testing.T, orders ...order) *MemoryRepository[order] {
+	t.Helper()
+
+	repo, err := NewMemory[order]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range orders {
+		if _, err := repo.Create(context.Background(), o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repo
+}
+
+func ids(orders []order) []string {
+	var ids []string
+	for _, o := range orders {
+		ids = append(ids, o.Customer+"/"+o.ID)
+	}
+	return ids
+}
+
+func TestMemoryRepositoryCreateConflict(t *testing.T) {
+	ctx := context.Background()
+	repo := newOrders(t, order{ID: "1", Customer: "alice", Total: 10})
+
+	stats, err := repo.Create(ctx, order{ID: "1", Customer: "alice", Total: 99})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("create of an existing id = %v, want ErrConflict", err)
+	}
+	if stats.StatusCode != http.StatusConflict {
+		t.Errorf("status = %d, want %d", stats.StatusCode, http.StatusConflict)
+	}
+
+	// Ids are unique per partition only
+	if _, err := repo.Create(ctx, order{ID: "1", Customer: "bob"}); err != nil {
+		t.Errorf("create of the same id in another partition: %v", err)
+	}
+
+	got, _, err := repo.Get(ctx, "alice", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Total != 10 {
+		t.Errorf("total = %d after a failed create, want the original 10", got.Total)
+	}
+}
+
+func TestMemoryRepositoryUpsert(t *testing.T) {
+	ctx := context.Background()
+	repo := newOrders(t)
+
+	stats, err := repo.Upsert(ctx, order{ID: "1", Customer: "alice", Total: 10})
+	if err != nil || stats.StatusCode != http.StatusCreated {
+		t.Fatalf("first upsert = %d, %v, want %d", stats.StatusCode, err, http.StatusCreated)
+	}
+	stats, err = repo.Upsert(ctx, order{ID: "1", Customer: "alice", Total: 20})
+	if err != nil || stats.StatusCode != http.StatusOK {
+		t.Fatalf("second upsert = %d, %v, want %d", stats.StatusCode, err, http.StatusOK)
+	}
+
+	got, _, err := repo.Get(ctx, "alice", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Total != 20 {
+		t.Errorf("total = %d, want 20", got.Total)
+	}
+}
+
+func TestMemoryRepositoryNotFound(t *testing.T) {
+	ctx := context.Background()
+	repo := newOrders(t, order{ID: "1", Customer: "alice"})
+
+	if _, stats, err := repo.Get(ctx, "bob", "1"); !errors.Is(err, ErrNotFound) || stats.StatusCode != http.StatusNotFound {
+		t.Errorf("get from another partition = %d, %v, want ErrNotFound", stats.StatusCode, err)
+	}
+	if _, stats, err := repo.Get(ctx, "alice", "2"); !errors.Is(err, ErrNotFound) || stats.StatusCode != http.StatusNotFound {
+		t.Errorf("get of a missing id = %d, %v, want ErrNotFound", stats.StatusCode, err)
+	}
+
+	if _, err := repo.Delete(ctx, "alice", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Delete(ctx, "alice", "1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second delete = %v, want ErrNotFound", err)
+	}
+	if _, _, err := repo.Get(ctx, "alice", "1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("get after delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryRepositoryDoesNotShareMemory(t *testing.T) {
+	ctx := context.Background()
+	item := order{ID: "1", Customer: "alice", Tags: []string{"new"}}
+	repo := newOrders(t, item)
+
+	item.Tags[0] = "changed"
+	got, _, err := repo.Get(ctx, "alice", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Tags[0] != "new" {
+		t.Errorf("stored tags changed with the caller's slice: %v", got.Tags)
+	}
+}
+
+func TestMemoryRepositoryQuery(t *testing.T) {
+	ctx := context.Background()
+	repo := newOrders(t,
+		order{ID: "2", Customer: "bob", Total: 50},
+		order{ID: "2", Customer: "alice", Total: 5},
+		order{ID: "1", Customer: "alice", Total: 30},
+	)
+
+	all, _, err := repo.Query(ctx, "", "SELECT * FROM c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(all), []string{"alice/1", "alice/2", "bob/2"}; !slices.Equal(got, want) {
+		t.Errorf("cross-partition query = %v, want %v", got, want)
+	}
+
+	alice, stats, err := repo.Query(ctx, "alice", "SELECT * FROM c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(alice), []string{"alice/1", "alice/2"}; !slices.Equal(got, want) {
+		t.Errorf("partition query = %v, want %v", got, want)
+	}
+	if stats.Pages != 1 || stats.StatusCode != http.StatusOK {
+		t.Errorf("stats = %+v, want one page with status 200", stats)
+	}
+
+	repo.Filter = func(query string, params []azcosmos.QueryParameter, item order) bool {
+		return item.Total >= params[0].Value.(int)
+	}
+	big, _, err := repo.Query(ctx, "", "SELECT * FROM c WHERE c.total >= @min", azcosmos.QueryParameter{Name: "@min", Value: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(big), []string{"alice/1", "bob/2"}; !slices.Equal(got, want) {
+		t.Errorf("filtered query = %v, want %v", got, want)
+	}
+}
+
+func TestMemoryRepositoryAllStopsEarly(t *testing.T) {
+	repo := newOrders(t, order{ID: "1", Customer: "a"}, order{ID: "2", Customer: "a"}, order{ID: "3", Customer: "a"})
+
+	seen := 0
+	for _, err := range repo.All(context.Background(), "a", "SELECT * FROM c", nil) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen++
+		if seen == 2 {
+			break
+		}
+	}
+	if seen != 2 {
+		t.Errorf("saw %d items, want 2", seen)
+	}
+}
+
+func TestMemoryRepositoryAllCancelled(t *testing.T) {
+	repo := newOrders(t, order{ID: "1", Customer: "a"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, err := range repo.All(ctx, "", "SELECT * FROM c", nil) {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("error = %v, want context.Canceled", err)
+		}
+	}
+}
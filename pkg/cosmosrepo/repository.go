@@ -0,0 +1,133 @@
+// Package cosmosrepo provides a typed repository over azcosmos.ContainerClient
+// and an in-memory implementation of the same interface for offline tests.
+//
+// Documents are plain structs. The partition key field is marked with the
+// `cosmos:"pk"` tag and the id comes from the field tagged `cosmos:"id"` or,
+// if there is none, the field whose JSON name is "id":
+//
+//	type Session struct {
+//		ID     string `json:"id"`
+//		UserID string `json:"userId" cosmos:"pk"`
+//	}
+package cosmosrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+var (
+	// ErrNotFound is returned when the document does not exist.
+	ErrNotFound = errors.New("cosmosrepo: document not found")
+	// ErrConflict is returned by Create when the id already exists in the partition.
+	ErrConflict = errors.New("cosmosrepo: document already exists")
+)
+
+// OpStats holds the diagnostics of one repository call. For queries and
+// iterators the values add up over every page.
+type OpStats struct {
+	RequestCharge float32
+	ClientLatency time.Duration
+	ServerLatency time.Duration
+	Pages         int
+	ActivityID    string
+	StatusCode    int
+}
+
+func (s *OpStats) add(other OpStats) {
+	s.RequestCharge += other.RequestCharge
+	s.ClientLatency += other.ClientLatency
+	s.ServerLatency += other.ServerLatency
+	s.Pages += other.Pages
+	s.ActivityID = other.ActivityID
+	s.StatusCode = other.StatusCode
+}
+
+// Repository is the typed data access interface implemented by
+// CosmosRepository and MemoryRepository.
+type Repository[T any] interface {
+	Get(ctx context.Context, partitionKey string, id string) (T, OpStats, error)
+	Create(ctx context.Context, item T) (OpStats, error)
+	Upsert(ctx context.Context, item T) (OpStats, error)
+	Delete(ctx context.Context, partitionKey string, id string) (OpStats, error)
+	// Query runs a SQL query scoped to one partition key. An empty partition
+	// key runs a cross-partition query.
+	Query(ctx context.Context, partitionKey string, query string, params ...azcosmos.QueryParameter) ([]T, OpStats, error)
+	// All streams query results page by page. stats is updated as pages are
+	// fetched and may be nil.
+	All(ctx context.Context, partitionKey string, query string, stats *OpStats, params ...azcosmos.QueryParameter) iter.Seq2[T, error]
+}
+
+// keyFields locates the id and partition key fields of T.
+type keyFields struct {
+	id []int
+	pk []int
+}
+
+func newKeyFields[T any]() (keyFields, error) {
+	var zero T
+	t := reflect.TypeOf(zero)
+	if t == nil || t.Kind() != reflect.Struct {
+		return keyFields{}, fmt.Errorf("cosmosrepo: %T is not a struct", zero)
+	}
+
+	var fields keyFields
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() || field.Type.Kind() != reflect.String {
+			continue
+		}
+
+		for _, option := range strings.Split(field.Tag.Get("cosmos"), ",") {
+			switch option {
+			case "id":
+				fields.id = field.Index
+			case "pk":
+				fields.pk = field.Index
+			}
+		}
+
+		jsonName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if jsonName == "id" && fields.id == nil {
+			fields.id = field.Index
+		}
+	}
+
+	if fields.id == nil {
+		return keyFields{}, fmt.Errorf("cosmosrepo: %s has no string id field (json:\"id\" or cosmos:\"id\")", t)
+	}
+	if fields.pk == nil {
+		return keyFields{}, fmt.Errorf("cosmosrepo: %s has no string partition key field (cosmos:\"pk\")", t)
+	}
+	// keys reads the fields with FieldByIndex, which panics when an embedded
+	// pointer on the way is nil, so such fields are rejected up front.
+	if viaPointer(t, fields.id) || viaPointer(t, fields.pk) {
+		return keyFields{}, fmt.Errorf("cosmosrepo: %s promotes its id or partition key field through an embedded pointer, embed that struct by value", t)
+	}
+
+	return fields, nil
+}
+
+// viaPointer reports whether the field at index is promoted through an
+// embedded pointer.
+func viaPointer(t reflect.Type, index []int) bool {
+	for _, i := range index[:len(index)-1] {
+		field := t.Field(i)
+		if field.Type.Kind() == reflect.Pointer {
+			return true
+		}
+		t = field.Type
+	}
+	return false
+}
+
+func (f keyFields) keys(item any) (partitionKey string, id string) {
+	v := reflect.ValueOf(item)
+	return v.FieldByIndex(f.pk).String(), v.FieldByIndex(f.id).String()
+}
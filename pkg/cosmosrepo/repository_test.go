@@ -0,0 +1,105 @@
+package cosmosrepo
+
+import (
+	"strings"
+	"testing"
+)
+
+type jsonID struct {
+	ID     string `json:"id"`
+	UserID string `json:"userId" cosmos:"pk"`
+}
+
+type taggedID struct {
+	Key    string `json:"key" cosmos:"id"`
+	Other  string `json:"id"`
+	Tenant string `json:"tenant" cosmos:"pk"`
+}
+
+type sameField struct {
+	ID string `json:"id" cosmos:"id,pk"`
+}
+
+type Base struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant" cosmos:"pk"`
+}
+
+type embedded struct {
+	Base
+	Name string `json:"name"`
+}
+
+type embeddedPointer struct {
+	*Base
+	Name string `json:"name"`
+}
+
+type noPK struct {
+	ID string `json:"id"`
+}
+
+type noID struct {
+	Tenant string `json:"tenant" cosmos:"pk"`
+}
+
+type nonStringPK struct {
+	ID     string `json:"id"`
+	Tenant int    `json:"tenant" cosmos:"pk"`
+}
+
+type unexportedPK struct {
+	ID     string `json:"id"`
+	tenant string `cosmos:"pk"`
+}
+
+func TestNewKeyFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields func() (keyFields, error)
+		item   any
+		wantPK string
+		wantID string
+	}{
+		{"json id", newKeyFields[jsonID], jsonID{ID: "1", UserID: "u"}, "u", "1"},
+		{"cosmos id wins over json id", newKeyFields[taggedID], taggedID{Key: "k", Other: "o", Tenant: "t"}, "t", "k"},
+		{"id is the partition key", newKeyFields[sameField], sameField{ID: "1"}, "1", "1"},
+		{"embedded by value", newKeyFields[embedded], embedded{Base: Base{ID: "1", Tenant: "t"}}, "t", "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := tt.fields()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pk, id := fields.keys(tt.item)
+			if pk != tt.wantPK || id != tt.wantID {
+				t.Errorf("keys = (%q, %q), want (%q, %q)", pk, id, tt.wantPK, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestNewKeyFieldsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  func() (keyFields, error)
+		wantErr string
+	}{
+		{"not a struct", newKeyFields[string], "is not a struct"},
+		{"pointer type", newKeyFields[*jsonID], "is not a struct"},
+		{"no partition key", newKeyFields[noPK], "no string partition key field"},
+		{"no id", newKeyFields[noID], "no string id field"},
+		{"non-string partition key", newKeyFields[nonStringPK], "no string partition key field"},
+		{"unexported partition key", newKeyFields[unexportedPK], "no string partition key field"},
+		{"embedded pointer", newKeyFields[embeddedPointer], "embedded pointer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.fields()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
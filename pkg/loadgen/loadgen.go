@@ -0,0 +1,60 @@
+// Package loadgen has the helpers the lab senders share to generate messages
+// from flags and run several senders at once.
+package loadgen
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"text/template"
+)
+
+// NewTemplate parses a Go template rendered once per generated message. It
+// adds a mod function to spread a counter over a few values, e.g.
+// "device-{{mod .Counter 4}}".
+func NewTemplate(name string, expression string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(template.FuncMap{
+		"mod": func(a, b int) int { return a % b },
+	}).Parse(expression)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s template: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// Render executes tmpl with data and returns the result.
+func Render(tmpl *template.Template, data any) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("render %s template: %w", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+// ParseValue returns raw as an int64, float64 or bool when it parses as one,
+// so properties such as "priority=7" compare as numbers in filters, and raw
+// itself otherwise.
+func ParseValue(raw string) any {
+	if i, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(raw, 64); err == nil {
+		return f
+	}
+	if b, err := strconv.ParseBool(raw); err == nil {
+		return b
+	}
+	return raw
+}
+
+// Collect reads errs until it is closed and returns the non-nil errors, ready
+// for errors.Join.
+func Collect(errs <-chan error) []error {
+	var all []error
+	for err := range errs {
+		if err != nil {
+			all = append(all, err)
+		}
+	}
+	return all
+}
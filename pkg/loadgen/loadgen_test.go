@@ -0,0 +1,60 @@
+package loadgen
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want any
+	}{
+		{"7", int64(7)},
+		{"-3", int64(-3)},
+		{"2.5", 2.5},
+		{"true", true},
+		{"gold", "gold"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := ParseValue(tt.raw); got != tt.want {
+			t.Errorf("ParseValue(%q) = %#v, want %#v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	tmpl, err := NewTemplate("key", "device-{{mod .Counter 4}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Render(tmpl, struct{ Counter int }{Counter: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "device-2" {
+		t.Errorf("rendered %q, want device-2", got)
+	}
+
+	if _, err := Render(tmpl, struct{}{}); err == nil {
+		t.Error("render without a Counter field succeeded, want an error")
+	}
+	if _, err := NewTemplate("key", "{{.Counter"); err == nil {
+		t.Error("parse of an unclosed action succeeded, want an error")
+	}
+}
+
+func TestCollect(t *testing.T) {
+	first, second := errors.New("first"), errors.New("second")
+	errs := make(chan error, 3)
+	errs <- first
+	errs <- nil
+	errs <- second
+	close(errs)
+
+	got := Collect(errs)
+	if len(got) != 2 || got[0] != first || got[1] != second {
+		t.Errorf("Collect = %v, want [first second]", got)
+	}
+}
@@ -0,0 +1,96 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// DemoOptions controls RunDemo.
+type DemoOptions struct {
+	Endpoints Endpoints
+	// Interval and Count pace the sender; Count 0 sends until Ctrl+C.
+	Interval time.Duration
+	Count    int
+	// WorkTime and FailRate shape the demo handler: each message takes
+	// WorkTime and fails with probability FailRate. Bodies containing
+	// "poison" always fail.
+	WorkTime time.Duration
+	FailRate float64
+	// Recorder, when set, records every first delivery before it is handled.
+	Recorder *Recorder
+}
+
+// RunDemo runs the send or receive mode of the lab apps over transport, so
+// the same workload can be compared on Service Bus, Storage queues and Event
+// Hubs. It logs the transport Semantics first and every attempt after.
+func RunDemo(ctx context.Context, mode string, transport string, credential azcore.TokenCredential, options DemoOptions) error {
+	switch mode {
+	case "send":
+		sender, err := OpenSender(ctx, transport, options.Endpoints, credential)
+		if err != nil {
+			return err
+		}
+		defer sender.Close(context.WithoutCancel(ctx))
+		log.Printf("Sending through %s", sender.Semantics())
+
+		runID := time.Now().Unix()
+		sent, err := SendEvery(ctx, sender, options.Interval, options.Count, func(n int) Message {
+			return Message{
+				ID:   fmt.Sprintf("demo-%d-%d", runID, n),
+				Body: fmt.Appendf(nil, `{"counter":%d,"ts":"%s"}`, n, time.Now().UTC().Format(time.RFC3339Nano)),
+			}
+		})
+		log.Printf("Done. Sent %d messages.", sent)
+		return err
+	case "receive":
+		receiver, err := OpenReceiver(ctx, transport, options.Endpoints, credential)
+		if err != nil {
+			return err
+		}
+		defer receiver.Close(context.WithoutCancel(ctx))
+		log.Printf("Receiving through %s", receiver.Semantics())
+
+		handler := DemoHandler(options.WorkTime, options.FailRate)
+		if options.Recorder != nil {
+			handler = RecordingHandler(options.Recorder, transport, handler)
+		}
+
+		return Pump(ctx, receiver, handler, PumpOptions{
+			OnSettled: func(delivery *Delivery, handlerErr error) {
+				if handlerErr != nil {
+					log.Printf("Abandoned: id=%s attempt=%d: %v", delivery.ID, delivery.Attempt, handlerErr)
+				}
+			},
+		})
+	default:
+		return fmt.Errorf("transports only support send and receive modes, not %s", mode)
+	}
+}
+
+// DemoHandler is the demo handler of the lab apps as a Handler.
+func DemoHandler(workTime time.Duration, failRate float64) Handler {
+	return func(ctx context.Context, delivery *Delivery) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(workTime):
+		}
+
+		if strings.Contains(string(delivery.Body), "poison") {
+			return errors.New("message marked as poison")
+		}
+		if rand.Float64() < failRate {
+			return errors.New("simulated handler failure")
+		}
+
+		log.Printf("Processed: id=%s attempt=%d sequence=%d body=%s", delivery.ID, delivery.Attempt, delivery.Sequence, delivery.Body)
+		return nil
+	}
+}
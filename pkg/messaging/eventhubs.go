@@ -0,0 +1,256 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs/v2"
+
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+var eventHubsSemantics = Semantics{
+	Transport:       "eventhubs",
+	OrderedByKey:    true, // the key picks the partition, each partition is ordered
+	Properties:      true,
+	MaxMessageBytes: 1024 * 1024, // Standard tier
+}
+
+// EventHubsSender sends events to an event hub.
+type EventHubsSender struct {
+	producer *azeventhubs.ProducerClient
+}
+
+var _ Sender = (*EventHubsSender)(nil)
+
+// NewEventHubsSender wraps producer. Close closes it.
+func NewEventHubsSender(producer *azeventhubs.ProducerClient) *EventHubsSender {
+	return &EventHubsSender{producer: producer}
+}
+
+func (s *EventHubsSender) Semantics() Semantics {
+	return eventHubsSemantics
+}
+
+// Send batches consecutive messages with the same Key, since a batch goes to
+// a single partition.
+func (s *EventHubsSender) Send(ctx context.Context, messages ...Message) error {
+	var batch *azeventhubs.EventDataBatch
+	var batchKey string
+
+	flush := func() error {
+		if batch == nil || batch.NumEvents() == 0 {
+			return nil
+		}
+		if err := s.producer.SendEventDataBatch(ctx, batch, nil); err != nil {
+			return fmt.Errorf("send event batch: %w", err)
+		}
+		batch = nil
+		return nil
+	}
+	newBatch := func(key string) error {
+		options := &azeventhubs.EventDataBatchOptions{}
+		if key != "" {
+			options.PartitionKey = &key
+		}
+		var err error
+		if batch, err = s.producer.NewEventDataBatch(ctx, options); err != nil {
+			return fmt.Errorf("new event batch: %w", err)
+		}
+		batchKey = key
+		return nil
+	}
+
+	for _, m := range messages {
+		event := &azeventhubs.EventData{Body: m.Body, Properties: m.Properties}
+		if m.ID != "" {
+			event.MessageID = &m.ID
+		}
+
+		if batch == nil || batchKey != m.Key {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := newBatch(m.Key); err != nil {
+				return err
+			}
+		}
+
+		err := batch.AddEventData(event, nil)
+		if errors.Is(err, azeventhubs.ErrEventDataTooLarge) && batch.NumEvents() > 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := newBatch(m.Key); err != nil {
+				return err
+			}
+			err = batch.AddEventData(event, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("add event %s: %w", m.ID, err)
+		}
+	}
+	return flush()
+}
+
+func (s *EventHubsSender) Close(ctx context.Context) error {
+	return s.producer.Close(ctx)
+}
+
+// EventHubsReceiver reads every partition of an event hub, without a
+// checkpoint store. Events are never redelivered: Complete and Abandon only
+// acknowledge them locally and the next receiver starts from StartPosition.
+type EventHubsReceiver struct {
+	consumer   *azeventhubs.ConsumerClient
+	partitions []*azeventhubs.PartitionClient
+
+	events chan *Delivery
+	errs   chan error
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ Receiver = (*EventHubsReceiver)(nil)
+
+// NewEventHubsReceiver starts reading all partitions of the consumer's event
+// hub from start, e.g. Latest to see only new events. Close stops the
+// partition readers and closes consumer.
+func NewEventHubsReceiver(ctx context.Context, consumer *azeventhubs.ConsumerClient, start azeventhubs.StartPosition) (*EventHubsReceiver, error) {
+	properties, err := consumer.GetEventHubProperties(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("get event hub properties: %w", err)
+	}
+
+	readCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	r := &EventHubsReceiver{
+		consumer: consumer,
+		events:   make(chan *Delivery),
+		errs:     make(chan error, len(properties.PartitionIDs)),
+		cancel:   cancel,
+	}
+
+	for _, partitionID := range properties.PartitionIDs {
+		partition, err := consumer.NewPartitionClient(partitionID, &azeventhubs.PartitionClientOptions{StartPosition: start})
+		if err != nil {
+			r.Close(ctx)
+			return nil, fmt.Errorf("new partition client %s: %w", partitionID, err)
+		}
+		r.partitions = append(r.partitions, partition)
+
+		r.wg.Add(1)
+		go r.readPartition(readCtx, partitionID, partition)
+	}
+	return r, nil
+}
+
+// readPartition forwards the events of one partition until ctx is cancelled,
+// backing off after transient errors.
+func (r *EventHubsReceiver) readPartition(ctx context.Context, partitionID string, partition *azeventhubs.PartitionClient) {
+	defer r.wg.Done()
+
+	backoff := time.Second
+	for ctx.Err() == nil {
+		receiveCtx, receiveCancel := context.WithTimeout(ctx, 10*time.Second)
+		events, err := partition.ReceiveEvents(receiveCtx, 100, nil)
+		receiveCancel()
+
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			var ehErr *azeventhubs.Error
+			if errors.As(err, &ehErr) && ehErr.Code == azeventhubs.ErrorCodeOwnershipLost {
+				r.errs <- fmt.Errorf("partition %s: %w", partitionID, err)
+				return
+			}
+
+			log.Printf("receive from partition %s: %v (retrying in %s)", partitionID, err, backoff)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		backoff = time.Second
+
+		for _, event := range events {
+			id := ptr.Deref(event.MessageID)
+			if id == "" {
+				id = fmt.Sprintf("%s/%d", partitionID, event.SequenceNumber)
+			}
+
+			delivery := &Delivery{
+				Message: Message{
+					ID:         id,
+					Body:       event.Body,
+					Properties: event.Properties,
+					Key:        ptr.Deref(event.PartitionKey),
+				},
+				Attempt:    1,
+				Sequence:   event.SequenceNumber,
+				EnqueuedAt: ptr.Deref(event.EnqueuedTime),
+				native:     event,
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case r.events <- delivery:
+			}
+		}
+	}
+}
+
+func (r *EventHubsReceiver) Semantics() Semantics {
+	return eventHubsSemantics
+}
+
+// Receive waits for the next event from any partition and adds whatever else
+// is ready, up to maxMessages.
+func (r *EventHubsReceiver) Receive(ctx context.Context, maxMessages int) ([]*Delivery, error) {
+	var deliveries []*Delivery
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case err := <-r.errs:
+		return nil, err
+	case delivery := <-r.events:
+		deliveries = append(deliveries, delivery)
+	}
+
+	for len(deliveries) < maxMessages {
+		select {
+		case delivery := <-r.events:
+			deliveries = append(deliveries, delivery)
+		default:
+			return deliveries, nil
+		}
+	}
+	return deliveries, nil
+}
+
+// Complete is a no-op: progress is not checkpointed.
+func (r *EventHubsReceiver) Complete(ctx context.Context, delivery *Delivery) error {
+	return nil
+}
+
+// Abandon is a no-op: the event stays in the partition but is not delivered
+// to this receiver again.
+func (r *EventHubsReceiver) Abandon(ctx context.Context, delivery *Delivery) error {
+	return nil
+}
+
+func (r *EventHubsReceiver) Close(ctx context.Context) error {
+	r.cancel()
+	r.wg.Wait()
+
+	var errs []error
+	for _, partition := range r.partitions {
+		errs = append(errs, partition.Close(ctx))
+	}
+	errs = append(errs, r.consumer.Close(ctx))
+	return errors.Join(errs...)
+}
@@ -0,0 +1,225 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryQueue is an in-memory Sender and Receiver with Service Bus-like
+// peek-lock semantics, for unit-testing handlers. Messages are copied on send
+// and receive so callers never share memory with the queue. The zero value is
+// an empty queue whose locks never expire.
+type MemoryQueue struct {
+	// LockDuration returns an unsettled delivery to the queue after this long;
+	// 0 keeps it locked until it is settled.
+	LockDuration time.Duration
+
+	mu       sync.Mutex
+	ready    []*memoryEntry
+	inFlight map[*Delivery]*memoryEntry
+	sequence int64
+	closed   bool
+	// wake is closed and replaced whenever a message becomes ready, which
+	// wakes every waiting Receive
+	wake chan struct{}
+}
+
+// init allocates what the zero value lacks. q.mu must be held.
+func (q *MemoryQueue) init() {
+	if q.inFlight == nil {
+		q.inFlight = map[*Delivery]*memoryEntry{}
+	}
+	if q.wake == nil {
+		q.wake = make(chan struct{})
+	}
+}
+
+type memoryEntry struct {
+	message    Message
+	sequence   int64
+	enqueuedAt time.Time
+	attempts   uint32
+	lockedTill time.Time
+}
+
+var (
+	_ Sender   = (*MemoryQueue)(nil)
+	_ Receiver = (*MemoryQueue)(nil)
+)
+
+// NewMemory returns an empty queue whose locks expire after lockDuration.
+func NewMemory(lockDuration time.Duration) *MemoryQueue {
+	return &MemoryQueue{LockDuration: lockDuration}
+}
+
+func (q *MemoryQueue) Semantics() Semantics {
+	return Semantics{
+		Transport:    "memory",
+		Redelivery:   true,
+		OrderedByKey: true,
+		Properties:   true,
+	}
+}
+
+func (q *MemoryQueue) Send(ctx context.Context, messages ...Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	for _, m := range messages {
+		q.sequence++
+		q.ready = append(q.ready, &memoryEntry{message: copyMessage(m), sequence: q.sequence, enqueuedAt: time.Now()})
+	}
+	q.signal()
+	return nil
+}
+
+// signal wakes every waiting Receive. q.mu must be held.
+func (q *MemoryQueue) signal() {
+	q.init()
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+// Receive locks up to maxMessages ready messages, waiting for one if the
+// queue is empty.
+func (q *MemoryQueue) Receive(ctx context.Context, maxMessages int) ([]*Delivery, error) {
+	if maxMessages <= 0 {
+		return nil, fmt.Errorf("messaging: maxMessages must be positive, got %d", maxMessages)
+	}
+
+	for {
+		deliveries, nextExpiry, wake, err := q.take(maxMessages)
+		if err != nil || len(deliveries) > 0 {
+			return deliveries, err
+		}
+
+		var expiry <-chan time.Time
+		if !nextExpiry.IsZero() {
+			expiry = time.After(time.Until(nextExpiry))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wake:
+		case <-expiry:
+		}
+	}
+}
+
+// take returns the deliveries that are ready now and, if there are none, when
+// the next lock expires and the channel the next signal closes. Both are read
+// under the same lock, so a message sent right after take is never missed.
+func (q *MemoryQueue) take(maxMessages int) ([]*Delivery, time.Time, <-chan struct{}, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, time.Time{}, nil, ErrClosed
+	}
+	q.init()
+
+	// Expired locks put their messages back in front, in sequence order
+	now := time.Now()
+	var expired []*memoryEntry
+	var nextExpiry time.Time
+	for delivery, entry := range q.inFlight {
+		if entry.lockedTill.IsZero() {
+			continue
+		}
+		if !entry.lockedTill.After(now) {
+			delete(q.inFlight, delivery)
+			expired = append(expired, entry)
+		} else if nextExpiry.IsZero() || entry.lockedTill.Before(nextExpiry) {
+			nextExpiry = entry.lockedTill
+		}
+	}
+	if len(expired) > 0 {
+		sort.Slice(expired, func(i, j int) bool { return expired[i].sequence < expired[j].sequence })
+		q.ready = append(expired, q.ready...)
+	}
+
+	n := min(maxMessages, len(q.ready))
+	deliveries := make([]*Delivery, 0, n)
+	for _, entry := range q.ready[:n] {
+		entry.attempts++
+		if q.LockDuration > 0 {
+			entry.lockedTill = now.Add(q.LockDuration)
+		}
+
+		delivery := &Delivery{
+			Message:    copyMessage(entry.message),
+			Attempt:    entry.attempts,
+			Sequence:   entry.sequence,
+			EnqueuedAt: entry.enqueuedAt,
+		}
+		q.inFlight[delivery] = entry
+		deliveries = append(deliveries, delivery)
+	}
+	q.ready = q.ready[n:]
+
+	return deliveries, nextExpiry, q.wake, nil
+}
+
+// settle removes delivery from the in-flight set. It fails with ErrLockLost
+// if the lock expired, even if the message was not received again yet.
+func (q *MemoryQueue) settle(delivery *Delivery) (*memoryEntry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry, ok := q.inFlight[delivery]
+	if !ok || (!entry.lockedTill.IsZero() && !entry.lockedTill.After(time.Now())) {
+		return nil, ErrLockLost
+	}
+	delete(q.inFlight, delivery)
+	return entry, nil
+}
+
+func (q *MemoryQueue) Complete(ctx context.Context, delivery *Delivery) error {
+	_, err := q.settle(delivery)
+	return err
+}
+
+// Abandon puts the message back in front of the queue.
+func (q *MemoryQueue) Abandon(ctx context.Context, delivery *Delivery) error {
+	entry, err := q.settle(delivery)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry.lockedTill = time.Time{}
+	q.ready = append([]*memoryEntry{entry}, q.ready...)
+	q.signal()
+	return nil
+}
+
+// Pending returns the number of messages waiting to be received.
+func (q *MemoryQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.ready)
+}
+
+// InFlight returns the number of received messages not yet settled.
+func (q *MemoryQueue) InFlight() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.inFlight)
+}
+
+// Close makes further calls fail with ErrClosed. Messages are discarded.
+func (q *MemoryQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.signal()
+	return nil
+}
@@ -0,0 +1,310 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, q *MemoryQueue, maxMessages int) []*Delivery {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	deliveries, err := q.Receive(ctx, maxMessages)
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	return deliveries
+}
+
+func send(t *testing.T, q *MemoryQueue, ids ...string) {
+	t.Helper()
+
+	for _, id := range ids {
+		if err := q.Send(context.Background(), Message{ID: id, Body: []byte("body of " + id)}); err != nil {
+			t.Fatalf("send %s: %v", id, err)
+		}
+	}
+}
+
+func TestMemoryQueueReceivesInSendOrder(t *testing.T) {
+	q := NewMemory(0)
+	send(t, q, "a", "b", "c")
+
+	var got []*Delivery
+	got = append(got, receive(t, q, 2)...)
+	got = append(got, receive(t, q, 2)...)
+
+	if len(got) != 3 {
+		t.Fatalf("received %d deliveries, want 3", len(got))
+	}
+	for i, want := range []string{"a", "b", "c"} {
+		d := got[i]
+		if d.ID != want || string(d.Body) != "body of "+want {
+			t.Errorf("delivery %d = %s %q, want %s", i, d.ID, d.Body, want)
+		}
+		if d.Attempt != 1 {
+			t.Errorf("delivery %s attempt = %d, want 1", d.ID, d.Attempt)
+		}
+		if d.Sequence != int64(i+1) {
+			t.Errorf("delivery %s sequence = %d, want %d", d.ID, d.Sequence, i+1)
+		}
+	}
+}
+
+func TestMemoryQueueCopiesMessages(t *testing.T) {
+	q := NewMemory(0)
+	message := Message{ID: "a", Body: []byte("original"), Properties: map[string]any{"k": "v"}}
+	if err := q.Send(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+	message.Body[0] = 'X'
+	message.Properties["k"] = "changed"
+
+	d := receive(t, q, 1)[0]
+	if string(d.Body) != "original" || d.Properties["k"] != "v" {
+		t.Errorf("received %q %v, want the message as it was sent", d.Body, d.Properties)
+	}
+}
+
+func TestMemoryQueueAbandonRedelivers(t *testing.T) {
+	q := NewMemory(0)
+	send(t, q, "a", "b")
+
+	first := receive(t, q, 1)[0]
+	if err := q.Abandon(context.Background(), first); err != nil {
+		t.Fatal(err)
+	}
+
+	got := receive(t, q, 2)
+	if len(got) != 2 {
+		t.Fatalf("received %d deliveries, want 2", len(got))
+	}
+	// The abandoned message goes back in front
+	if got[0].ID != "a" || got[0].Attempt != 2 {
+		t.Errorf("first redelivery = %s attempt %d, want a attempt 2", got[0].ID, got[0].Attempt)
+	}
+	if got[1].ID != "b" || got[1].Attempt != 1 {
+		t.Errorf("second delivery = %s attempt %d, want b attempt 1", got[1].ID, got[1].Attempt)
+	}
+
+	// Settling the stale delivery again fails
+	if err := q.Complete(context.Background(), first); !errors.Is(err, ErrLockLost) {
+		t.Errorf("complete of a settled delivery = %v, want ErrLockLost", err)
+	}
+}
+
+func TestMemoryQueueLockExpiry(t *testing.T) {
+	q := NewMemory(20 * time.Millisecond)
+	send(t, q, "a")
+
+	expired := receive(t, q, 1)[0]
+	time.Sleep(30 * time.Millisecond)
+
+	if err := q.Complete(context.Background(), expired); !errors.Is(err, ErrLockLost) {
+		t.Fatalf("complete after lock expiry = %v, want ErrLockLost", err)
+	}
+
+	redelivered := receive(t, q, 1)[0]
+	if redelivered.ID != "a" || redelivered.Attempt != 2 {
+		t.Fatalf("redelivery = %s attempt %d, want a attempt 2", redelivered.ID, redelivered.Attempt)
+	}
+	if err := q.Complete(context.Background(), redelivered); err != nil {
+		t.Fatalf("complete within the lock: %v", err)
+	}
+	if q.Pending() != 0 || q.InFlight() != 0 {
+		t.Errorf("pending=%d inFlight=%d after complete, want 0", q.Pending(), q.InFlight())
+	}
+}
+
+func TestMemoryQueueReceiveWaitsForSend(t *testing.T) {
+	q := NewMemory(0)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Send(context.Background(), Message{ID: "late"})
+	}()
+
+	if got := receive(t, q, 1); got[0].ID != "late" {
+		t.Errorf("received %s, want late", got[0].ID)
+	}
+}
+
+func TestMemoryQueueSendWakesEveryReceiver(t *testing.T) {
+	q := NewMemory(0)
+
+	const receivers = 2
+	received := make(chan string, receivers)
+	for range receivers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			deliveries, err := q.Receive(ctx, 1)
+			if err != nil {
+				received <- err.Error()
+				return
+			}
+			received <- deliveries[0].ID
+		}()
+	}
+
+	// Both receivers wait before one Send makes two messages ready
+	time.Sleep(10 * time.Millisecond)
+	if err := q.Send(context.Background(), Message{ID: "a"}, Message{ID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]bool{}
+	for range receivers {
+		got[<-received] = true
+	}
+	if !got["a"] || !got["b"] {
+		t.Errorf("receivers got %v, want a and b", got)
+	}
+}
+
+func TestMemoryQueueReceiveRejectsNonPositiveMax(t *testing.T) {
+	q := NewMemory(0)
+	send(t, q, "a")
+
+	for _, maxMessages := range []int{0, -1} {
+		if _, err := q.Receive(context.Background(), maxMessages); err == nil {
+			t.Errorf("receive of %d messages succeeded, want an error", maxMessages)
+		}
+	}
+}
+
+func TestMemoryQueueZeroValue(t *testing.T) {
+	var q MemoryQueue
+	send(t, &q, "a")
+
+	d := receive(t, &q, 1)[0]
+	if err := q.Complete(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.Receive(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("receive on an empty queue = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestMemoryQueueClose(t *testing.T) {
+	q := NewMemory(0)
+	done := make(chan error, 1)
+	go func() {
+		_, err := q.Receive(context.Background(), 1)
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	q.Close(context.Background())
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("receive after close = %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close did not wake a waiting receive")
+	}
+	if err := q.Send(context.Background(), Message{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("send after close = %v, want ErrClosed", err)
+	}
+}
+
+func TestPumpSettles(t *testing.T) {
+	q := NewMemory(0)
+	send(t, q, "ok", "flaky")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// flaky fails on its first attempt and succeeds when redelivered
+	handler := func(ctx context.Context, d *Delivery) error {
+		if d.ID == "flaky" && d.Attempt == 1 {
+			return errors.New("first attempt fails")
+		}
+		return nil
+	}
+
+	type settled struct {
+		id      string
+		attempt uint32
+		failed  bool
+	}
+	var mu sync.Mutex
+	var got []settled
+	options := PumpOptions{
+		BatchSize: 1,
+		OnSettled: func(d *Delivery, handlerErr error) {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, settled{d.ID, d.Attempt, handlerErr != nil})
+			if len(got) == 3 {
+				cancel()
+			}
+		},
+	}
+
+	if err := Pump(ctx, q, handler, options); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []settled{{"ok", 1, false}, {"flaky", 1, true}, {"flaky", 2, false}}
+	if len(got) != len(want) {
+		t.Fatalf("settled %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("settlement %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if q.Pending() != 0 || q.InFlight() != 0 {
+		t.Errorf("pending=%d inFlight=%d after pump, want 0", q.Pending(), q.InFlight())
+	}
+}
+
+// interruptedReceiver returns its first deliveries together with the error of
+// a receive cut short by Ctrl+C, as ServiceBusReceiver does.
+type interruptedReceiver struct {
+	*MemoryQueue
+	cancel context.CancelFunc
+}
+
+func (r interruptedReceiver) Receive(ctx context.Context, maxMessages int) ([]*Delivery, error) {
+	deliveries, err := r.MemoryQueue.Receive(ctx, maxMessages)
+	if err != nil {
+		return nil, err
+	}
+	r.cancel()
+	return deliveries, ctx.Err()
+}
+
+func TestPumpSettlesDeliveriesReturnedWithError(t *testing.T) {
+	q := NewMemory(0)
+	send(t, q, "a", "b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var handled []string
+	handler := func(ctx context.Context, d *Delivery) error {
+		handled = append(handled, d.ID)
+		return nil
+	}
+	if err := Pump(ctx, interruptedReceiver{q, cancel}, handler, PumpOptions{BatchSize: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(handled) != 2 {
+		t.Errorf("handled %v, want a and b", handled)
+	}
+	if q.Pending() != 0 || q.InFlight() != 0 {
+		t.Errorf("pending=%d inFlight=%d after pump, want 0", q.Pending(), q.InFlight())
+	}
+}
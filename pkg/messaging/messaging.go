@@ -0,0 +1,165 @@
+// Package messaging puts Service Bus queues, Storage queues and Event Hubs
+// behind the same Sender and Receiver interfaces, plus an in-memory queue for
+// unit-testing handlers without any broker.
+//
+// The interfaces only cover what all transports share: send a message,
+// receive it, then complete it or hand it back. What each transport does on
+// top of that (redelivery, ordering, properties) is described by Semantics,
+// so the same handler can be run against each one to compare them. Features
+// outside that common ground, such as dead-lettering or visibility timeouts,
+// stay with the SDK code of each lab app.
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	// ErrLockLost is returned when a delivery is settled after its lock expired
+	// and it may already have been given to another receiver.
+	ErrLockLost = errors.New("messaging: delivery lock lost")
+	// ErrClosed is returned by calls on a closed sender or receiver.
+	ErrClosed = errors.New("messaging: closed")
+)
+
+// Message is what senders send.
+type Message struct {
+	// ID identifies the message for duplicate detection where the transport
+	// supports it. Storage queues assign their own IDs and ignore it.
+	ID   string
+	Body []byte
+	// Properties are application properties. Storage queues have none and
+	// refuse messages that set them.
+	Properties map[string]any
+	// Key groups related messages: the SessionID on Service Bus and the
+	// partition key on Event Hubs. Storage queues ignore it.
+	Key string
+}
+
+// Delivery is a received message.
+type Delivery struct {
+	Message
+	// Attempt is 1 on first delivery and grows with every redelivery. Event
+	// Hubs never redelivers and always reports 1.
+	Attempt uint32
+	// Sequence is the position in the queue or partition; Storage queues have
+	// none and report 0.
+	Sequence   int64
+	EnqueuedAt time.Time
+
+	// native is the SDK message the receiver needs to settle the delivery.
+	native any
+}
+
+// Semantics describes the delivery guarantees of a transport.
+type Semantics struct {
+	Transport string
+	// Redelivery is true when Abandon makes the message available again.
+	Redelivery bool
+	// OrderedByKey is true when messages with the same Key are received in
+	// the order they were sent.
+	OrderedByKey bool
+	// Properties is true when application properties are carried.
+	Properties bool
+	// MaxMessageBytes is the largest body the transport accepts.
+	MaxMessageBytes int
+}
+
+func (s Semantics) String() string {
+	return fmt.Sprintf("transport=%s redelivery=%t orderedByKey=%t properties=%t maxMessageBytes=%d",
+		s.Transport, s.Redelivery, s.OrderedByKey, s.Properties, s.MaxMessageBytes)
+}
+
+// Sender is implemented by ServiceBusSender, StorageQueueSender,
+// EventHubsSender and MemoryQueue.
+type Sender interface {
+	// Send sends messages, batching them where the transport allows.
+	Send(ctx context.Context, messages ...Message) error
+	Semantics() Semantics
+	Close(ctx context.Context) error
+}
+
+// Receiver is implemented by ServiceBusReceiver, StorageQueueReceiver,
+// EventHubsReceiver and MemoryQueue.
+type Receiver interface {
+	// Receive waits until at least one message is available and returns up to
+	// maxMessages of them. It returns ctx.Err() if ctx is done first. Deliveries
+	// returned together with an error were still received and must be settled.
+	Receive(ctx context.Context, maxMessages int) ([]*Delivery, error)
+	// Complete removes the delivery so it is not received again.
+	Complete(ctx context.Context, delivery *Delivery) error
+	// Abandon hands the delivery back for redelivery, if the transport has it.
+	Abandon(ctx context.Context, delivery *Delivery) error
+	Semantics() Semantics
+	Close(ctx context.Context) error
+}
+
+// Handler processes one delivery. Returning an error abandons it.
+type Handler func(ctx context.Context, delivery *Delivery) error
+
+// PumpOptions controls Pump.
+type PumpOptions struct {
+	// BatchSize is the maxMessages passed to Receive. 0 means 10.
+	BatchSize int
+	// OnSettled, when set, is called after each delivery is settled with the
+	// handler error, which is nil for completed deliveries.
+	OnSettled func(delivery *Delivery, handlerErr error)
+}
+
+// Pump receives from receiver until ctx is cancelled, completing every
+// delivery handler accepts and abandoning the others. Deliveries already
+// received when ctx is cancelled are still handled and settled.
+func Pump(ctx context.Context, receiver Receiver, handler Handler, options PumpOptions) error {
+	if options.BatchSize == 0 {
+		options.BatchSize = 10
+	}
+	// Received deliveries are ours until settled, so they outlive Ctrl+C
+	handleCtx := context.WithoutCancel(ctx)
+
+	for {
+		deliveries, err := receiver.Receive(ctx, options.BatchSize)
+
+		// Deliveries returned with an error are handled before giving up
+		for _, delivery := range deliveries {
+			var settleErr error
+			handlerErr := handler(handleCtx, delivery)
+			if handlerErr == nil {
+				settleErr = receiver.Complete(handleCtx, delivery)
+			} else {
+				settleErr = receiver.Abandon(handleCtx, delivery)
+			}
+			if settleErr != nil {
+				log.Printf("settle message %s: %v", delivery.ID, settleErr)
+			}
+
+			if options.OnSettled != nil {
+				options.OnSettled(delivery, handlerErr)
+			}
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("receive: %w", err)
+		}
+	}
+}
+
+// copyMessage returns m with its own body and properties, so later changes by
+// the caller do not reach a stored or sent message.
+func copyMessage(m Message) Message {
+	m.Body = append([]byte(nil), m.Body...)
+	if m.Properties != nil {
+		properties := make(map[string]any, len(m.Properties))
+		for k, v := range m.Properties {
+			properties[k] = v
+		}
+		m.Properties = properties
+	}
+	return m
+}
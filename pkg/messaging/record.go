@@ -0,0 +1,224 @@
+package messaging
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Record is one line of an NDJSON recording: a received message with its
+// properties and timestamps.
+type Record struct {
+	Transport  string         `json:"transport,omitempty"`
+	ID         string         `json:"id,omitempty"`
+	Key        string         `json:"key,omitempty"`
+	Properties map[string]any `json:"properties,omitempty"`
+	// Body is the body as text, or base64 when Base64 is set because the body
+	// is not valid UTF-8.
+	Body       string    `json:"body"`
+	Base64     bool      `json:"base64,omitempty"`
+	Attempt    uint32    `json:"attempt,omitempty"`
+	Sequence   int64     `json:"sequence,omitempty"`
+	EnqueuedAt time.Time `json:"enqueuedAt,omitzero"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// NewRecord captures delivery, received now over transport.
+func NewRecord(transport string, delivery *Delivery) Record {
+	record := Record{
+		Transport:  transport,
+		ID:         delivery.ID,
+		Key:        delivery.Key,
+		Properties: delivery.Properties,
+		Attempt:    delivery.Attempt,
+		Sequence:   delivery.Sequence,
+		EnqueuedAt: delivery.EnqueuedAt,
+		ReceivedAt: time.Now().UTC(),
+	}
+
+	if utf8.Valid(delivery.Body) {
+		record.Body = string(delivery.Body)
+	} else {
+		record.Body = base64.StdEncoding.EncodeToString(delivery.Body)
+		record.Base64 = true
+	}
+	return record
+}
+
+// Time is when the message was originally sent: its enqueue time if the
+// transport reported one, otherwise when it was received.
+func (r Record) Time() time.Time {
+	if !r.EnqueuedAt.IsZero() {
+		return r.EnqueuedAt
+	}
+	return r.ReceivedAt
+}
+
+// Message returns the recorded message, ready to be sent again.
+func (r Record) Message() (Message, error) {
+	body := []byte(r.Body)
+	if r.Base64 {
+		decoded, err := base64.StdEncoding.DecodeString(r.Body)
+		if err != nil {
+			return Message{}, fmt.Errorf("decode body of %s: %w", r.ID, err)
+		}
+		body = decoded
+	}
+	return Message{ID: r.ID, Key: r.Key, Properties: r.Properties, Body: body}, nil
+}
+
+// Recorder appends records to an NDJSON file. Only first deliveries are
+// recorded, so a replay sends every message once however often it was
+// redelivered. It is safe for concurrent use.
+type Recorder struct {
+	mu    sync.Mutex
+	file  *os.File
+	enc   *json.Encoder
+	count int
+}
+
+// CreateRecorder opens path for appending, creating it if needed, so several
+// runs can add to the same recording.
+func CreateRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open recording: %w", err)
+	}
+	return &Recorder{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// Write records delivery, received over transport, and skips redeliveries.
+func (r *Recorder) Write(transport string, delivery *Delivery) error {
+	if delivery.Attempt > 1 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.enc.Encode(NewRecord(transport, delivery)); err != nil {
+		return fmt.Errorf("write record %s: %w", delivery.ID, err)
+	}
+	r.count++
+	return nil
+}
+
+// RecordingHandler records first deliveries before passing every delivery to
+// next. A failed write is logged and does not stop the message from being
+// handled.
+func RecordingHandler(recorder *Recorder, transport string, next Handler) Handler {
+	return func(ctx context.Context, delivery *Delivery) error {
+		if err := recorder.Write(transport, delivery); err != nil {
+			log.Print(err)
+		}
+		return next(ctx, delivery)
+	}
+}
+
+// Close closes the file and reports how many records were written.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	log.Printf("Recorded %d message(s) to %s", r.count, r.file.Name())
+	return r.file.Close()
+}
+
+// ReadRecording reads every record of an NDJSON recording. Numeric
+// properties come back as int64 when they are whole numbers, float64 otherwise.
+func ReadRecording(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open recording: %w", err)
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.UseNumber()
+
+		var record Record
+		if err := decoder.Decode(&record); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		for key, value := range record.Properties {
+			record.Properties[key] = numberValue(value)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read recording: %w", err)
+	}
+	return records, nil
+}
+
+func numberValue(value any) any {
+	number, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+	if i, err := number.Int64(); err == nil {
+		return i
+	}
+	if f, err := number.Float64(); err == nil {
+		return f
+	}
+	return number.String()
+}
+
+// Replay sends records through sender in the order of their original times,
+// keeping the gaps between them divided by speed: 1 is real time, 2 twice as
+// fast, and 0 sends everything at once. Records with the same time keep their
+// order. It returns how many records were sent.
+func Replay(ctx context.Context, sender Sender, records []Record, speed float64) (int, error) {
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	// Concurrent workers and appended runs do not write records in time order
+	records = slices.Clone(records)
+	slices.SortStableFunc(records, func(a, b Record) int { return a.Time().Compare(b.Time()) })
+
+	first := records[0].Time()
+	start := time.Now()
+
+	for i, record := range records {
+		if speed > 0 {
+			offset := time.Duration(float64(record.Time().Sub(first)) / speed)
+			select {
+			case <-ctx.Done():
+				return i, nil
+			case <-time.After(time.Until(start.Add(offset))):
+			}
+		}
+
+		message, err := record.Message()
+		if err != nil {
+			return i, err
+		}
+		if err := sender.Send(ctx, message); err != nil {
+			if ctx.Err() != nil {
+				return i, nil
+			}
+			return i, fmt.Errorf("replay record %d (%s): %w", i+1, record.ID, err)
+		}
+		log.Printf("Replayed #%d id=%s originally at %s", i+1, record.ID, record.Time().Format(time.RFC3339Nano))
+	}
+	return len(records), nil
+}
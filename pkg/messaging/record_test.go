@@ -0,0 +1,91 @@
+package messaging
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRecorderSkipsRedeliveries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.ndjson")
+	recorder, err := CreateRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := Message{ID: "a", Body: []byte("hello"), Properties: map[string]any{"n": int64(1)}}
+	for attempt := uint32(1); attempt <= 3; attempt++ {
+		if err := recorder.Write("memory", &Delivery{Message: message, Attempt: attempt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.Write("memory", &Delivery{Message: Message{ID: "b", Body: []byte{0xff}}, Attempt: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("read %d records, want 2: the redeliveries of a must be skipped", len(records))
+	}
+
+	q := NewMemory(0)
+	sent, err := Replay(context.Background(), q, records, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 || q.Pending() != 2 {
+		t.Fatalf("replayed %d, pending %d, want 2", sent, q.Pending())
+	}
+
+	got := receive(t, q, 2)
+	if got[0].ID != "a" || string(got[0].Body) != "hello" || got[0].Properties["n"] != int64(1) {
+		t.Errorf("replayed %s %q %v, want a as recorded", got[0].ID, got[0].Body, got[0].Properties)
+	}
+	// Bodies that are not UTF-8 survive through base64
+	if got[1].ID != "b" || string(got[1].Body) != "\xff" {
+		t.Errorf("replayed %s %q, want b with its binary body", got[1].ID, got[1].Body)
+	}
+}
+
+func TestReplaySortsByTime(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// As written by two workers, with c and d received at the same time
+	records := []Record{
+		{ID: "c", Body: "c", ReceivedAt: base.Add(20 * time.Millisecond)},
+		{ID: "b", Body: "b", EnqueuedAt: base.Add(10 * time.Millisecond), ReceivedAt: base.Add(time.Hour)},
+		{ID: "a", Body: "a", ReceivedAt: base},
+		{ID: "d", Body: "d", ReceivedAt: base.Add(20 * time.Millisecond)},
+	}
+
+	q := NewMemory(0)
+	start := time.Now()
+	sent, err := Replay(context.Background(), q, records, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("replay took %s, want about the 20ms between the first and last record", elapsed)
+	}
+	if sent != len(records) {
+		t.Fatalf("replayed %d, want %d", sent, len(records))
+	}
+
+	var got []string
+	for _, d := range receive(t, q, len(records)) {
+		got = append(got, d.ID)
+	}
+	if want := []string{"a", "b", "c", "d"}; !slices.Equal(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+	if records[0].ID != "c" {
+		t.Errorf("Replay reordered the caller's records")
+	}
+}
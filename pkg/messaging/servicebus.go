@@ -0,0 +1,172 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+var serviceBusSemantics = Semantics{
+	Transport:       "servicebus",
+	Redelivery:      true,
+	OrderedByKey:    true, // with sessions; Key becomes the SessionID
+	Properties:      true,
+	MaxMessageBytes: 256 * 1024, // Standard tier
+}
+
+// ServiceBusSender sends to a Service Bus queue or topic.
+type ServiceBusSender struct {
+	sender *azservicebus.Sender
+	// client is closed with the sender when OpenSender created it
+	client *azservicebus.Client
+}
+
+var _ Sender = (*ServiceBusSender)(nil)
+
+// NewServiceBusSender wraps sender. Close closes it.
+func NewServiceBusSender(sender *azservicebus.Sender) *ServiceBusSender {
+	return &ServiceBusSender{sender: sender}
+}
+
+func (s *ServiceBusSender) Semantics() Semantics {
+	return serviceBusSemantics
+}
+
+// Send fills as few batches as possible with messages and sends them in order.
+func (s *ServiceBusSender) Send(ctx context.Context, messages ...Message) error {
+	batch, err := s.sender.NewMessageBatch(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("new message batch: %w", err)
+	}
+
+	for _, m := range messages {
+		message := &azservicebus.Message{
+			Body:                  m.Body,
+			ApplicationProperties: m.Properties,
+		}
+		if m.ID != "" {
+			message.MessageID = &m.ID
+		}
+		if m.Key != "" {
+			message.SessionID = &m.Key
+		}
+
+		err := batch.AddMessage(message, nil)
+		if errors.Is(err, azservicebus.ErrMessageTooLarge) && batch.NumMessages() > 0 {
+			if err := s.sender.SendMessageBatch(ctx, batch, nil); err != nil {
+				return fmt.Errorf("send message batch: %w", err)
+			}
+			if batch, err = s.sender.NewMessageBatch(ctx, nil); err != nil {
+				return fmt.Errorf("new message batch: %w", err)
+			}
+			err = batch.AddMessage(message, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("add message %s: %w", m.ID, err)
+		}
+	}
+
+	if batch.NumMessages() == 0 {
+		return nil
+	}
+	if err := s.sender.SendMessageBatch(ctx, batch, nil); err != nil {
+		return fmt.Errorf("send message batch: %w", err)
+	}
+	return nil
+}
+
+func (s *ServiceBusSender) Close(ctx context.Context) error {
+	err := s.sender.Close(ctx)
+	if s.client != nil {
+		err = errors.Join(err, s.client.Close(ctx))
+	}
+	return err
+}
+
+// ServiceBusReceiver receives from a Service Bus queue or subscription in
+// peek-lock mode.
+type ServiceBusReceiver struct {
+	receiver *azservicebus.Receiver
+	// client is closed with the receiver when OpenReceiver created it
+	client *azservicebus.Client
+}
+
+var _ Receiver = (*ServiceBusReceiver)(nil)
+
+// NewServiceBusReceiver wraps receiver, which must use peek-lock. Close
+// closes it.
+func NewServiceBusReceiver(receiver *azservicebus.Receiver) *ServiceBusReceiver {
+	return &ServiceBusReceiver{receiver: receiver}
+}
+
+func (r *ServiceBusReceiver) Semantics() Semantics {
+	return serviceBusSemantics
+}
+
+func (r *ServiceBusReceiver) Receive(ctx context.Context, maxMessages int) ([]*Delivery, error) {
+	for {
+		messages, err := r.receiver.ReceiveMessages(ctx, maxMessages, nil)
+
+		// Messages can come with an error, e.g. when ctx is cancelled mid-receive.
+		// They are locked to this receiver either way, so they are returned to be
+		// settled rather than left locked until their lock expires.
+		deliveries := make([]*Delivery, 0, len(messages))
+		for _, message := range messages {
+			deliveries = append(deliveries, ServiceBusDelivery(message))
+		}
+		if ctx.Err() != nil {
+			return deliveries, ctx.Err()
+		}
+		if err != nil {
+			return deliveries, err
+		}
+		if len(deliveries) > 0 {
+			return deliveries, nil
+		}
+	}
+}
+
+// ServiceBusDelivery converts a message received with the Service Bus SDK, so
+// apps that settle messages themselves can still record them.
+func ServiceBusDelivery(message *azservicebus.ReceivedMessage) *Delivery {
+	return &Delivery{
+		Message: Message{
+			ID:         message.MessageID,
+			Body:       message.Body,
+			Properties: message.ApplicationProperties,
+			Key:        ptr.Deref(message.SessionID),
+		},
+		Attempt:    message.DeliveryCount,
+		Sequence:   ptr.Deref(message.SequenceNumber),
+		EnqueuedAt: ptr.Deref(message.EnqueuedTime),
+		native:     message,
+	}
+}
+
+func (r *ServiceBusReceiver) Complete(ctx context.Context, delivery *Delivery) error {
+	return r.settleErr(r.receiver.CompleteMessage(ctx, delivery.native.(*azservicebus.ReceivedMessage), nil))
+}
+
+func (r *ServiceBusReceiver) Abandon(ctx context.Context, delivery *Delivery) error {
+	return r.settleErr(r.receiver.AbandonMessage(ctx, delivery.native.(*azservicebus.ReceivedMessage), nil))
+}
+
+func (r *ServiceBusReceiver) settleErr(err error) error {
+	var sbErr *azservicebus.Error
+	if errors.As(err, &sbErr) && sbErr.Code == azservicebus.CodeLockLost {
+		return fmt.Errorf("%w: %v", ErrLockLost, err)
+	}
+	return err
+}
+
+func (r *ServiceBusReceiver) Close(ctx context.Context) error {
+	err := r.receiver.Close(ctx)
+	if r.client != nil {
+		err = errors.Join(err, r.client.Close(ctx))
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package messaging
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue/queueerror"
+
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+var storageQueueSemantics = Semantics{
+	Transport:       "storagequeue",
+	Redelivery:      true,
+	MaxMessageBytes: 64 * 1024,
+}
+
+// StorageQueueOptions controls the Storage queue sender and receiver.
+type StorageQueueOptions struct {
+	// Base64 encodes message text, as Functions queue triggers expect.
+	Base64 bool
+	// VisibilityTimeout is how long a received message stays hidden from
+	// other receivers. 0 means 30s.
+	VisibilityTimeout time.Duration
+	// PollInterval is the wait between dequeues of an empty queue. 0 means 1s.
+	PollInterval time.Duration
+}
+
+func (o *StorageQueueOptions) withDefaults() StorageQueueOptions {
+	var options StorageQueueOptions
+	if o != nil {
+		options = *o
+	}
+	if options.VisibilityTimeout == 0 {
+		options.VisibilityTimeout = 30 * time.Second
+	}
+	if options.PollInterval == 0 {
+		options.PollInterval = time.Second
+	}
+	return options
+}
+
+// StorageQueueSender enqueues to a Storage queue.
+type StorageQueueSender struct {
+	queue   *azqueue.QueueClient
+	options StorageQueueOptions
+}
+
+var _ Sender = (*StorageQueueSender)(nil)
+
+// NewStorageQueueSender sends to queue; nil options use the defaults.
+func NewStorageQueueSender(queue *azqueue.QueueClient, options *StorageQueueOptions) *StorageQueueSender {
+	return &StorageQueueSender{queue: queue, options: options.withDefaults()}
+}
+
+func (s *StorageQueueSender) Semantics() Semantics {
+	return storageQueueSemantics
+}
+
+// Send enqueues messages one by one; the queue has no batch operation.
+func (s *StorageQueueSender) Send(ctx context.Context, messages ...Message) error {
+	for _, m := range messages {
+		if len(m.Properties) > 0 {
+			return fmt.Errorf("message %s: storage queues have no application properties: %w", m.ID, errors.ErrUnsupported)
+		}
+
+		text := string(m.Body)
+		if s.options.Base64 {
+			text = base64.StdEncoding.EncodeToString(m.Body)
+		}
+		if _, err := s.queue.EnqueueMessage(ctx, text, nil); err != nil {
+			return fmt.Errorf("enqueue message: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *StorageQueueSender) Close(ctx context.Context) error {
+	return nil
+}
+
+// StorageQueueReceiver dequeues from a Storage queue. A dequeued message is
+// hidden for VisibilityTimeout and reappears if it is not completed in time.
+type StorageQueueReceiver struct {
+	queue   *azqueue.QueueClient
+	options StorageQueueOptions
+}
+
+var _ Receiver = (*StorageQueueReceiver)(nil)
+
+// NewStorageQueueReceiver receives from queue; nil options use the defaults.
+func NewStorageQueueReceiver(queue *azqueue.QueueClient, options *StorageQueueOptions) *StorageQueueReceiver {
+	return &StorageQueueReceiver{queue: queue, options: options.withDefaults()}
+}
+
+func (r *StorageQueueReceiver) Semantics() Semantics {
+	return storageQueueSemantics
+}
+
+// Receive polls the queue every PollInterval until it returns messages.
+func (r *StorageQueueReceiver) Receive(ctx context.Context, maxMessages int) ([]*Delivery, error) {
+	dequeueOptions := &azqueue.DequeueMessagesOptions{
+		NumberOfMessages:  ptr.To(int32(min(max(maxMessages, 1), 32))),
+		VisibilityTimeout: ptr.To(int32(r.options.VisibilityTimeout / time.Second)),
+	}
+
+	for {
+		resp, err := r.queue.DequeueMessages(ctx, dequeueOptions)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("dequeue messages: %w", err)
+		}
+
+		if len(resp.Messages) > 0 {
+			deliveries := make([]*Delivery, 0, len(resp.Messages))
+			for _, message := range resp.Messages {
+				delivery, err := r.delivery(message)
+				if err != nil {
+					return nil, err
+				}
+				deliveries = append(deliveries, delivery)
+			}
+			return deliveries, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(r.options.PollInterval):
+		}
+	}
+}
+
+func (r *StorageQueueReceiver) delivery(message *azqueue.DequeuedMessage) (*Delivery, error) {
+	body := []byte(ptr.Deref(message.MessageText))
+	if r.options.Base64 {
+		decoded, err := base64.StdEncoding.DecodeString(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("decode message %s: %w", ptr.Deref(message.MessageID), err)
+		}
+		body = decoded
+	}
+	return StorageQueueDelivery(message, body), nil
+}
+
+// StorageQueueDelivery converts a message dequeued with the Storage queue
+// SDK, whose text decodes to body, so apps that delete messages themselves
+// can still record them.
+func StorageQueueDelivery(message *azqueue.DequeuedMessage, body []byte) *Delivery {
+	return &Delivery{
+		Message:    Message{ID: ptr.Deref(message.MessageID), Body: body},
+		Attempt:    uint32(ptr.Deref(message.DequeueCount)),
+		EnqueuedAt: ptr.Deref(message.InsertionTime),
+		native:     message,
+	}
+}
+
+func (r *StorageQueueReceiver) Complete(ctx context.Context, delivery *Delivery) error {
+	message := delivery.native.(*azqueue.DequeuedMessage)
+	_, err := r.queue.DeleteMessage(ctx, ptr.Deref(message.MessageID), ptr.Deref(message.PopReceipt), nil)
+	return r.settleErr(err)
+}
+
+// Abandon makes the message visible again right away instead of after the
+// visibility timeout.
+func (r *StorageQueueReceiver) Abandon(ctx context.Context, delivery *Delivery) error {
+	message := delivery.native.(*azqueue.DequeuedMessage)
+	_, err := r.queue.UpdateMessage(ctx, ptr.Deref(message.MessageID), ptr.Deref(message.PopReceipt), ptr.Deref(message.MessageText),
+		&azqueue.UpdateMessageOptions{VisibilityTimeout: ptr.To(int32(0))})
+	return r.settleErr(err)
+}
+
+// settleErr maps a stale pop receipt, which means the visibility timeout
+// expired and the message was dequeued again, to ErrLockLost.
+func (r *StorageQueueReceiver) settleErr(err error) error {
+	if queueerror.HasCode(err, queueerror.PopReceiptMismatch, queueerror.MessageNotFound) {
+		return fmt.Errorf("%w: %v", ErrLockLost, err)
+	}
+	return err
+}
+
+func (r *StorageQueueReceiver) Close(ctx context.Context) error {
+	return nil
+}
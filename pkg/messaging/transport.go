@@ -0,0 +1,135 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs/v2"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+
+	"github.com/neovasili/training-az-204/pkg/ptr"
+)
+
+// Transports lists the names accepted by OpenSender and OpenReceiver.
+var Transports = []string{"servicebus", "storagequeue", "eventhubs"}
+
+// Endpoints locates the queue or hub behind each transport.
+type Endpoints struct {
+	ServiceBusNamespace string // <namespace>.servicebus.windows.net
+	ServiceBusQueue     string
+	StorageQueueService string // https://<account>.queue.core.windows.net
+	StorageQueue        string
+	EventHubsNamespace  string // <namespace>.servicebus.windows.net
+	EventHub            string
+	ConsumerGroup       string
+}
+
+// LabEndpoints are the resources created by the Pulumi stacks of the
+// Service Bus, Storage queue and Event Hubs labs.
+var LabEndpoints = Endpoints{
+	ServiceBusNamespace: "service-bus-test-sbns.servicebus.windows.net",
+	ServiceBusQueue:     "training-queue",
+	StorageQueueService: "https://storagequeuetestaz204q.queue.core.windows.net",
+	StorageQueue:        "training-queue",
+	EventHubsNamespace:  "event-hub-test-ehns.servicebus.windows.net",
+	EventHub:            "training-events",
+	ConsumerGroup:       "training-cg",
+}
+
+// OpenSender connects a Sender of the named transport using AAD.
+func OpenSender(ctx context.Context, transport string, endpoints Endpoints, credential azcore.TokenCredential) (Sender, error) {
+	switch transport {
+	case "servicebus":
+		client, err := azservicebus.NewClient(endpoints.ServiceBusNamespace, credential, nil)
+		if err != nil {
+			return nil, fmt.Errorf("service bus client: %w", err)
+		}
+		sender, err := client.NewSender(endpoints.ServiceBusQueue, nil)
+		if err != nil {
+			return nil, fmt.Errorf("new sender: %w", err)
+		}
+		return &ServiceBusSender{sender: sender, client: client}, nil
+	case "storagequeue":
+		queue, err := newStorageQueueClient(endpoints, credential)
+		if err != nil {
+			return nil, err
+		}
+		return NewStorageQueueSender(queue, nil), nil
+	case "eventhubs":
+		producer, err := azeventhubs.NewProducerClient(endpoints.EventHubsNamespace, endpoints.EventHub, credential, nil)
+		if err != nil {
+			return nil, fmt.Errorf("new producer: %w", err)
+		}
+		return NewEventHubsSender(producer), nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q, expected one of %v", transport, Transports)
+	}
+}
+
+// OpenReceiver connects a Receiver of the named transport using AAD. Event
+// Hubs receivers start at the latest event of every partition.
+func OpenReceiver(ctx context.Context, transport string, endpoints Endpoints, credential azcore.TokenCredential) (Receiver, error) {
+	switch transport {
+	case "servicebus":
+		client, err := azservicebus.NewClient(endpoints.ServiceBusNamespace, credential, nil)
+		if err != nil {
+			return nil, fmt.Errorf("service bus client: %w", err)
+		}
+		receiver, err := client.NewReceiverForQueue(endpoints.ServiceBusQueue, nil)
+		if err != nil {
+			return nil, fmt.Errorf("new receiver: %w", err)
+		}
+		return &ServiceBusReceiver{receiver: receiver, client: client}, nil
+	case "storagequeue":
+		queue, err := newStorageQueueClient(endpoints, credential)
+		if err != nil {
+			return nil, err
+		}
+		return NewStorageQueueReceiver(queue, nil), nil
+	case "eventhubs":
+		consumer, err := azeventhubs.NewConsumerClient(endpoints.EventHubsNamespace, endpoints.EventHub, endpoints.ConsumerGroup, credential, nil)
+		if err != nil {
+			return nil, fmt.Errorf("new consumer: %w", err)
+		}
+		return NewEventHubsReceiver(ctx, consumer, azeventhubs.StartPosition{Latest: ptr.To(true)})
+	default:
+		return nil, fmt.Errorf("unknown transport %q, expected one of %v", transport, Transports)
+	}
+}
+
+func newStorageQueueClient(endpoints Endpoints, credential azcore.TokenCredential) (*azqueue.QueueClient, error) {
+	service, err := azqueue.NewServiceClient(endpoints.StorageQueueService, credential, nil)
+	if err != nil {
+		return nil, fmt.Errorf("queue service client: %w", err)
+	}
+	return service.NewQueueClient(endpoints.StorageQueue), nil
+}
+
+// SendEvery sends the message returned by next every interval until count
+// messages are sent (0 = no limit) or ctx is cancelled, and returns how many
+// were sent.
+func SendEvery(ctx context.Context, sender Sender, interval time.Duration, count int, next func(n int) Message) (int, error) {
+	sent := 0
+	for count == 0 || sent < count {
+		message := next(sent + 1)
+		if err := sender.Send(ctx, message); err != nil {
+			if ctx.Err() != nil {
+				return sent, nil
+			}
+			return sent, err
+		}
+		sent++
+		log.Printf("Sent message #%d id=%s (%d bytes)", sent, message.ID, len(message.Body))
+
+		select {
+		case <-ctx.Done():
+			return sent, nil
+		case <-time.After(interval):
+		}
+	}
+	return sent, nil
+}
@@ -0,0 +1,17 @@
+// Package ptr has the two pointer helpers every lab app needs when filling
+// and reading Azure SDK models, where optional fields are pointers.
+package ptr
+
+// To returns a pointer to a copy of value.
+func To[T any](value T) *T {
+	return &value
+}
+
+// Deref returns the value p points to, or the zero value when p is nil.
+func Deref[T any](p *T) T {
+	if p == nil {
+		var zero T
+		return zero
+	}
+	return *p
+}